@@ -1,18 +1,20 @@
 #!/bin/sh
 
+# The blocklist is a hosts file, the StevenBlack hosts file is appended as is.
+
 BLOCKLIST='blocklist/blocklist.txt'
 
 rm -f $BLOCKLIST
 
-echo 'corp.target.com' >> $BLOCKLIST
-echo 'dist.target.com' >> $BLOCKLIST
-echo 'labs.target.com' >> $BLOCKLIST
-echo 'hq.target.com' >> $BLOCKLIST
-echo 'prod.target.com' >> $BLOCKLIST
-echo 'stores.target.com' >> $BLOCKLIST
-echo 'target.com.target.com' >> $BLOCKLIST
-echo '_udp.target.com' >> $BLOCKLIST
+echo '0.0.0.0 corp.target.com' >> $BLOCKLIST
+echo '0.0.0.0 dist.target.com' >> $BLOCKLIST
+echo '0.0.0.0 labs.target.com' >> $BLOCKLIST
+echo '0.0.0.0 hq.target.com' >> $BLOCKLIST
+echo '0.0.0.0 prod.target.com' >> $BLOCKLIST
+echo '0.0.0.0 stores.target.com' >> $BLOCKLIST
+echo '0.0.0.0 target.com.target.com' >> $BLOCKLIST
+echo '0.0.0.0 _udp.target.com' >> $BLOCKLIST
 
-curl --silent 'https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts' | grep '^0\.0\.0\.0' | grep -v '0\.0\.0\.0$' | sort -u | awk '{print $2}' >> $BLOCKLIST
+curl --silent 'https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts' >> $BLOCKLIST
 
 wc -l $BLOCKLIST
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
 	"runtime"
 	"syscall"
+	"time"
 
 	"github.com/aaronriekenberg/go-doh-proxy/proxy"
 	"github.com/kr/pretty"
@@ -13,11 +15,42 @@ import (
 
 var gitCommit string
 
-func awaitShutdownSignal() {
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+const stopTimeout = 10 * time.Second
+
+func reloadConfiguration(configFile string, dnsProxy proxy.DNSProxy) {
+	configuration, err := proxy.ReadConfiguration(configFile)
+	if err != nil {
+		log.Printf("proxy.ReadConfiguration error, keeping current configuration: %v", err)
+		return
+	}
+
+	if err := dnsProxy.Reload(configuration); err != nil {
+		log.Printf("dnsProxy.Reload error, keeping current configuration: %v", err)
+		return
+	}
+}
+
+func awaitShutdownSignal(configFile string, dnsProxy proxy.DNSProxy) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
 	s := <-sig
-	log.Fatalf("Signal (%v) received, stopping", s)
+	for s == syscall.SIGHUP {
+		log.Printf("Signal (%v) received, reloading", s)
+		reloadConfiguration(configFile, dnsProxy)
+		s = <-sig
+	}
+
+	log.Printf("Signal (%v) received, stopping", s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+
+	if err := dnsProxy.Stop(ctx); err != nil {
+		log.Fatalf("dnsProxy.Stop error: %v", err)
+	}
+
+	log.Printf("stopped")
 }
 
 func main() {
@@ -36,8 +69,11 @@ func main() {
 	}
 	log.Printf("configuration:\n%# v", pretty.Formatter(configuration))
 
-	dnsProxy := proxy.NewDNSProxy(configuration)
+	dnsProxy, err := proxy.NewDNSProxy(configuration)
+	if err != nil {
+		log.Fatalf("proxy.NewDNSProxy error: %v", err)
+	}
 	dnsProxy.Start()
 
-	awaitShutdownSignal()
+	awaitShutdownSignal(configFile, dnsProxy)
 }
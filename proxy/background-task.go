@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+)
+
+// backgroundTask tracks goroutines that run until stop is called.
+type backgroundTask struct {
+	stopChannel chan struct{}
+	stopOnce    sync.Once
+	waitGroup   sync.WaitGroup
+}
+
+func newBackgroundTask() *backgroundTask {
+	return &backgroundTask{
+		stopChannel: make(chan struct{}),
+	}
+}
+
+func (backgroundTask *backgroundTask) run(f func()) {
+	backgroundTask.waitGroup.Add(1)
+
+	go func() {
+		defer backgroundTask.waitGroup.Done()
+
+		f()
+	}()
+}
+
+// stopping is closed when stop is called.
+func (backgroundTask *backgroundTask) stopping() <-chan struct{} {
+	return backgroundTask.stopChannel
+}
+
+// stop signals all goroutines to return and waits for them until ctx is done.
+func (backgroundTask *backgroundTask) stop(ctx context.Context) error {
+	backgroundTask.stopOnce.Do(func() {
+		close(backgroundTask.stopChannel)
+	})
+
+	doneChannel := make(chan struct{})
+	go func() {
+		backgroundTask.waitGroup.Wait()
+		close(doneChannel)
+	}()
+
+	select {
+	case <-doneChannel:
+		return nil
+	case <-ctx.Done():
+	}
+
+	// ctx may already be done when stop is called, give finished goroutines priority
+	select {
+	case <-doneChannel:
+		return nil
+	default:
+		return ctx.Err()
+	}
+}
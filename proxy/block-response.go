@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	blockResponseModeNXDomain = "nxdomain"
+	blockResponseModeNoData   = "nodata"
+	blockResponseModeRefused  = "refused"
+	blockResponseModeNullIP   = "nullIP"
+	blockResponseModeSinkhole = "sinkhole"
+)
+
+const blockResponseDefaultTTLSeconds = 60
+
+// RFC 8914 Extended DNS Errors.  miekg/dns v1.1.31 has no EDNS0_EDE so EDNS0_LOCAL is used.
+const (
+	edns0ExtendedDNSErrorCode    = 15
+	extendedDNSErrorInfoBlocked  = 15
+	extendedDNSErrorBlockedText  = "blocked by go-doh-proxy"
+	blockResponseSOANameserver   = "blocked.invalid."
+	blockResponseSOAMailbox      = "hostmaster.blocked.invalid."
+	blockResponseOPTUDPSizeBytes = 1232
+)
+
+// blockResponder creates the responses to blocked queries.
+type blockResponder struct {
+	mode             string
+	sinkholeIPv4     net.IP
+	sinkholeIPv6     net.IP
+	ttlSeconds       uint32
+	extendedDNSError bool
+}
+
+func newBlockResponder(configuration *BlockResponseConfiguration) (*blockResponder, error) {
+	blockResponder := &blockResponder{
+		mode:             configuration.Mode,
+		ttlSeconds:       configuration.TTLSeconds,
+		extendedDNSError: configuration.ExtendedDNSError,
+	}
+
+	if len(blockResponder.mode) == 0 {
+		blockResponder.mode = blockResponseModeNXDomain
+	}
+
+	if blockResponder.ttlSeconds == 0 {
+		blockResponder.ttlSeconds = blockResponseDefaultTTLSeconds
+	}
+
+	switch blockResponder.mode {
+	case blockResponseModeNXDomain, blockResponseModeNoData, blockResponseModeRefused:
+
+	case blockResponseModeNullIP:
+		blockResponder.sinkholeIPv4 = net.IPv4zero.To4()
+		blockResponder.sinkholeIPv6 = net.IPv6zero
+
+	case blockResponseModeSinkhole:
+		if len(configuration.SinkholeIPv4) > 0 {
+			if blockResponder.sinkholeIPv4 = net.ParseIP(configuration.SinkholeIPv4).To4(); blockResponder.sinkholeIPv4 == nil {
+				return nil, fmt.Errorf("invalid sinkholeIPv4 %q", configuration.SinkholeIPv4)
+			}
+		}
+		if len(configuration.SinkholeIPv6) > 0 {
+			ip := net.ParseIP(configuration.SinkholeIPv6)
+			if (ip == nil) || (ip.To4() != nil) {
+				return nil, fmt.Errorf("invalid sinkholeIPv6 %q", configuration.SinkholeIPv6)
+			}
+			blockResponder.sinkholeIPv6 = ip
+		}
+		if (blockResponder.sinkholeIPv4 == nil) && (blockResponder.sinkholeIPv6 == nil) {
+			return nil, fmt.Errorf("block response mode %q requires sinkholeIPv4 or sinkholeIPv6", blockResponder.mode)
+		}
+
+	default:
+		return nil, fmt.Errorf("invalid block response mode %q", configuration.Mode)
+	}
+
+	return blockResponder, nil
+}
+
+func (blockResponder *blockResponder) rrHeader(question *dns.Question, rrType uint16) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   question.Name,
+		Rrtype: rrType,
+		Class:  dns.ClassINET,
+		Ttl:    blockResponder.ttlSeconds,
+	}
+}
+
+// soa is added to NXDOMAIN and NODATA responses so clients cache them for the block TTL.
+func (blockResponder *blockResponder) soa(question *dns.Question) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     blockResponder.rrHeader(question, dns.TypeSOA),
+		Ns:      blockResponseSOANameserver,
+		Mbox:    blockResponseSOAMailbox,
+		Serial:  1,
+		Refresh: blockResponder.ttlSeconds,
+		Retry:   blockResponder.ttlSeconds,
+		Expire:  blockResponder.ttlSeconds,
+		Minttl:  blockResponder.ttlSeconds,
+	}
+}
+
+// answer returns the sinkhole answer for the question, or nil for NODATA.
+func (blockResponder *blockResponder) answer(question *dns.Question) dns.RR {
+	switch {
+	case (question.Qtype == dns.TypeA) && (blockResponder.sinkholeIPv4 != nil):
+		return &dns.A{
+			Hdr: blockResponder.rrHeader(question, dns.TypeA),
+			A:   blockResponder.sinkholeIPv4,
+		}
+
+	case (question.Qtype == dns.TypeAAAA) && (blockResponder.sinkholeIPv6 != nil):
+		return &dns.AAAA{
+			Hdr:  blockResponder.rrHeader(question, dns.TypeAAAA),
+			AAAA: blockResponder.sinkholeIPv6,
+		}
+	}
+	return nil
+}
+
+// addExtendedDNSError adds an OPT record with the RFC 8914 Blocked error if the client sent EDNS.
+func (blockResponder *blockResponder) addExtendedDNSError(request, response *dns.Msg) {
+	if (!blockResponder.extendedDNSError) || (request.IsEdns0() == nil) {
+		return
+	}
+
+	data := make([]byte, 2, 2+len(extendedDNSErrorBlockedText))
+	binary.BigEndian.PutUint16(data, extendedDNSErrorInfoBlocked)
+	data = append(data, extendedDNSErrorBlockedText...)
+
+	opt := &dns.OPT{
+		Hdr: dns.RR_Header{
+			Name:   ".",
+			Rrtype: dns.TypeOPT,
+		},
+	}
+	opt.SetUDPSize(blockResponseOPTUDPSizeBytes)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: edns0ExtendedDNSErrorCode,
+		Data: data,
+	})
+	response.Extra = append(response.Extra, opt)
+}
+
+// createResponse creates the response to a blocked request.
+func (blockResponder *blockResponder) createResponse(request *dns.Msg) *dns.Msg {
+	response := new(dns.Msg)
+
+	if len(request.Question) == 0 {
+		response.SetRcode(request, dns.RcodeRefused)
+		return response
+	}
+
+	question := &(request.Question[0])
+
+	switch blockResponder.mode {
+	case blockResponseModeNXDomain:
+		response.SetRcode(request, dns.RcodeNameError)
+		response.Ns = append(response.Ns, blockResponder.soa(question))
+
+	case blockResponseModeRefused:
+		response.SetRcode(request, dns.RcodeRefused)
+
+	default:
+		response.SetReply(request)
+		if answer := blockResponder.answer(question); answer != nil {
+			response.Answer = append(response.Answer, answer)
+		} else {
+			response.Ns = append(response.Ns, blockResponder.soa(question))
+		}
+	}
+
+	response.RecursionAvailable = true
+	blockResponder.addExtendedDNSError(request, response)
+
+	return response
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func newTestBlockedRequest(qtype uint16, edns bool) *dns.Msg {
+	request := new(dns.Msg)
+	request.SetQuestion("ads.example.com.", qtype)
+	if edns {
+		request.SetEdns0(4096, false)
+	}
+	return request
+}
+
+// testExtendedDNSError returns the RFC 8914 info code and text of the response, or ok false.
+func testExtendedDNSError(response *dns.Msg) (infoCode uint16, text string, ok bool) {
+	opt := response.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, option := range opt.Option {
+		if local, isLocal := option.(*dns.EDNS0_LOCAL); isLocal && (local.Code == edns0ExtendedDNSErrorCode) && (len(local.Data) >= 2) {
+			return binary.BigEndian.Uint16(local.Data), string(local.Data[2:]), true
+		}
+	}
+	return
+}
+
+func firstSOA(response *dns.Msg) (*dns.SOA, bool) {
+	if len(response.Ns) != 1 {
+		return nil, false
+	}
+	soa, ok := response.Ns[0].(*dns.SOA)
+	return soa, ok
+}
+
+func TestBlockResponderCreateResponse(t *testing.T) {
+	tests := []struct {
+		name          string
+		configuration BlockResponseConfiguration
+		qtype         uint16
+		wantRcode     int
+		wantAnswer    net.IP
+		wantSOA       bool
+		wantTTL       uint32
+	}{
+		{name: "default A", qtype: dns.TypeA, wantRcode: dns.RcodeNameError, wantSOA: true, wantTTL: blockResponseDefaultTTLSeconds},
+		{name: "nxdomain AAAA", configuration: BlockResponseConfiguration{Mode: "nxdomain", TTLSeconds: 300}, qtype: dns.TypeAAAA, wantRcode: dns.RcodeNameError, wantSOA: true, wantTTL: 300},
+		{name: "nodata A", configuration: BlockResponseConfiguration{Mode: "nodata"}, qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantSOA: true, wantTTL: blockResponseDefaultTTLSeconds},
+		{name: "refused A", configuration: BlockResponseConfiguration{Mode: "refused"}, qtype: dns.TypeA, wantRcode: dns.RcodeRefused},
+		{name: "nullIP A", configuration: BlockResponseConfiguration{Mode: "nullIP"}, qtype: dns.TypeA, wantRcode: dns.RcodeSuccess, wantAnswer: net.IPv4zero, wantTTL: blockResponseDefaultTTLSeconds},
+		{name: "nullIP AAAA", configuration: BlockResponseConfiguration{Mode: "nullIP"}, qtype: dns.TypeAAAA, wantRcode: dns.RcodeSuccess, wantAnswer: net.IPv6zero, wantTTL: blockResponseDefaultTTLSeconds},
+		{name: "nullIP MX", configuration: BlockResponseConfiguration{Mode: "nullIP"}, qtype: dns.TypeMX, wantRcode: dns.RcodeSuccess, wantSOA: true, wantTTL: blockResponseDefaultTTLSeconds},
+		{
+			name:          "sinkhole A",
+			configuration: BlockResponseConfiguration{Mode: "sinkhole", SinkholeIPv4: "192.0.2.10", SinkholeIPv6: "2001:db8::10", TTLSeconds: 10},
+			qtype:         dns.TypeA,
+			wantRcode:     dns.RcodeSuccess,
+			wantAnswer:    net.ParseIP("192.0.2.10"),
+			wantTTL:       10,
+		},
+		{
+			name:          "sinkhole AAAA",
+			configuration: BlockResponseConfiguration{Mode: "sinkhole", SinkholeIPv4: "192.0.2.10", SinkholeIPv6: "2001:db8::10", TTLSeconds: 10},
+			qtype:         dns.TypeAAAA,
+			wantRcode:     dns.RcodeSuccess,
+			wantAnswer:    net.ParseIP("2001:db8::10"),
+			wantTTL:       10,
+		},
+		{
+			name:          "sinkhole AAAA without IPv6",
+			configuration: BlockResponseConfiguration{Mode: "sinkhole", SinkholeIPv4: "192.0.2.10"},
+			qtype:         dns.TypeAAAA,
+			wantRcode:     dns.RcodeSuccess,
+			wantSOA:       true,
+			wantTTL:       blockResponseDefaultTTLSeconds,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blockResponder, err := newBlockResponder(&test.configuration)
+			if err != nil {
+				t.Fatalf("newBlockResponder error: %v", err)
+			}
+
+			request := newTestBlockedRequest(test.qtype, false)
+			response := blockResponder.createResponse(request)
+
+			if (!response.Response) || (response.Id != request.Id) || (!response.RecursionAvailable) {
+				t.Errorf("response header = %+v, want a reply to the request", response.MsgHdr)
+			}
+			if response.Rcode != test.wantRcode {
+				t.Errorf("Rcode = %v, want %v", dns.RcodeToString[response.Rcode], dns.RcodeToString[test.wantRcode])
+			}
+
+			switch {
+			case test.wantAnswer == nil:
+				if len(response.Answer) != 0 {
+					t.Errorf("Answer = %v, want none", response.Answer)
+				}
+			case len(response.Answer) != 1:
+				t.Errorf("Answer = %v, want %v", response.Answer, test.wantAnswer)
+			default:
+				var ip net.IP
+				switch rr := response.Answer[0].(type) {
+				case *dns.A:
+					ip = rr.A
+				case *dns.AAAA:
+					ip = rr.AAAA
+				}
+				header := response.Answer[0].Header()
+				if (!ip.Equal(test.wantAnswer)) || (header.Rrtype != test.qtype) || (header.Name != "ads.example.com.") || (header.Ttl != test.wantTTL) {
+					t.Errorf("Answer = %v, want %v with ttl %v", response.Answer[0], test.wantAnswer, test.wantTTL)
+				}
+			}
+
+			if !test.wantSOA {
+				if len(response.Ns) != 0 {
+					t.Errorf("Ns = %v, want none", response.Ns)
+				}
+			} else if soa, ok := firstSOA(response); !ok || (soa.Hdr.Ttl != test.wantTTL) || (soa.Minttl != test.wantTTL) {
+				t.Errorf("Ns = %v, want SOA with ttl and minimum %v", response.Ns, test.wantTTL)
+			}
+
+			if _, _, ok := testExtendedDNSError(response); ok {
+				t.Errorf("response has an extended DNS error without extendedDNSError")
+			}
+		})
+	}
+}
+
+func TestBlockResponderExtendedDNSError(t *testing.T) {
+	tests := []struct {
+		name             string
+		mode             string
+		extendedDNSError bool
+		requestEDNS      bool
+		want             bool
+	}{
+		{name: "nxdomain edns client", mode: "nxdomain", extendedDNSError: true, requestEDNS: true, want: true},
+		{name: "refused edns client", mode: "refused", extendedDNSError: true, requestEDNS: true, want: true},
+		{name: "nullIP edns client", mode: "nullIP", extendedDNSError: true, requestEDNS: true, want: true},
+		{name: "client without edns", mode: "nxdomain", extendedDNSError: true, requestEDNS: false, want: false},
+		{name: "disabled", mode: "nxdomain", extendedDNSError: false, requestEDNS: true, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blockResponder, err := newBlockResponder(&BlockResponseConfiguration{
+				Mode:             test.mode,
+				ExtendedDNSError: test.extendedDNSError,
+			})
+			if err != nil {
+				t.Fatalf("newBlockResponder error: %v", err)
+			}
+
+			response := blockResponder.createResponse(newTestBlockedRequest(dns.TypeA, test.requestEDNS))
+
+			infoCode, text, ok := testExtendedDNSError(response)
+			if ok != test.want {
+				t.Fatalf("extended DNS error = %v, want %v", ok, test.want)
+			}
+			if ok && ((infoCode != extendedDNSErrorInfoBlocked) || (text != extendedDNSErrorBlockedText)) {
+				t.Errorf("extended DNS error = %v %q, want %v %q", infoCode, text, extendedDNSErrorInfoBlocked, extendedDNSErrorBlockedText)
+			}
+
+			// the OPT record must survive a round trip to the client
+			packed, err := response.Pack()
+			if err != nil {
+				t.Fatalf("Pack error: %v", err)
+			}
+			unpacked := new(dns.Msg)
+			if err := unpacked.Unpack(packed); err != nil {
+				t.Fatalf("Unpack error: %v", err)
+			}
+			if _, _, ok := testExtendedDNSError(unpacked); ok != test.want {
+				t.Errorf("unpacked extended DNS error = %v, want %v", ok, test.want)
+			}
+		})
+	}
+}
+
+func TestNewBlockResponderErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		configuration BlockResponseConfiguration
+	}{
+		{name: "unknown mode", configuration: BlockResponseConfiguration{Mode: "drop"}},
+		{name: "sinkhole without addresses", configuration: BlockResponseConfiguration{Mode: "sinkhole"}},
+		{name: "invalid sinkholeIPv4", configuration: BlockResponseConfiguration{Mode: "sinkhole", SinkholeIPv4: "2001:db8::10"}},
+		{name: "invalid sinkholeIPv6", configuration: BlockResponseConfiguration{Mode: "sinkhole", SinkholeIPv6: "192.0.2.10"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newBlockResponder(&test.configuration); err == nil {
+				t.Errorf("newBlockResponder error = nil, want error")
+			}
+		})
+	}
+}
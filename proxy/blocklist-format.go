@@ -0,0 +1,284 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Blocklist file formats, detected from the first line that is not blank or a comment.
+const (
+	// one domain per line, # comments
+	blocklistFormatDomains = "domains"
+	// hosts file lines like "0.0.0.0 example.com", # comments
+	blocklistFormatHosts = "hosts"
+	// Adblock Plus domain rules like "||example.com^" and "@@||example.com^", ! comments
+	blocklistFormatAdblock = "adblock"
+	// allowlist entries, "example.com" for an exact match or "*.example.com" for example.com
+	// and its subdomains, # comments.  Never detected.
+	blocklistFormatAllowlist = "allowlist"
+)
+
+// blocklistMaxInvalidLinesLogged limits the invalid lines logged per file.
+const blocklistMaxInvalidLinesLogged = 10
+
+// hostsFileDefaultNames are entries in hosts files that are not blocked domains.
+var hostsFileDefaultNames = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+	"0.0.0.0.":               true,
+}
+
+// blocklistRules are the canonical domain names parsed from blocklist and allowlist files.
+// allowedDomains also match subdomains, exactAllowedDomains do not.
+type blocklistRules struct {
+	blockedDomains      []string
+	allowedDomains      []string
+	exactAllowedDomains []string
+}
+
+// parseBlocklistDomain validates a domain name from a blocklist and returns its canonical name.
+func parseBlocklistDomain(domainName string) (string, error) {
+	if len(domainName) == 0 {
+		return "", errors.New("empty domain name")
+	}
+
+	if net.ParseIP(domainName) != nil {
+		return "", fmt.Errorf("%q is an IP address", domainName)
+	}
+
+	for _, c := range domainName {
+		if !(((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) || ((c >= '0') && (c <= '9')) || (c == '-') || (c == '_') || (c == '.')) {
+			return "", fmt.Errorf("invalid character %q in %q", c, domainName)
+		}
+	}
+
+	if _, ok := dns.IsDomainName(domainName); (!ok) || strings.Contains(domainName, "..") || strings.HasPrefix(domainName, ".") {
+		return "", fmt.Errorf("invalid domain name %q", domainName)
+	}
+
+	return dns.CanonicalName(domainName), nil
+}
+
+func detectBlocklistFormat(line string) string {
+	if strings.HasPrefix(line, "[Adblock") || strings.HasPrefix(line, "!") ||
+		strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@") {
+		return blocklistFormatAdblock
+	}
+
+	if fields := strings.Fields(line); (len(fields) > 1) && (net.ParseIP(fields[0]) != nil) {
+		return blocklistFormatHosts
+	}
+
+	return blocklistFormatDomains
+}
+
+func removeHashComment(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+	return strings.TrimSpace(line)
+}
+
+func (blocklistRules *blocklistRules) parseDomainsLine(line string) error {
+	line = removeHashComment(line)
+	if len(line) == 0 {
+		return nil
+	}
+
+	domainName, err := parseBlocklistDomain(line)
+	if err != nil {
+		return err
+	}
+
+	blocklistRules.blockedDomains = append(blocklistRules.blockedDomains, domainName)
+	return nil
+}
+
+func (blocklistRules *blocklistRules) parseHostsLine(line string) error {
+	line = removeHashComment(line)
+	if len(line) == 0 {
+		return nil
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return errors.New("expected address and names")
+	}
+
+	if net.ParseIP(fields[0]) == nil {
+		return fmt.Errorf("invalid address %q", fields[0])
+	}
+
+	for _, field := range fields[1:] {
+		if hostsFileDefaultNames[dns.CanonicalName(field)] {
+			continue
+		}
+
+		domainName, err := parseBlocklistDomain(field)
+		if err != nil {
+			return err
+		}
+
+		blocklistRules.blockedDomains = append(blocklistRules.blockedDomains, domainName)
+	}
+	return nil
+}
+
+// parseAdblockLine supports only domain rules: "||example.com^" blocks and "@@||example.com^"
+// allows example.com and its subdomains.  The only supported option is $important.
+func (blocklistRules *blocklistRules) parseAdblockLine(line string) error {
+	line = strings.TrimSpace(line)
+	if (len(line) == 0) || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[Adblock") {
+		return nil
+	}
+
+	allowed := false
+	if strings.HasPrefix(line, "@@") {
+		allowed = true
+		line = line[2:]
+	}
+
+	if i := strings.IndexByte(line, '$'); i >= 0 {
+		if options := line[i+1:]; options != "important" {
+			return fmt.Errorf("unsupported options %q", options)
+		}
+		line = line[:i]
+	}
+
+	if !strings.HasPrefix(line, "||") {
+		return errors.New("unsupported rule, expected ||domain^")
+	}
+	line = strings.TrimPrefix(line[2:], "|")
+
+	if !strings.HasSuffix(line, "^") {
+		return errors.New("unsupported rule, expected ||domain^")
+	}
+	line = strings.TrimSuffix(line, "^")
+
+	domainName, err := parseBlocklistDomain(line)
+	if err != nil {
+		return err
+	}
+
+	if allowed {
+		blocklistRules.allowedDomains = append(blocklistRules.allowedDomains, domainName)
+	} else {
+		blocklistRules.blockedDomains = append(blocklistRules.blockedDomains, domainName)
+	}
+	return nil
+}
+
+func (blocklistRules *blocklistRules) parseAllowlistLine(line string) error {
+	line = removeHashComment(line)
+	if len(line) == 0 {
+		return nil
+	}
+
+	suffixMatch := strings.HasPrefix(line, "*.")
+	if suffixMatch {
+		line = line[2:]
+	}
+
+	domainName, err := parseBlocklistDomain(line)
+	if err != nil {
+		return err
+	}
+
+	if suffixMatch {
+		blocklistRules.allowedDomains = append(blocklistRules.allowedDomains, domainName)
+	} else {
+		blocklistRules.exactAllowedDomains = append(blocklistRules.exactAllowedDomains, domainName)
+	}
+	return nil
+}
+
+func logInvalidBlocklistLine(source string, lineNumber int, line string, err error, invalidLines int) {
+	if invalidLines <= blocklistMaxInvalidLinesLogged {
+		log.Printf("%v:%v: invalid line %q: %v", source, lineNumber, line, err)
+	}
+}
+
+// parseAllowlistDomains adds allowlist entries from the configuration.
+func (blocklistRules *blocklistRules) parseAllowlistDomains(source string, domains []string) {
+	invalidLines := 0
+	for i, domain := range domains {
+		if err := blocklistRules.parseAllowlistLine(domain); err != nil {
+			invalidLines++
+			logInvalidBlocklistLine(source, i+1, domain, err, invalidLines)
+		}
+	}
+}
+
+// parseBlockedDomains adds blocked domains from the configuration.
+func (blocklistRules *blocklistRules) parseBlockedDomains(source string, domains []string) {
+	invalidLines := 0
+	for i, domain := range domains {
+		if err := blocklistRules.parseDomainsLine(domain); err != nil {
+			invalidLines++
+			logInvalidBlocklistLine(source, i+1, domain, err, invalidLines)
+		}
+	}
+}
+
+// parse adds the rules in a blocklist or allowlist file.  An empty format is detected from
+// the file.  Invalid lines are logged with their line numbers and skipped.
+func (blocklistRules *blocklistRules) parse(source string, reader io.Reader, format string) error {
+	lineNumber := 0
+	invalidLines := 0
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		if format == "" {
+			if (len(line) == 0) || strings.HasPrefix(line, "#") {
+				continue
+			}
+			format = detectBlocklistFormat(line)
+			log.Printf("%v: detected %v format", source, format)
+		}
+
+		var err error
+		switch format {
+		case blocklistFormatDomains:
+			err = blocklistRules.parseDomainsLine(line)
+		case blocklistFormatHosts:
+			err = blocklistRules.parseHostsLine(line)
+		case blocklistFormatAdblock:
+			err = blocklistRules.parseAdblockLine(line)
+		case blocklistFormatAllowlist:
+			err = blocklistRules.parseAllowlistLine(line)
+		}
+
+		if err != nil {
+			invalidLines++
+			logInvalidBlocklistLine(source, lineNumber, line, err, invalidLines)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scanner error: %w", err)
+	}
+
+	if invalidLines > 0 {
+		log.Printf("%v: %v invalid lines skipped", source, invalidLines)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// captureLog returns the log output of f.
+func captureLog(f func()) string {
+	var buffer bytes.Buffer
+	log.SetOutput(&buffer)
+	defer log.SetOutput(os.Stderr)
+
+	f()
+	return buffer.String()
+}
+
+func TestDetectBlocklistFormat(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{line: "example.com", want: blocklistFormatDomains},
+		{line: "0.0.0.0 example.com", want: blocklistFormatHosts},
+		{line: "127.0.0.1\tlocalhost", want: blocklistFormatHosts},
+		{line: "::1 localhost ip6-localhost", want: blocklistFormatHosts},
+		{line: "[Adblock Plus 2.0]", want: blocklistFormatAdblock},
+		{line: "! Title: list", want: blocklistFormatAdblock},
+		{line: "||example.com^", want: blocklistFormatAdblock},
+		{line: "@@||example.com^", want: blocklistFormatAdblock},
+	}
+
+	for _, test := range tests {
+		t.Run(test.line, func(t *testing.T) {
+			if got := detectBlocklistFormat(test.line); got != test.want {
+				t.Errorf("detectBlocklistFormat(%q) = %q, want %q", test.line, got, test.want)
+			}
+		})
+	}
+}
+
+func TestBlocklistRulesParse(t *testing.T) {
+	tests := []struct {
+		name               string
+		input              string
+		format             string
+		wantFormat         string
+		wantBlocked        []string
+		wantAllowed        []string
+		wantExactAllowed   []string
+		wantInvalidLineLog []string
+	}{
+		{
+			name:        "domains",
+			input:       "# comment\n\nexample.com\nAds.Example.NET # trailing comment\n",
+			wantFormat:  blocklistFormatDomains,
+			wantBlocked: []string{"example.com.", "ads.example.net."},
+		},
+		{
+			name: "hosts",
+			input: "# hosts\n127.0.0.1 localhost\n::1 localhost ip6-localhost ip6-loopback\n255.255.255.255 broadcasthost\n" +
+				"0.0.0.0 0.0.0.0\n0.0.0.0 example.com www.example.com\n",
+			wantFormat:  blocklistFormatHosts,
+			wantBlocked: []string{"example.com.", "www.example.com."},
+		},
+		{
+			name:        "adblock",
+			input:       "[Adblock Plus 2.0]\n! comment\n||example.com^\n@@||cdn.example.com^\n||tracker.net^$important\n",
+			wantFormat:  blocklistFormatAdblock,
+			wantBlocked: []string{"example.com.", "tracker.net."},
+			wantAllowed: []string{"cdn.example.com."},
+		},
+		{
+			name:             "allowlist",
+			input:            "example.com\n*.example.net\n",
+			format:           blocklistFormatAllowlist,
+			wantAllowed:      []string{"example.net."},
+			wantExactAllowed: []string{"example.com."},
+		},
+		{
+			name:               "invalid domains lines",
+			input:              "example.com\n192.168.1.1\nbad domain\n\nok.example.com\nexa$mple.com\n",
+			wantFormat:         blocklistFormatDomains,
+			wantBlocked:        []string{"example.com.", "ok.example.com."},
+			wantInvalidLineLog: []string{"test:2: invalid line", "test:3: invalid line", "test:6: invalid line"},
+		},
+		{
+			name:               "invalid adblock lines",
+			input:              "! comment\n||example.com^\n/banner/*\n||tracker.net^$third-party\nexample.org\n",
+			wantFormat:         blocklistFormatAdblock,
+			wantBlocked:        []string{"example.com."},
+			wantInvalidLineLog: []string{"test:3: invalid line", "test:4: invalid line", "test:5: invalid line"},
+		},
+		{
+			name:               "invalid hosts lines",
+			input:              "0.0.0.0 example.com\n0.0.0.0\nnot-an-address example.net\n",
+			wantFormat:         blocklistFormatHosts,
+			wantBlocked:        []string{"example.com."},
+			wantInvalidLineLog: []string{"test:2: invalid line", "test:3: invalid line"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var blocklistRules blocklistRules
+			var err error
+			logOutput := captureLog(func() {
+				err = blocklistRules.parse("test", strings.NewReader(test.input), test.format)
+			})
+			if err != nil {
+				t.Fatalf("parse error: %v", err)
+			}
+
+			if len(test.wantFormat) > 0 {
+				if want := "test: detected " + test.wantFormat + " format"; !strings.Contains(logOutput, want) {
+					t.Errorf("log output %q does not contain %q", logOutput, want)
+				}
+			}
+
+			if !reflect.DeepEqual(blocklistRules.blockedDomains, test.wantBlocked) {
+				t.Errorf("blockedDomains = %v, want %v", blocklistRules.blockedDomains, test.wantBlocked)
+			}
+			if !reflect.DeepEqual(blocklistRules.allowedDomains, test.wantAllowed) {
+				t.Errorf("allowedDomains = %v, want %v", blocklistRules.allowedDomains, test.wantAllowed)
+			}
+			if !reflect.DeepEqual(blocklistRules.exactAllowedDomains, test.wantExactAllowed) {
+				t.Errorf("exactAllowedDomains = %v, want %v", blocklistRules.exactAllowedDomains, test.wantExactAllowed)
+			}
+
+			if got := strings.Count(logOutput, "invalid line "); got != len(test.wantInvalidLineLog) {
+				t.Errorf("logged %v invalid lines, want %v: %q", got, len(test.wantInvalidLineLog), logOutput)
+			}
+			for _, want := range test.wantInvalidLineLog {
+				if !strings.Contains(logOutput, want) {
+					t.Errorf("log output %q does not contain %q", logOutput, want)
+				}
+			}
+		})
+	}
+}
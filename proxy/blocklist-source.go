@@ -0,0 +1,371 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// blocklistSourcesTimerInterval is how often local files are checked for changes and URLs for
+// a due refresh.
+const blocklistSourcesTimerInterval = 10 * time.Second
+
+const (
+	blocklistSourceDefaultRefreshInterval = 24 * time.Hour
+	blocklistSourceRequestTimeout         = 60 * time.Second
+	blocklistSourceMaxBytes               = 64 * 1024 * 1024
+)
+
+// blocklistSourceState is the last good copy of a blocklist source.  nextRefresh is only set
+// for URL sources, local files are checked on every timer tick.
+type blocklistSourceState struct {
+	rules        *blocklistRules
+	etag         string
+	lastModified string
+	fileModTime  time.Time
+	nextRefresh  time.Time
+}
+
+// blocklistSourcesUpdater provides the current source configurations and rebuilds the
+// blocklist after a source changes.
+type blocklistSourcesUpdater interface {
+	blocklistSourceConfigurations() []BlocklistSourceConfiguration
+	blocklistSourcesUpdated()
+}
+
+// blocklistSources downloads remote blocklists with conditional GET and rereads local
+// blocklists when they change.  A failed refresh keeps the previous copy.
+type blocklistSources struct {
+	backgroundTask *backgroundTask
+	metrics        *metrics
+	// httpClient may be replaced before start, e.g. with an httptest.Server client.
+	httpClient  *http.Client
+	statesMutex sync.Mutex
+	states      map[BlocklistSourceConfiguration]*blocklistSourceState
+}
+
+func newBlocklistSources(metrics *metrics) *blocklistSources {
+	return &blocklistSources{
+		backgroundTask: newBackgroundTask(),
+		metrics:        metrics,
+		httpClient: &http.Client{
+			Timeout: blocklistSourceRequestTimeout,
+		},
+		states: make(map[BlocklistSourceConfiguration]*blocklistSourceState),
+	}
+}
+
+func (configuration *BlocklistSourceConfiguration) name() string {
+	if len(configuration.Name) > 0 {
+		return configuration.Name
+	}
+	if len(configuration.URL) > 0 {
+		return configuration.URL
+	}
+	return configuration.File
+}
+
+func (configuration *BlocklistSourceConfiguration) refreshInterval() time.Duration {
+	if configuration.RefreshIntervalSeconds <= 0 {
+		return blocklistSourceDefaultRefreshInterval
+	}
+	return time.Duration(configuration.RefreshIntervalSeconds) * time.Second
+}
+
+func parseBlocklistSource(source string, reader io.Reader) (*blocklistRules, error) {
+	var blocklistRules blocklistRules
+	if err := blocklistRules.parse(source, reader, ""); err != nil {
+		return nil, err
+	}
+
+	if (len(blocklistRules.blockedDomains) == 0) && (len(blocklistRules.allowedDomains) == 0) {
+		return nil, errors.New("no domains found")
+	}
+
+	return &blocklistRules, nil
+}
+
+// loadFile reads the file of a source, the last good copy for remote sources.  A missing
+// file is not an error for remote sources that have not been downloaded yet.  The file mod
+// time is kept even if the file does not parse.
+func (blocklistSources *blocklistSources) loadFile(configuration *BlocklistSourceConfiguration) (*blocklistSourceState, error) {
+	state := &blocklistSourceState{}
+
+	fileInfo, err := os.Stat(configuration.File)
+	if (err != nil) && os.IsNotExist(err) && (len(configuration.URL) > 0) {
+		log.Printf("blocklist source %q has no copy in %q yet", configuration.URL, configuration.File)
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("os.Stat error: %w", err)
+	}
+	state.fileModTime = fileInfo.ModTime()
+
+	file, err := os.Open(configuration.File)
+	if err != nil {
+		return state, fmt.Errorf("os.Open error: %w", err)
+	}
+	defer file.Close()
+
+	rules, err := parseBlocklistSource(configuration.File, file)
+	if err != nil {
+		return state, fmt.Errorf("%q parse error: %w", configuration.File, err)
+	}
+
+	state.rules = rules
+	if len(configuration.URL) > 0 {
+		state.lastModified = fileInfo.ModTime().UTC().Format(http.TimeFormat)
+	}
+
+	return state, nil
+}
+
+// rules returns the last good copy of each configured source, nil for sources without a
+// copy.  Sources not seen before are read from their files, sources no longer configured are
+// forgotten.
+func (blocklistSources *blocklistSources) rules(configurations []BlocklistSourceConfiguration) ([]*blocklistRules, error) {
+	blocklistSources.statesMutex.Lock()
+	defer blocklistSources.statesMutex.Unlock()
+
+	states := make(map[BlocklistSourceConfiguration]*blocklistSourceState)
+	var rules []*blocklistRules
+
+	for _, configuration := range configurations {
+		if len(configuration.File) == 0 {
+			return nil, fmt.Errorf("blocklist source %q requires a file", configuration.URL)
+		}
+
+		state, ok := blocklistSources.states[configuration]
+		if !ok {
+			var err error
+			state, err = blocklistSources.loadFile(&configuration)
+			if err != nil {
+				blocklistSources.metrics.incrementBlocklistSourceErrors()
+				log.Printf("blocklist source %q error: %v", configuration.name(), err)
+			}
+		}
+		states[configuration] = state
+
+		rules = append(rules, state.rules)
+	}
+
+	blocklistSources.states = states
+
+	return rules, nil
+}
+
+func (blocklistSources *blocklistSources) state(configuration BlocklistSourceConfiguration) *blocklistSourceState {
+	blocklistSources.statesMutex.Lock()
+	defer blocklistSources.statesMutex.Unlock()
+
+	return blocklistSources.states[configuration]
+}
+
+// updateState replaces the state unless the source was removed meanwhile.
+func (blocklistSources *blocklistSources) updateState(configuration BlocklistSourceConfiguration, previousState, state *blocklistSourceState) {
+	blocklistSources.statesMutex.Lock()
+	defer blocklistSources.statesMutex.Unlock()
+
+	if blocklistSources.states[configuration] == previousState {
+		blocklistSources.states[configuration] = state
+	}
+}
+
+// writeBlocklistSourceFile writes to a temporary file and renames it over the file.
+func writeBlocklistSourceFile(file string, data []byte, modTime time.Time) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return fmt.Errorf("ioutil.TempFile error: %w", err)
+	}
+	tempFileName := tempFile.Name()
+
+	_, err = tempFile.Write(data)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tempFileName, modTime, modTime)
+	}
+	if err == nil {
+		err = os.Rename(tempFileName, file)
+	}
+	if err != nil {
+		os.Remove(tempFileName)
+		return err
+	}
+
+	return nil
+}
+
+// download returns the new state, or nil if the source is not modified.
+func (blocklistSources *blocklistSources) download(ctx context.Context, configuration *BlocklistSourceConfiguration, previousState *blocklistSourceState) (*blocklistSourceState, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, configuration.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequestWithContext error: %w", err)
+	}
+	if len(previousState.etag) > 0 {
+		request.Header.Set("If-None-Match", previousState.etag)
+	}
+	if len(previousState.lastModified) > 0 {
+		request.Header.Set("If-Modified-Since", previousState.lastModified)
+	}
+
+	response, err := blocklistSources.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("httpClient.Do error: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q", response.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, blocklistSourceMaxBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading body: %w", err)
+	}
+	if len(body) > blocklistSourceMaxBytes {
+		return nil, fmt.Errorf("body larger than %v bytes", blocklistSourceMaxBytes)
+	}
+
+	rules, err := parseBlocklistSource(configuration.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("parse error: %w", err)
+	}
+
+	state := &blocklistSourceState{
+		rules:        rules,
+		etag:         response.Header.Get("ETag"),
+		lastModified: response.Header.Get("Last-Modified"),
+	}
+
+	modTime := time.Now()
+	if lastModifiedTime, err := http.ParseTime(state.lastModified); err == nil {
+		modTime = lastModifiedTime
+	} else {
+		state.lastModified = modTime.UTC().Format(http.TimeFormat)
+	}
+
+	if err := writeBlocklistSourceFile(configuration.File, body, modTime); err != nil {
+		return nil, fmt.Errorf("error writing %q: %w", configuration.File, err)
+	}
+	state.fileModTime = modTime
+
+	log.Printf("blocklist source %q downloaded %v bytes to %q", configuration.URL, len(body), configuration.File)
+
+	return state, nil
+}
+
+// refreshSource returns the new state, or nil if the source did not change.
+func (blocklistSources *blocklistSources) refreshSource(ctx context.Context, configuration *BlocklistSourceConfiguration, previousState *blocklistSourceState) (*blocklistSourceState, error) {
+	if len(configuration.URL) > 0 {
+		return blocklistSources.download(ctx, configuration, previousState)
+	}
+
+	fileInfo, err := os.Stat(configuration.File)
+	if err != nil {
+		return nil, fmt.Errorf("os.Stat error: %w", err)
+	}
+	if fileInfo.ModTime().Equal(previousState.fileModTime) {
+		return nil, nil
+	}
+
+	log.Printf("blocklist source %q changed", configuration.File)
+	return blocklistSources.loadFile(configuration)
+}
+
+// refresh refreshes the sources that are due and calls blocklistSourcesUpdated if any changed.
+func (blocklistSources *blocklistSources) refresh(ctx context.Context, updater blocklistSourcesUpdater) {
+	updated := false
+
+	for _, configuration := range updater.blocklistSourceConfigurations() {
+		previousState := blocklistSources.state(configuration)
+		if (previousState == nil) || time.Now().Before(previousState.nextRefresh) {
+			continue
+		}
+
+		var nextRefresh time.Time
+		if len(configuration.URL) > 0 {
+			nextRefresh = time.Now().Add(configuration.refreshInterval())
+		}
+
+		state, err := blocklistSources.refreshSource(ctx, &configuration, previousState)
+		if err != nil {
+			blocklistSources.metrics.incrementBlocklistSourceErrors()
+			log.Printf("blocklist source %q refresh error, keeping previous copy: %v", configuration.name(), err)
+		}
+
+		if (err != nil) || (state == nil) {
+			stateCopy := *previousState
+			if state != nil {
+				// a local file that does not load is not read again until it changes
+				stateCopy.fileModTime = state.fileModTime
+			}
+			state = &stateCopy
+		} else {
+			updated = true
+		}
+		state.nextRefresh = nextRefresh
+
+		blocklistSources.updateState(configuration, previousState, state)
+	}
+
+	if updated {
+		updater.blocklistSourcesUpdated()
+	}
+}
+
+func (blocklistSources *blocklistSources) runPeriodicRefresh(updater blocklistSourcesUpdater) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// cancel in-progress downloads on stop
+	blocklistSources.backgroundTask.run(func() {
+		select {
+		case <-blocklistSources.backgroundTask.stopping():
+			cancel()
+		case <-ctx.Done():
+		}
+	})
+
+	ticker := time.NewTicker(blocklistSourcesTimerInterval)
+	defer ticker.Stop()
+
+	for {
+		blocklistSources.refresh(ctx, updater)
+
+		select {
+		case <-ticker.C:
+
+		case <-blocklistSources.backgroundTask.stopping():
+			return
+		}
+	}
+}
+
+func (blocklistSources *blocklistSources) start(updater blocklistSourcesUpdater) {
+	log.Printf("blocklistSources.start")
+
+	blocklistSources.backgroundTask.run(func() {
+		blocklistSources.runPeriodicRefresh(updater)
+	})
+}
+
+func (blocklistSources *blocklistSources) stop(ctx context.Context) error {
+	log.Printf("blocklistSources.stop")
+
+	return blocklistSources.backgroundTask.stop(ctx)
+}
@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testBlocklistSourceBody         = "||example.com^\n||tracker.net^\n"
+	testBlocklistSourceETag         = `"v1"`
+	testBlocklistSourceLastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+)
+
+type testBlocklistSourcesUpdater struct {
+	configurations []BlocklistSourceConfiguration
+	updates        int
+}
+
+func (updater *testBlocklistSourcesUpdater) blocklistSourceConfigurations() []BlocklistSourceConfiguration {
+	return updater.configurations
+}
+
+func (updater *testBlocklistSourcesUpdater) blocklistSourcesUpdated() {
+	updater.updates++
+}
+
+// testBlocklistSourceServer serves status and body, or 304 for a conditional request while
+// body is unchanged.
+type testBlocklistSourceServer struct {
+	mutex              sync.Mutex
+	status             int
+	body               string
+	requests           int
+	ifNoneMatch        string
+	ifModifiedSince    string
+	notModifiedReplies int
+}
+
+func (server *testBlocklistSourceServer) setResponse(status int, body string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.status = status
+	server.body = body
+}
+
+func (server *testBlocklistSourceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	server.requests++
+	server.ifNoneMatch = r.Header.Get("If-None-Match")
+	server.ifModifiedSince = r.Header.Get("If-Modified-Since")
+
+	if (server.body == testBlocklistSourceBody) && (server.ifNoneMatch == testBlocklistSourceETag) {
+		server.notModifiedReplies++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("ETag", testBlocklistSourceETag)
+	w.Header().Set("Last-Modified", testBlocklistSourceLastModified)
+	w.WriteHeader(server.status)
+	w.Write([]byte(server.body))
+}
+
+// newTestBlocklistSources returns blocklistSources with one URL source served by an
+// httptest.Server, before the first download.
+func newTestBlocklistSources(t *testing.T) (*blocklistSources, *testBlocklistSourcesUpdater, *testBlocklistSourceServer, *httptest.Server) {
+	sourceServer := &testBlocklistSourceServer{
+		status: http.StatusOK,
+		body:   testBlocklistSourceBody,
+	}
+	httpServer := httptest.NewServer(sourceServer)
+	t.Cleanup(httpServer.Close)
+
+	blocklistSources := newBlocklistSources(newMetrics(&MetricsConfiguration{}))
+	blocklistSources.httpClient = httpServer.Client()
+
+	updater := &testBlocklistSourcesUpdater{
+		configurations: []BlocklistSourceConfiguration{
+			{
+				Name: "test",
+				URL:  httpServer.URL + "/blocklist.txt",
+				File: filepath.Join(t.TempDir(), "blocklist.txt"),
+			},
+		},
+	}
+
+	rules, err := blocklistSources.rules(updater.configurations)
+	if err != nil {
+		t.Fatalf("rules error: %v", err)
+	}
+	if (len(rules) != 1) || (rules[0] != nil) {
+		t.Fatalf("rules before download = %v, want one nil", rules)
+	}
+
+	return blocklistSources, updater, sourceServer, httpServer
+}
+
+// makeDue makes the source refresh on the next call to refresh.
+func makeDue(blocklistSources *blocklistSources, configuration BlocklistSourceConfiguration) {
+	blocklistSources.statesMutex.Lock()
+	defer blocklistSources.statesMutex.Unlock()
+
+	blocklistSources.states[configuration].nextRefresh = time.Time{}
+}
+
+func readTestFile(t *testing.T, file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile error: %v", err)
+	}
+	return string(data)
+}
+
+func TestBlocklistSourceDownload(t *testing.T) {
+	blocklistSources, updater, _, _ := newTestBlocklistSources(t)
+	configuration := updater.configurations[0]
+
+	blocklistSources.refresh(context.Background(), updater)
+
+	if updater.updates != 1 {
+		t.Errorf("updates = %v, want 1", updater.updates)
+	}
+	if got := readTestFile(t, configuration.File); got != testBlocklistSourceBody {
+		t.Errorf("file contents = %q, want %q", got, testBlocklistSourceBody)
+	}
+
+	state := blocklistSources.state(configuration)
+	if state.etag != testBlocklistSourceETag {
+		t.Errorf("etag = %q, want %q", state.etag, testBlocklistSourceETag)
+	}
+	if state.lastModified != testBlocklistSourceLastModified {
+		t.Errorf("lastModified = %q, want %q", state.lastModified, testBlocklistSourceLastModified)
+	}
+	if wantBlocked := []string{"example.com.", "tracker.net."}; !reflect.DeepEqual(state.rules.blockedDomains, wantBlocked) {
+		t.Errorf("blockedDomains = %v, want %v", state.rules.blockedDomains, wantBlocked)
+	}
+
+	// a restart reads the local copy
+	restartedBlocklistSources := newBlocklistSources(newMetrics(&MetricsConfiguration{}))
+	rules, err := restartedBlocklistSources.rules(updater.configurations)
+	if err != nil {
+		t.Fatalf("rules error: %v", err)
+	}
+	if !reflect.DeepEqual(rules[0].blockedDomains, state.rules.blockedDomains) {
+		t.Errorf("blockedDomains after restart = %v, want %v", rules[0].blockedDomains, state.rules.blockedDomains)
+	}
+	if got := restartedBlocklistSources.state(configuration).lastModified; got != testBlocklistSourceLastModified {
+		t.Errorf("lastModified after restart = %q, want %q", got, testBlocklistSourceLastModified)
+	}
+}
+
+func TestBlocklistSourceNotModified(t *testing.T) {
+	blocklistSources, updater, sourceServer, _ := newTestBlocklistSources(t)
+	configuration := updater.configurations[0]
+
+	blocklistSources.refresh(context.Background(), updater)
+	previousState := blocklistSources.state(configuration)
+
+	// not due yet
+	blocklistSources.refresh(context.Background(), updater)
+	if sourceServer.requests != 1 {
+		t.Fatalf("requests = %v, want 1", sourceServer.requests)
+	}
+
+	makeDue(blocklistSources, configuration)
+	blocklistSources.refresh(context.Background(), updater)
+
+	if sourceServer.ifNoneMatch != testBlocklistSourceETag {
+		t.Errorf("If-None-Match = %q, want %q", sourceServer.ifNoneMatch, testBlocklistSourceETag)
+	}
+	if sourceServer.ifModifiedSince != testBlocklistSourceLastModified {
+		t.Errorf("If-Modified-Since = %q, want %q", sourceServer.ifModifiedSince, testBlocklistSourceLastModified)
+	}
+	if sourceServer.notModifiedReplies != 1 {
+		t.Errorf("notModifiedReplies = %v, want 1", sourceServer.notModifiedReplies)
+	}
+
+	if updater.updates != 1 {
+		t.Errorf("updates = %v, want 1", updater.updates)
+	}
+	if sourceErrors := blocklistSources.metrics.blocklistSourceErrors(); sourceErrors != 0 {
+		t.Errorf("blocklistSourceErrors = %v, want 0", sourceErrors)
+	}
+
+	state := blocklistSources.state(configuration)
+	if state.rules != previousState.rules {
+		t.Errorf("rules replaced after 304")
+	}
+	if !state.nextRefresh.After(time.Now()) {
+		t.Errorf("nextRefresh = %v, want after now", state.nextRefresh)
+	}
+}
+
+func TestBlocklistSourceFailedDownloadKeepsPreviousCopy(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		body        string
+		closeServer bool
+	}{
+		{name: "server error", status: http.StatusInternalServerError, body: "error"},
+		{name: "not found", status: http.StatusNotFound, body: "not found"},
+		{name: "no domains", status: http.StatusOK, body: "# empty\n"},
+		{name: "connection refused", closeServer: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocklistSources, updater, sourceServer, httpServer := newTestBlocklistSources(t)
+			configuration := updater.configurations[0]
+
+			blocklistSources.refresh(context.Background(), updater)
+			previousState := blocklistSources.state(configuration)
+
+			if test.closeServer {
+				httpServer.Close()
+			} else {
+				sourceServer.setResponse(test.status, test.body)
+			}
+
+			makeDue(blocklistSources, configuration)
+			blocklistSources.refresh(context.Background(), updater)
+
+			if sourceErrors := blocklistSources.metrics.blocklistSourceErrors(); sourceErrors != 1 {
+				t.Errorf("blocklistSourceErrors = %v, want 1", sourceErrors)
+			}
+			if updater.updates != 1 {
+				t.Errorf("updates = %v, want 1", updater.updates)
+			}
+			if got := readTestFile(t, configuration.File); got != testBlocklistSourceBody {
+				t.Errorf("file contents = %q, want %q", got, testBlocklistSourceBody)
+			}
+
+			state := blocklistSources.state(configuration)
+			if (state.rules != previousState.rules) || (state.etag != previousState.etag) {
+				t.Errorf("state not kept after failed download")
+			}
+			if !state.nextRefresh.After(time.Now()) {
+				t.Errorf("nextRefresh = %v, want after now", state.nextRefresh)
+			}
+		})
+	}
+}
+
+func TestBlocklistSourceLocalFileCheckedEveryTick(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "blocklist.txt")
+	modTime := time.Now().Add(-time.Hour)
+	writeFile := func(t *testing.T, contents string) {
+		modTime = modTime.Add(time.Minute)
+		if err := writeBlocklistSourceFile(file, []byte(contents), modTime); err != nil {
+			t.Fatalf("writeBlocklistSourceFile error: %v", err)
+		}
+	}
+	writeFile(t, "example.com\n")
+
+	blocklistSources := newBlocklistSources(newMetrics(&MetricsConfiguration{}))
+	updater := &testBlocklistSourcesUpdater{
+		configurations: []BlocklistSourceConfiguration{
+			{File: file, RefreshIntervalSeconds: 86400},
+		},
+	}
+	configuration := updater.configurations[0]
+
+	if _, err := blocklistSources.rules(updater.configurations); err != nil {
+		t.Fatalf("rules error: %v", err)
+	}
+
+	steps := []struct {
+		name        string
+		contents    string
+		wantBlocked []string
+		wantUpdates int
+		wantErrors  uint64
+	}{
+		{name: "unchanged", wantBlocked: []string{"example.com."}, wantUpdates: 0},
+		{name: "changed before the refresh interval", contents: "tracker.net\n", wantBlocked: []string{"tracker.net."}, wantUpdates: 1},
+		{name: "invalid change keeps the previous copy", contents: "# empty\n", wantBlocked: []string{"tracker.net."}, wantUpdates: 1, wantErrors: 1},
+		{name: "invalid file is not read again", wantBlocked: []string{"tracker.net."}, wantUpdates: 1, wantErrors: 1},
+		{name: "fixed", contents: "example.org\n", wantBlocked: []string{"example.org."}, wantUpdates: 2, wantErrors: 1},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			if len(step.contents) > 0 {
+				writeFile(t, step.contents)
+			}
+
+			blocklistSources.refresh(context.Background(), updater)
+
+			state := blocklistSources.state(configuration)
+			if !reflect.DeepEqual(state.rules.blockedDomains, step.wantBlocked) {
+				t.Errorf("blockedDomains = %v, want %v", state.rules.blockedDomains, step.wantBlocked)
+			}
+			if !state.nextRefresh.IsZero() {
+				t.Errorf("nextRefresh = %v, want zero for a local file", state.nextRefresh)
+			}
+			if updater.updates != step.wantUpdates {
+				t.Errorf("updates = %v, want %v", updater.updates, step.wantUpdates)
+			}
+			if sourceErrors := blocklistSources.metrics.blocklistSourceErrors(); sourceErrors != step.wantErrors {
+				t.Errorf("blocklistSourceErrors = %v, want %v", sourceErrors, step.wantErrors)
+			}
+		})
+	}
+}
@@ -1,67 +1,235 @@
 package proxy
 
 import (
-	"bufio"
+	"fmt"
 	"log"
 	"os"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
-func installHandlersForBlockedDomains(blockedDomainsFile string, serveMux *dns.ServeMux, blockedDomainHandler dns.HandlerFunc) {
-	log.Printf("reading BlockedDomainsFile %q", blockedDomainsFile)
-	file, err := os.Open(blockedDomainsFile)
-	if err != nil {
-		log.Fatalf("error reading BlockedDomainsFile: %v", err)
+// blocklistLookupSamples is the number of lookups timed when a blocklist is loaded.
+const blocklistLookupSamples = 10000
+
+// domainSet is an immutable set of domains that matches a domain and all its subdomains.
+// Names are stored with their labels reversed, so "ads.example.com." is "com.example.ads.",
+// and sorted.  Children of a domain then sort right after it, so parent domain
+// deduplication is one pass and a lookup is one binary search.
+type domainSet struct {
+	// names is all reversed names concatenated, name i is names[offsets[i]:offsets[i+1]].
+	names   string
+	offsets []uint32
+}
+
+// reverseLabels returns the canonical name with its labels reversed, e.g. "com.example.ads.".
+func reverseLabels(domainName string) string {
+	labels := dns.SplitDomainName(dns.CanonicalName(domainName))
+
+	var builder strings.Builder
+	builder.Grow(len(domainName) + 1)
+	for i := len(labels) - 1; i >= 0; i-- {
+		builder.WriteString(labels[i])
+		builder.WriteByte('.')
 	}
-	defer file.Close()
+	return builder.String()
+}
+
+// newDomainSet builds a domainSet, skipping domains whose parent domain is already in the set.
+func newDomainSet(domainNames []string) (*domainSet, int) {
+	reversedNames := make([]string, 0, len(domainNames))
+	for _, domainName := range domainNames {
+		reversedNames = append(reversedNames, reverseLabels(domainName))
+	}
+	sort.Strings(reversedNames)
 
-	var blockedDomainsSlice []string
+	var builder strings.Builder
+	offsets := make([]uint32, 0, len(reversedNames)+1)
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		blockedDomain := strings.TrimSpace(scanner.Text())
-		if len(blockedDomain) == 0 {
+	skippedDomains := 0
+	lastKept := ""
+	for i, reversedName := range reversedNames {
+		if (i > 0) && strings.HasPrefix(reversedName, lastKept) {
+			skippedDomains++
 			continue
 		}
-		blockedDomain = dns.CanonicalName(blockedDomain)
-		blockedDomainsSlice = append(blockedDomainsSlice, blockedDomain)
-	}
-	if err := scanner.Err(); err != nil {
-		log.Fatalf("BlockedDomainsFile scanner error: %v", err)
+
+		offsets = append(offsets, uint32(builder.Len()))
+		builder.WriteString(reversedName)
+		lastKept = reversedName
 	}
+	offsets = append(offsets, uint32(builder.Len()))
+
+	return &domainSet{
+		names:   builder.String(),
+		offsets: offsets,
+	}, skippedDomains
+}
+
+func (domainSet *domainSet) len() int {
+	return len(domainSet.offsets) - 1
+}
+
+func (domainSet *domainSet) name(i int) string {
+	return domainSet.names[domainSet.offsets[i]:domainSet.offsets[i+1]]
+}
 
-	sort.Slice(blockedDomainsSlice, func(i, j int) bool {
-		return len(blockedDomainsSlice[i]) < len(blockedDomainsSlice[j])
+func (domainSet *domainSet) memoryBytes() int {
+	return len(domainSet.names) + (4 * len(domainSet.offsets))
+}
+
+// contains returns true if domainName or a parent domain is in the set.
+func (domainSet *domainSet) contains(domainName string) bool {
+	reversedName := reverseLabels(domainName)
+
+	// The greatest name <= reversedName is the only candidate: with parents deduplicated,
+	// no name sorts between a parent and its children.
+	i := sort.Search(domainSet.len(), func(i int) bool {
+		return domainSet.name(i) > reversedName
 	})
+	if i == 0 {
+		return false
+	}
+
+	return strings.HasPrefix(reversedName, domainSet.name(i-1))
+}
+
+// blocklist check results
+const (
+	blocklistNotBlocked = iota
+	blocklistBlocked
+	// blocked but overridden by the allowlist
+	blocklistAllowed
+)
+
+// blocklist blocks a domain and its subdomains unless the allowlist or an Adblock Plus
+// exception rule like "@@||example.com^" matches.
+type blocklist struct {
+	blockedDomains      *domainSet
+	allowedDomains      *domainSet
+	exactAllowedDomains map[string]bool
+}
+
+func (blocklist *blocklist) check(domainName string) int {
+	if !blocklist.blockedDomains.contains(domainName) {
+		return blocklistNotBlocked
+	}
+
+	if blocklist.allowed(domainName) {
+		return blocklistAllowed
+	}
+
+	return blocklistBlocked
+}
 
-	alreadyBlocked := make(map[string]bool)
+// allowed returns true if domainName is on the allowlist, whether or not it is blocked.
+func (blocklist *blocklist) allowed(domainName string) bool {
+	return blocklist.exactAllowedDomains[dns.CanonicalName(domainName)] || blocklist.allowedDomains.contains(domainName)
+}
+
+// blockedCNAMETarget returns the first blocked CNAME target in the answer, or "" if none is
+// blocked.  Trackers use first party names with CNAMEs to blocked domains (CNAME cloaking).
+// Allowlisted question names are not checked.
+func (blocklist *blocklist) blockedCNAMETarget(response *dns.Msg) string {
+	if (len(response.Question) > 0) && blocklist.allowed(response.Question[0].Name) {
+		return ""
+	}
 
-	// would like to use dns.ServeMux.match but it is not exported
-	domainIsAlreadyBlocked := func(domainName string) bool {
-		for off, end := 0, false; !end; off, end = dns.NextLabel(domainName, off) {
-			if alreadyBlocked[domainName[off:]] {
-				return true
-			}
+	for _, rr := range response.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && (blocklist.check(cname.Target) == blocklistBlocked) {
+			return cname.Target
 		}
-		return false
 	}
+	return ""
+}
 
-	skippedBlockedDomain := 0
-	handlersInstalled := 0
-	for _, blockedDomain := range blockedDomainsSlice {
+func (blocklist *blocklist) memoryBytes() int {
+	return blocklist.blockedDomains.memoryBytes() + blocklist.allowedDomains.memoryBytes()
+}
+
+// averageLookupTime times blocked for up to blocklistLookupSamples of sampleNames.
+func (blocklist *blocklist) averageLookupTime(sampleNames []string) time.Duration {
+	if len(sampleNames) > blocklistLookupSamples {
+		sampleNames = sampleNames[:blocklistLookupSamples]
+	}
+	if len(sampleNames) == 0 {
+		return 0
+	}
 
-		if domainIsAlreadyBlocked(blockedDomain) {
-			skippedBlockedDomain++
-		} else {
-			serveMux.HandleFunc(blockedDomain, blockedDomainHandler)
-			handlersInstalled++
-			alreadyBlocked[blockedDomain] = true
+	startTime := time.Now()
+	for _, sampleName := range sampleNames {
+		blocklist.check(sampleName)
+	}
+	return time.Since(startTime) / time.Duration(len(sampleNames))
+}
+
+func parseBlocklistFile(blocklistRules *blocklistRules, name, file, format string) error {
+	log.Printf("reading %v %q", name, file)
+	reader, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("error reading %v: %w", name, err)
+	}
+	defer reader.Close()
+
+	if err := blocklistRules.parse(file, reader, format); err != nil {
+		return fmt.Errorf("%v parse error: %w", name, err)
+	}
+	return nil
+}
+
+func loadBlockedDomainsFile(blockedDomainsFile string) (*blocklistRules, error) {
+	var blocklistRules blocklistRules
+	if err := parseBlocklistFile(&blocklistRules, "BlockedDomainsFile", blockedDomainsFile, ""); err != nil {
+		return nil, err
+	}
+	return &blocklistRules, nil
+}
+
+func loadAllowlist(allowlistConfiguration *AllowlistConfiguration) (*blocklistRules, error) {
+	var blocklistRules blocklistRules
+
+	if len(allowlistConfiguration.File) > 0 {
+		if err := parseBlocklistFile(&blocklistRules, "allowlist file", allowlistConfiguration.File, blocklistFormatAllowlist); err != nil {
+			return nil, err
+		}
+	}
+
+	blocklistRules.parseAllowlistDomains("allowlistConfiguration.domains", allowlistConfiguration.Domains)
+
+	return &blocklistRules, nil
+}
+
+// newBlocklist builds a blocklist from parsed blocklists and the allowlist.
+func newBlocklist(name string, rulesList []*blocklistRules) *blocklist {
+	var blocklistRules blocklistRules
+
+	for _, rules := range rulesList {
+		if rules == nil {
+			continue
 		}
+		blocklistRules.blockedDomains = append(blocklistRules.blockedDomains, rules.blockedDomains...)
+		blocklistRules.allowedDomains = append(blocklistRules.allowedDomains, rules.allowedDomains...)
+		blocklistRules.exactAllowedDomains = append(blocklistRules.exactAllowedDomains, rules.exactAllowedDomains...)
+	}
 
+	loadStartTime := time.Now()
+	blockedDomains, skippedBlockedDomains := newDomainSet(blocklistRules.blockedDomains)
+	allowedDomains, _ := newDomainSet(blocklistRules.allowedDomains)
+	blocklist := &blocklist{
+		blockedDomains:      blockedDomains,
+		allowedDomains:      allowedDomains,
+		exactAllowedDomains: make(map[string]bool),
 	}
+	for _, exactAllowedDomain := range blocklistRules.exactAllowedDomains {
+		blocklist.exactAllowedDomains[exactAllowedDomain] = true
+	}
+	loadDuration := time.Since(loadStartTime)
+
+	log.Printf("blocklist %q all blocked domains %v skippedBlockedDomain %v blocklist size %v allowed domains %v exact allowed domains %v memoryBytes %v build time %v average lookup time %v",
+		name, len(blocklistRules.blockedDomains), skippedBlockedDomains, blockedDomains.len(), allowedDomains.len(), len(blocklist.exactAllowedDomains),
+		blocklist.memoryBytes(), loadDuration, blocklist.averageLookupTime(blocklistRules.blockedDomains))
 
-	log.Printf("all blocked domains %v skippedBlockedDomain %v handlersInstalled %v", len(blockedDomainsSlice), skippedBlockedDomain, handlersInstalled)
+	return blocklist
 }
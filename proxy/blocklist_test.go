@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDomainSetContains(t *testing.T) {
+	domainSet, _ := newDomainSet([]string{"example.com.", "Tracker.Net", "a.b.example.org."})
+
+	tests := []struct {
+		domainName string
+		want       bool
+	}{
+		{domainName: "example.com.", want: true},
+		{domainName: "ads.example.com.", want: true},
+		{domainName: "a.b.ads.example.com.", want: true},
+		{domainName: "ADS.Example.COM", want: true},
+		{domainName: "exampleads.com.", want: false},
+		{domainName: "adsexample.com.", want: false},
+		{domainName: "example.com.au.", want: false},
+		{domainName: "com.", want: false},
+		{domainName: "tracker.net.", want: true},
+		{domainName: "x.tracker.net.", want: true},
+		{domainName: "b.example.org.", want: false},
+		{domainName: "a.b.example.org.", want: true},
+		{domainName: "aa.b.example.org.", want: false},
+		{domainName: "c.a.b.example.org.", want: true},
+		{domainName: ".", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.domainName, func(t *testing.T) {
+			if got := domainSet.contains(test.domainName); got != test.want {
+				t.Errorf("contains(%q) = %v, want %v", test.domainName, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewDomainSetSkipsSubdomains(t *testing.T) {
+	tests := []struct {
+		name        string
+		domainNames []string
+		wantLen     int
+		wantSkipped int
+	}{
+		{name: "empty", domainNames: nil, wantLen: 0, wantSkipped: 0},
+		{name: "unrelated", domainNames: []string{"example.com.", "example.net."}, wantLen: 2, wantSkipped: 0},
+		{name: "child after parent", domainNames: []string{"example.com.", "ads.example.com."}, wantLen: 1, wantSkipped: 1},
+		{name: "child before parent", domainNames: []string{"a.ads.example.com.", "ads.example.com.", "example.com."}, wantLen: 1, wantSkipped: 2},
+		{name: "duplicates", domainNames: []string{"example.com.", "EXAMPLE.com", "example.com."}, wantLen: 1, wantSkipped: 2},
+		{name: "not a label boundary", domainNames: []string{"example.com.", "exampleads.com."}, wantLen: 2, wantSkipped: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			domainSet, skipped := newDomainSet(test.domainNames)
+			if domainSet.len() != test.wantLen {
+				t.Errorf("len() = %v, want %v", domainSet.len(), test.wantLen)
+			}
+			if skipped != test.wantSkipped {
+				t.Errorf("skipped = %v, want %v", skipped, test.wantSkipped)
+			}
+
+			for _, domainName := range test.domainNames {
+				if !domainSet.contains(domainName) {
+					t.Errorf("contains(%q) = false after dedup", domainName)
+				}
+			}
+		})
+	}
+}
+
+func TestBlocklistCheck(t *testing.T) {
+	blocklist := newBlocklist("test", []*blocklistRules{
+		{
+			blockedDomains:      []string{"example.com.", "tracker.net."},
+			allowedDomains:      []string{"cdn.example.com."},
+			exactAllowedDomains: []string{"tracker.net."},
+		},
+	})
+
+	tests := []struct {
+		domainName string
+		want       int
+	}{
+		{domainName: "example.com.", want: blocklistBlocked},
+		{domainName: "ads.example.com.", want: blocklistBlocked},
+		{domainName: "cdn.example.com.", want: blocklistAllowed},
+		{domainName: "img.cdn.example.com.", want: blocklistAllowed},
+		{domainName: "tracker.net.", want: blocklistAllowed},
+		{domainName: "www.tracker.net.", want: blocklistBlocked},
+		{domainName: "example.org.", want: blocklistNotBlocked},
+	}
+
+	for _, test := range tests {
+		t.Run(test.domainName, func(t *testing.T) {
+			if got := blocklist.check(test.domainName); got != test.want {
+				t.Errorf("check(%q) = %v, want %v", test.domainName, got, test.want)
+			}
+		})
+	}
+}
+
+func TestAllowlistOverridesBlocklist(t *testing.T) {
+	directory := t.TempDir()
+	blockedDomainsFile := filepath.Join(directory, "blocklist.txt")
+	allowlistFile := filepath.Join(directory, "allowlist.txt")
+	if err := ioutil.WriteFile(blockedDomainsFile, []byte("example.com\ntracker.net\nads.example.org\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile error: %v", err)
+	}
+	if err := ioutil.WriteFile(allowlistFile, []byte("# allowlist\n*.cdn.example.com\ntracker.net # exact\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile error: %v", err)
+	}
+
+	blockedRules, err := loadBlockedDomainsFile(blockedDomainsFile)
+	if err != nil {
+		t.Fatalf("loadBlockedDomainsFile error: %v", err)
+	}
+	allowlistRules, err := loadAllowlist(&AllowlistConfiguration{
+		File:    allowlistFile,
+		Domains: []string{"*.ads.example.org"},
+	})
+	if err != nil {
+		t.Fatalf("loadAllowlist error: %v", err)
+	}
+	blocklist := newBlocklist("test", []*blocklistRules{blockedRules, allowlistRules})
+
+	tests := []struct {
+		domainName string
+		want       int
+	}{
+		{domainName: "www.example.com.", want: blocklistBlocked},
+		{domainName: "cdn.example.com.", want: blocklistAllowed},
+		{domainName: "img.cdn.example.com.", want: blocklistAllowed},
+		{domainName: "tracker.net.", want: blocklistAllowed},
+		{domainName: "pixel.tracker.net.", want: blocklistBlocked},
+		{domainName: "x.ads.example.org.", want: blocklistAllowed},
+		{domainName: "example.org.", want: blocklistNotBlocked},
+		// allowlisted but not blocked
+		{domainName: "cdn.example.net.", want: blocklistNotBlocked},
+	}
+
+	for _, test := range tests {
+		t.Run(test.domainName, func(t *testing.T) {
+			if got := blocklist.check(test.domainName); got != test.want {
+				t.Errorf("check(%q) = %v, want %v", test.domainName, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,412 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Snapshot file layout, all integers big endian:
+//   header:          magic [8]byte, version uint32
+//   cache entry:     recordType uint8 (1), cacheTime int64, expirationTime int64, key, packed dns.Msg,
+//                    blockedAddress
+//   prefetch entry:  recordType uint8 (2), expirationTime int64, key, packed dns.Msg with one question,
+//                    upstream, ipBlocking uint8
+// Times are unix nanoseconds.  Keys, packed messages, blocked addresses, and upstreams are
+// prefixed with a uint16 length.
+
+var cacheSnapshotMagic = [8]byte{'g', 'o', 'd', 'o', 'h', 's', 'n', 'p'}
+
+const cacheSnapshotVersion uint32 = 3
+
+const (
+	cacheSnapshotRecordTypeCache    uint8 = 1
+	cacheSnapshotRecordTypePrefetch uint8 = 2
+)
+
+type cacheSnapshotPrefetchEntry struct {
+	cacheKey string
+	entry    *prefetchCacheEntry
+}
+
+type cacheSnapshotCacheEntry struct {
+	cacheKey    string
+	cacheObject *cacheObject
+}
+
+type cacheSnapshot struct {
+	configuration  *CacheSnapshotConfiguration
+	backgroundTask *backgroundTask
+	cache          *cache
+	prefetch       *prefetch
+}
+
+func newCacheSnapshot(configuration *CacheSnapshotConfiguration, cache *cache, prefetch *prefetch) *cacheSnapshot {
+	return &cacheSnapshot{
+		configuration:  configuration,
+		backgroundTask: newBackgroundTask(),
+		cache:          cache,
+		prefetch:       prefetch,
+	}
+}
+
+func (cacheSnapshot *cacheSnapshot) enabled() bool {
+	return len(cacheSnapshot.configuration.File) > 0
+}
+
+func writeSnapshotBytes(writer io.Writer, b []byte) error {
+	if len(b) > 0xffff {
+		return fmt.Errorf("snapshot value too long %v", len(b))
+	}
+	if err := binary.Write(writer, binary.BigEndian, uint16(len(b))); err != nil {
+		return err
+	}
+	_, err := writer.Write(b)
+	return err
+}
+
+func readSnapshotBytes(reader io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(reader, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (cacheSnapshot *cacheSnapshot) encode(writer io.Writer) (cacheEntries, prefetchEntries int, err error) {
+	if _, err = writer.Write(cacheSnapshotMagic[:]); err != nil {
+		return
+	}
+	if err = binary.Write(writer, binary.BigEndian, cacheSnapshotVersion); err != nil {
+		return
+	}
+
+	// oldest first so reloading preserves lru order
+	for _, key := range cacheSnapshot.cache.lruCache.Keys() {
+		cacheKey := key.(string)
+		value, ok := cacheSnapshot.cache.lruCache.Peek(cacheKey)
+		if !ok {
+			continue
+		}
+		cacheObject := value.(*cacheObject)
+
+		// Pack writes the OPT record, so pack a copy of the message cache hits are reading.
+		var packedMessage []byte
+		packedMessage, err = cacheObject.message.Copy().Pack()
+		if err != nil {
+			log.Printf("cacheSnapshot.encode pack error cacheKey %q: %v", cacheKey, err)
+			err = nil
+			continue
+		}
+
+		if err = binary.Write(writer, binary.BigEndian, cacheSnapshotRecordTypeCache); err != nil {
+			return
+		}
+		if err = binary.Write(writer, binary.BigEndian, cacheObject.cacheTime.UnixNano()); err != nil {
+			return
+		}
+		if err = binary.Write(writer, binary.BigEndian, cacheObject.expirationTime.UnixNano()); err != nil {
+			return
+		}
+		if err = writeSnapshotBytes(writer, []byte(cacheKey)); err != nil {
+			return
+		}
+		if err = writeSnapshotBytes(writer, packedMessage); err != nil {
+			return
+		}
+		if err = writeSnapshotBytes(writer, []byte(cacheObject.blockedAddress)); err != nil {
+			return
+		}
+		cacheEntries++
+	}
+
+	for _, key := range cacheSnapshot.prefetch.cacheKeyToQuestion.Keys() {
+		cacheKey := key.(string)
+		value, ok := cacheSnapshot.prefetch.cacheKeyToQuestion.Peek(cacheKey)
+		if !ok {
+			continue
+		}
+		entry := value.(*prefetchCacheEntry)
+
+		questionMessage := new(dns.Msg)
+		questionMessage.Question = append(questionMessage.Question, entry.question)
+
+		var packedMessage []byte
+		packedMessage, err = questionMessage.Pack()
+		if err != nil {
+			log.Printf("cacheSnapshot.encode pack error cacheKey %q: %v", cacheKey, err)
+			err = nil
+			continue
+		}
+
+		if err = binary.Write(writer, binary.BigEndian, cacheSnapshotRecordTypePrefetch); err != nil {
+			return
+		}
+		if err = binary.Write(writer, binary.BigEndian, entry.expirationTime.UnixNano()); err != nil {
+			return
+		}
+		if err = writeSnapshotBytes(writer, []byte(cacheKey)); err != nil {
+			return
+		}
+		if err = writeSnapshotBytes(writer, packedMessage); err != nil {
+			return
+		}
+		if err = writeSnapshotBytes(writer, []byte(entry.upstreamPolicy.upstream)); err != nil {
+			return
+		}
+		var ipBlocking uint8
+		if entry.upstreamPolicy.ipBlocking {
+			ipBlocking = 1
+		}
+		if err = binary.Write(writer, binary.BigEndian, ipBlocking); err != nil {
+			return
+		}
+		prefetchEntries++
+	}
+
+	return
+}
+
+func (cacheSnapshot *cacheSnapshot) decode(reader io.Reader) (cacheEntries []cacheSnapshotCacheEntry, prefetchEntries []cacheSnapshotPrefetchEntry, err error) {
+	var magic [8]byte
+	if _, err = io.ReadFull(reader, magic[:]); err != nil {
+		err = fmt.Errorf("error reading magic: %w", err)
+		return
+	}
+	if magic != cacheSnapshotMagic {
+		err = fmt.Errorf("invalid magic %q", magic[:])
+		return
+	}
+
+	var version uint32
+	if err = binary.Read(reader, binary.BigEndian, &version); err != nil {
+		err = fmt.Errorf("error reading version: %w", err)
+		return
+	}
+	if version != cacheSnapshotVersion {
+		err = fmt.Errorf("unsupported version %v", version)
+		return
+	}
+
+	for {
+		var recordType uint8
+		err = binary.Read(reader, binary.BigEndian, &recordType)
+		if errors.Is(err, io.EOF) {
+			err = nil
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		switch recordType {
+		case cacheSnapshotRecordTypeCache:
+			var cacheTimeNanos, expirationTimeNanos int64
+			if err = binary.Read(reader, binary.BigEndian, &cacheTimeNanos); err != nil {
+				return
+			}
+			if err = binary.Read(reader, binary.BigEndian, &expirationTimeNanos); err != nil {
+				return
+			}
+
+			var key, packedMessage, blockedAddress []byte
+			if key, err = readSnapshotBytes(reader); err != nil {
+				return
+			}
+			if packedMessage, err = readSnapshotBytes(reader); err != nil {
+				return
+			}
+			if blockedAddress, err = readSnapshotBytes(reader); err != nil {
+				return
+			}
+
+			cacheObject := &cacheObject{
+				cacheTime:      time.Unix(0, cacheTimeNanos),
+				expirationTime: time.Unix(0, expirationTimeNanos),
+				blockedAddress: string(blockedAddress),
+			}
+			if err = cacheObject.message.Unpack(packedMessage); err != nil {
+				err = fmt.Errorf("error unpacking cache entry %q: %w", key, err)
+				return
+			}
+
+			cacheEntries = append(cacheEntries, cacheSnapshotCacheEntry{
+				cacheKey:    string(key),
+				cacheObject: cacheObject,
+			})
+
+		case cacheSnapshotRecordTypePrefetch:
+			var expirationTimeNanos int64
+			if err = binary.Read(reader, binary.BigEndian, &expirationTimeNanos); err != nil {
+				return
+			}
+
+			var key, packedMessage, upstream []byte
+			if key, err = readSnapshotBytes(reader); err != nil {
+				return
+			}
+			if packedMessage, err = readSnapshotBytes(reader); err != nil {
+				return
+			}
+			if upstream, err = readSnapshotBytes(reader); err != nil {
+				return
+			}
+			var ipBlocking uint8
+			if err = binary.Read(reader, binary.BigEndian, &ipBlocking); err != nil {
+				return
+			}
+
+			questionMessage := new(dns.Msg)
+			if err = questionMessage.Unpack(packedMessage); err != nil {
+				err = fmt.Errorf("error unpacking prefetch entry %q: %w", key, err)
+				return
+			}
+			if len(questionMessage.Question) != 1 {
+				err = fmt.Errorf("invalid prefetch entry %q question length %v", key, len(questionMessage.Question))
+				return
+			}
+
+			prefetchEntries = append(prefetchEntries, cacheSnapshotPrefetchEntry{
+				cacheKey: string(key),
+				entry: &prefetchCacheEntry{
+					question: questionMessage.Question[0],
+					upstreamPolicy: upstreamPolicy{
+						upstream:   string(upstream),
+						ipBlocking: (ipBlocking != 0),
+					},
+					expirationTime: time.Unix(0, expirationTimeNanos),
+				},
+			})
+
+		default:
+			err = fmt.Errorf("invalid record type %v", recordType)
+			return
+		}
+	}
+}
+
+// load reads the snapshot file into the cache and prefetch.  Any error causes the
+// whole file to be ignored.
+func (cacheSnapshot *cacheSnapshot) load() {
+	if !cacheSnapshot.enabled() {
+		return
+	}
+
+	log.Printf("reading cache snapshot file %q", cacheSnapshot.configuration.File)
+
+	source, err := ioutil.ReadFile(cacheSnapshot.configuration.File)
+	if err != nil {
+		log.Printf("error reading cache snapshot file, ignoring: %v", err)
+		return
+	}
+
+	cacheEntries, prefetchEntries, err := cacheSnapshot.decode(bytes.NewReader(source))
+	if err != nil {
+		log.Printf("error decoding cache snapshot file, ignoring: %v", err)
+		return
+	}
+
+	now := time.Now()
+
+	cacheEntriesLoaded := 0
+	for _, cacheEntry := range cacheEntries {
+		if !cacheEntry.cacheObject.staleExpired(now, cacheSnapshot.cache.maxStale) {
+			cacheSnapshot.cache.add(cacheEntry.cacheKey, cacheEntry.cacheObject)
+			cacheEntriesLoaded++
+		}
+	}
+
+	prefetchEntriesLoaded := 0
+	for _, prefetchEntry := range prefetchEntries {
+		if !prefetchEntry.entry.expired(now) {
+			cacheSnapshot.prefetch.cacheKeyToQuestion.Add(prefetchEntry.cacheKey, prefetchEntry.entry)
+			prefetchEntriesLoaded++
+		}
+	}
+
+	log.Printf("cache snapshot loaded cacheEntries %v/%v prefetchEntries %v/%v",
+		cacheEntriesLoaded, len(cacheEntries), prefetchEntriesLoaded, len(prefetchEntries))
+}
+
+// save writes the snapshot to a temporary file and renames it over the snapshot file.
+func (cacheSnapshot *cacheSnapshot) save() {
+	if !cacheSnapshot.enabled() {
+		return
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(cacheSnapshot.configuration.File), filepath.Base(cacheSnapshot.configuration.File)+".tmp")
+	if err != nil {
+		log.Printf("cacheSnapshot.save ioutil.TempFile error: %v", err)
+		return
+	}
+	tempFileName := file.Name()
+
+	writer := bufio.NewWriter(file)
+
+	cacheEntries, prefetchEntries, err := cacheSnapshot.encode(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempFileName, cacheSnapshot.configuration.File)
+	}
+	if err != nil {
+		log.Printf("cacheSnapshot.save error: %v", err)
+		os.Remove(tempFileName)
+		return
+	}
+
+	log.Printf("cache snapshot saved cacheEntries %v prefetchEntries %v", cacheEntries, prefetchEntries)
+}
+
+func (cacheSnapshot *cacheSnapshot) runPeriodicTimer() {
+	ticker := time.NewTicker(time.Duration(cacheSnapshot.configuration.TimerIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			cacheSnapshot.save()
+
+		case <-cacheSnapshot.backgroundTask.stopping():
+			return
+		}
+	}
+}
+
+func (cacheSnapshot *cacheSnapshot) start() {
+	log.Printf("cacheSnapshot.start")
+
+	if cacheSnapshot.enabled() && (cacheSnapshot.configuration.TimerIntervalSeconds > 0) {
+		cacheSnapshot.backgroundTask.run(cacheSnapshot.runPeriodicTimer)
+	}
+}
+
+// stop stops the periodic timer and saves a final snapshot.
+func (cacheSnapshot *cacheSnapshot) stop(ctx context.Context) error {
+	log.Printf("cacheSnapshot.stop")
+
+	err := cacheSnapshot.backgroundTask.stop(ctx)
+
+	cacheSnapshot.save()
+
+	return err
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestCacheSnapshot(t *testing.T, file string) *cacheSnapshot {
+	cache := newCache(&CacheConfiguration{
+		MaxSize:         100,
+		MaxStaleSeconds: 60,
+	})
+	prefetch := newPrefetch(&PrefetchConfiguration{
+		MaxCacheSize: 100,
+	})
+	return newCacheSnapshot(&CacheSnapshotConfiguration{File: file}, cache, prefetch)
+}
+
+func newTestCacheObject(name string, cacheTime, expirationTime time.Time) *cacheObject {
+	cacheObject := &cacheObject{
+		cacheTime:      cacheTime,
+		expirationTime: expirationTime,
+	}
+	cacheObject.message.SetQuestion(name, dns.TypeA)
+	cacheObject.message.Response = true
+	cacheObject.message.Answer = append(cacheObject.message.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   []byte{192, 0, 2, 1},
+	})
+	cacheObject.message.SetEdns0(dohWireUDPSize, false)
+	return cacheObject
+}
+
+func TestCacheSnapshotRoundTrip(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "cache-snapshot.bin")
+	now := time.Now()
+
+	saved := newTestCacheSnapshot(t, file)
+	saved.cache.add("fresh.example.:1", newTestCacheObject("fresh.example.", now, now.Add(time.Minute)))
+	saved.cache.add("stale.example.:1", newTestCacheObject("stale.example.", now.Add(-2*time.Minute), now.Add(-30*time.Second)))
+	saved.cache.add("expired.example.:1", newTestCacheObject("expired.example.", now.Add(-time.Hour), now.Add(-10*time.Minute)))
+
+	freshQuestion := dns.Question{Name: "fresh.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	saved.prefetch.cacheKeyToQuestion.Add("fresh.example.:1", &prefetchCacheEntry{
+		question:       freshQuestion,
+		upstreamPolicy: upstreamPolicy{upstream: "quad9", ipBlocking: true},
+		expirationTime: now.Add(time.Hour),
+	})
+	saved.prefetch.cacheKeyToQuestion.Add("expired.example.:1", &prefetchCacheEntry{
+		question:       dns.Question{Name: "expired.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+		upstreamPolicy: defaultUpstreamPolicy,
+		expirationTime: now.Add(-time.Second),
+	})
+
+	saved.save()
+
+	loaded := newTestCacheSnapshot(t, file)
+	loaded.load()
+
+	if loaded.cache.len() != 2 {
+		t.Errorf("cache.len = %v, want 2", loaded.cache.len())
+	}
+
+	fresh, ok := loaded.cache.get("fresh.example.:1")
+	if !ok {
+		t.Fatalf("fresh entry not loaded")
+	}
+	if !fresh.expirationTime.Equal(now.Add(time.Minute)) || !fresh.cacheTime.Equal(now) {
+		t.Errorf("fresh entry times = %v %v, want %v %v", fresh.cacheTime, fresh.expirationTime, now, now.Add(time.Minute))
+	}
+	if (len(fresh.message.Answer) != 1) || (fresh.message.Answer[0].(*dns.A).A.String() != "192.0.2.1") {
+		t.Errorf("fresh entry answer = %v", fresh.message.Answer)
+	}
+
+	if _, ok := loaded.cache.get("stale.example.:1"); !ok {
+		t.Errorf("stale entry within maxStale not loaded")
+	}
+	if _, ok := loaded.cache.get("expired.example.:1"); ok {
+		t.Errorf("expired entry loaded")
+	}
+
+	if loaded.prefetch.cacheKeyToQuestion.Len() != 1 {
+		t.Errorf("prefetch len = %v, want 1", loaded.prefetch.cacheKeyToQuestion.Len())
+	}
+	value, ok := loaded.prefetch.cacheKeyToQuestion.Get("fresh.example.:1")
+	if !ok {
+		t.Fatalf("fresh prefetch entry not loaded")
+	}
+	entry := value.(*prefetchCacheEntry)
+	if (entry.question != freshQuestion) || (entry.upstreamPolicy != upstreamPolicy{upstream: "quad9", ipBlocking: true}) {
+		t.Errorf("prefetch entry = %+v", entry)
+	}
+}
+
+func TestCacheSnapshotInvalidFileIgnored(t *testing.T) {
+	now := time.Now()
+
+	saved := newTestCacheSnapshot(t, "")
+	saved.cache.add("a.example.:1", newTestCacheObject("a.example.", now, now.Add(time.Minute)))
+	saved.cache.add("b.example.:1", newTestCacheObject("b.example.", now, now.Add(time.Minute)))
+
+	var buffer bytes.Buffer
+	if _, _, err := saved.encode(&buffer); err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+	valid := buffer.Bytes()
+
+	oldVersion := append([]byte(nil), valid...)
+	binary.BigEndian.PutUint32(oldVersion[len(cacheSnapshotMagic):], cacheSnapshotVersion-1)
+
+	badMagic := append([]byte(nil), valid...)
+	badMagic[0] = 'x'
+
+	badRecordType := append([]byte(nil), valid...)
+	badRecordType[len(cacheSnapshotMagic)+4] = 99
+
+	tests := []struct {
+		name     string
+		contents []byte
+		wantLen  int
+	}{
+		{name: "valid", contents: valid, wantLen: 2},
+		{name: "empty", contents: nil, wantLen: 0},
+		{name: "old version", contents: oldVersion, wantLen: 0},
+		{name: "bad magic", contents: badMagic, wantLen: 0},
+		{name: "bad record type", contents: badRecordType, wantLen: 0},
+		{name: "truncated header", contents: valid[:10], wantLen: 0},
+		{name: "truncated entry", contents: valid[:len(valid)-5], wantLen: 0},
+		{name: "corrupt message", contents: append(append([]byte(nil), valid[:len(valid)-20]...), bytes.Repeat([]byte{0xff}, 20)...), wantLen: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "cache-snapshot.bin")
+			if err := ioutil.WriteFile(file, test.contents, 0644); err != nil {
+				t.Fatalf("ioutil.WriteFile error: %v", err)
+			}
+
+			loaded := newTestCacheSnapshot(t, file)
+			loaded.load()
+
+			if loaded.cache.len() != test.wantLen {
+				t.Errorf("cache.len = %v, want %v", loaded.cache.len(), test.wantLen)
+			}
+		})
+	}
+}
+
+// TestCacheSnapshotEncodeConcurrentWithCacheHits fails with -race if encode writes to cached messages.
+func TestCacheSnapshotEncodeConcurrentWithCacheHits(t *testing.T) {
+	now := time.Now()
+
+	cacheSnapshot := newTestCacheSnapshot(t, "")
+	cacheObject := newTestCacheObject("example.com.", now, now.Add(time.Minute))
+	cacheSnapshot.cache.add("example.com.:1", cacheObject)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			cacheObject.message.Copy()
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if _, _, err := cacheSnapshot.encode(ioutil.Discard); err != nil {
+			t.Fatalf("encode error: %v", err)
+		}
+	}
+	wg.Wait()
+}
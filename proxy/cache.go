@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
@@ -9,27 +10,55 @@ import (
 	"github.com/miekg/dns"
 )
 
-func getCacheKey(question *dns.Question) string {
-	return fmt.Sprintf("%s:%d", dns.CanonicalName(question.Name), question.Qtype)
+// dnssecOK returns true if the request has the EDNS DNSSEC OK bit set.
+func dnssecOK(request *dns.Msg) bool {
+	opt := request.IsEdns0()
+	return (opt != nil) && opt.Do()
+}
+
+// getCacheKey returns the cache key for the question of a request.  Responses to DNSSEC OK
+// requests carry DNSSEC records and are cached separately.  Keys for client groups with their
+// own upstreamPolicy include the policy.
+func getCacheKey(request *dns.Msg, upstreamPolicy upstreamPolicy) string {
+	question := &(request.Question[0])
+
+	cacheKey := fmt.Sprintf("%s:%d", dns.CanonicalName(question.Name), question.Qtype)
+	if dnssecOK(request) {
+		cacheKey += ":do"
+	}
+	if upstreamPolicy != defaultUpstreamPolicy {
+		cacheKey += fmt.Sprintf(":%s:%v", upstreamPolicy.upstream, upstreamPolicy.ipBlocking)
+	}
+	return cacheKey
 }
 
 type cacheObject struct {
 	cacheTime      time.Time
 	expirationTime time.Time
 	message        dns.Msg
+	// blockedAddress is the IP blocklist decision made when the response was cached
+	blockedAddress string
 }
 
 func (co *cacheObject) expired(now time.Time) bool {
 	return now.After(co.expirationTime)
 }
 
+// RFC 8767 section 4: stale data may be served until maxStale past expiration.
+func (co *cacheObject) staleExpired(now time.Time, maxStale time.Duration) bool {
+	return now.After(co.expirationTime.Add(maxStale))
+}
+
 func (co *cacheObject) durationInCache(now time.Time) time.Duration {
 	return now.Sub(co.cacheTime)
 }
 
 type cache struct {
-	configuration *CacheConfiguration
-	lruCache      *lru.Cache
+	configuration    *CacheConfiguration
+	backgroundTask   *backgroundTask
+	lruCache         *lru.Cache
+	maxStale         time.Duration
+	staleResponseTTL uint32
 }
 
 func newCache(configuration *CacheConfiguration) *cache {
@@ -38,9 +67,18 @@ func newCache(configuration *CacheConfiguration) *cache {
 		log.Fatalf("error creating cache %v", err)
 	}
 
+	staleResponseTTL := configuration.StaleResponseTTLSeconds
+	if staleResponseTTL == 0 {
+		// RFC 8767 section 4 recommends 30 seconds
+		staleResponseTTL = 30
+	}
+
 	return &cache{
-		configuration: configuration,
-		lruCache:      lruCache,
+		configuration:    configuration,
+		backgroundTask:   newBackgroundTask(),
+		lruCache:         lruCache,
+		maxStale:         time.Duration(configuration.MaxStaleSeconds) * time.Second,
+		staleResponseTTL: staleResponseTTL,
 	}
 }
 
@@ -58,10 +96,21 @@ func (cache *cache) get(key string) (*cacheObject, bool) {
 	return cacheObject, true
 }
 
+func (cache *cache) serveStaleEnabled() bool {
+	return cache.maxStale > 0
+}
+
 func (cache *cache) add(key string, value *cacheObject) {
 	cache.lruCache.Add(key, value)
 }
 
+// purge removes all entries and returns the number removed.
+func (cache *cache) purge() int {
+	itemsPurged := cache.lruCache.Len()
+	cache.lruCache.Purge()
+	return itemsPurged
+}
+
 func (cache *cache) len() int {
 	return cache.lruCache.Len()
 }
@@ -75,7 +124,7 @@ func (cache *cache) periodicPurge(maxPurgeItems int) (itemsPurged int) {
 
 		cacheObject := value.(*cacheObject)
 
-		if cacheObject.expired(time.Now()) {
+		if cacheObject.staleExpired(time.Now(), cache.maxStale) {
 			cache.lruCache.Remove(key)
 			itemsPurged++
 		} else {
@@ -88,18 +137,29 @@ func (cache *cache) periodicPurge(maxPurgeItems int) (itemsPurged int) {
 
 func (cache *cache) runPeriodicTimer() {
 	ticker := time.NewTicker(time.Duration(cache.configuration.TimerIntervalSeconds) * time.Second)
+	defer ticker.Stop()
 
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+			cacheItemsPurged := cache.periodicPurge(cache.configuration.MaxPurgesPerTimerPop)
 
-		cacheItemsPurged := cache.periodicPurge(cache.configuration.MaxPurgesPerTimerPop)
+			log.Printf("cache.len = %v cacheItemsPurged = %v", cache.len(), cacheItemsPurged)
 
-		log.Printf("cache.len = %v cacheItemsPurged = %v", cache.len(), cacheItemsPurged)
+		case <-cache.backgroundTask.stopping():
+			return
+		}
 	}
 }
 
 func (cache *cache) start() {
 	log.Printf("cache.start")
 
-	go cache.runPeriodicTimer()
+	cache.backgroundTask.run(cache.runPeriodicTimer)
+}
+
+func (cache *cache) stop(ctx context.Context) error {
+	log.Printf("cache.stop")
+
+	return cache.backgroundTask.stop(ctx)
 }
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestGetCacheKey(t *testing.T) {
+	tests := []struct {
+		name           string
+		questionName   string
+		qtype          uint16
+		dnssecOK       bool
+		upstreamPolicy upstreamPolicy
+		want           string
+	}{
+		{name: "default", questionName: "Example.COM.", qtype: dns.TypeA, upstreamPolicy: defaultUpstreamPolicy, want: "example.com.:1"},
+		{name: "DNSSEC OK", questionName: "example.com.", qtype: dns.TypeAAAA, dnssecOK: true, upstreamPolicy: defaultUpstreamPolicy, want: "example.com.:28:do"},
+		{name: "upstream", questionName: "example.com.", qtype: dns.TypeA, upstreamPolicy: upstreamPolicy{upstream: "quad9", ipBlocking: true}, want: "example.com.:1:quad9:true"},
+		{name: "no IP blocking", questionName: "example.com.", qtype: dns.TypeA, upstreamPolicy: upstreamPolicy{}, want: "example.com.:1::false"},
+		{name: "DNSSEC OK and upstream", questionName: "example.com.", qtype: dns.TypeA, dnssecOK: true, upstreamPolicy: upstreamPolicy{upstream: "quad9"}, want: "example.com.:1:do:quad9:false"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := new(dns.Msg)
+			request.SetQuestion(test.questionName, test.qtype)
+			if test.dnssecOK {
+				request.SetEdns0(1232, true)
+			}
+
+			if got := getCacheKey(request, test.upstreamPolicy); got != test.want {
+				t.Errorf("getCacheKey = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGetCacheKeyClientGroups(t *testing.T) {
+	request := new(dns.Msg)
+	request.SetQuestion("example.com.", dns.TypeA)
+
+	cacheKey := func(t *testing.T, configuration ClientGroupConfiguration) string {
+		clientGroup, err := newClientGroup(&configuration)
+		if err != nil {
+			t.Fatalf("newClientGroup error: %v", err)
+		}
+		return getCacheKey(request, clientGroup.upstreamPolicy)
+	}
+
+	defaultKey := getCacheKey(request, newDefaultClientGroup().upstreamPolicy)
+	sameAsDefault := cacheKey(t, ClientGroupConfiguration{Name: "lan", Blocklists: []string{"ads"}})
+	ownUpstream := cacheKey(t, ClientGroupConfiguration{Name: "work", Upstream: "quad9"})
+	noBlocking := cacheKey(t, ClientGroupConfiguration{Name: "admin", DisableBlocking: true})
+
+	// blocklists are checked after the cache, so only the upstreamPolicy separates cache entries
+	if sameAsDefault != defaultKey {
+		t.Errorf("cache key with the default upstreamPolicy = %q, want %q", sameAsDefault, defaultKey)
+	}
+	keys := map[string]bool{defaultKey: true, ownUpstream: true, noBlocking: true}
+	if len(keys) != 3 {
+		t.Errorf("cache keys %q, %q, %q are not distinct", defaultKey, ownUpstream, noBlocking)
+	}
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// defaultClientGroupName is the group of clients in no ClientGroupConfiguration.
+const defaultClientGroupName = "default"
+
+// blockedDomainsFileBlocklistName selects BlockedDomainsFile in ClientGroupConfiguration.Blocklists.
+const blockedDomainsFileBlocklistName = "blockedDomainsFile"
+
+// upstreamPolicy is how a client group resolves cache misses.  Upstream responses are cached
+// per upstreamPolicy because the upstream and IP blocklist change the cached response.
+type upstreamPolicy struct {
+	// upstream is the only upstream used, "" for the upstream selection policy
+	upstream   string
+	ipBlocking bool
+}
+
+var defaultUpstreamPolicy = upstreamPolicy{
+	ipBlocking: true,
+}
+
+type clientGroup struct {
+	name           string
+	networks       []*net.IPNet
+	blocklistNames []string
+	blocking       bool
+	upstreamPolicy upstreamPolicy
+}
+
+func newDefaultClientGroup() *clientGroup {
+	return &clientGroup{
+		name:           defaultClientGroupName,
+		blocking:       true,
+		upstreamPolicy: defaultUpstreamPolicy,
+	}
+}
+
+// parseClientNetwork parses a CIDR, or an address as a single address network.
+func parseClientNetwork(clientCIDR string) (*net.IPNet, error) {
+	if strings.Contains(clientCIDR, "/") {
+		_, network, err := net.ParseCIDR(clientCIDR)
+		return network, err
+	}
+
+	ip := net.ParseIP(clientCIDR)
+	if ip == nil {
+		return nil, errors.New("invalid IP address")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+func newClientGroup(configuration *ClientGroupConfiguration) (*clientGroup, error) {
+	if (len(configuration.Name) == 0) || (configuration.Name == defaultClientGroupName) {
+		return nil, fmt.Errorf("invalid client group name %q", configuration.Name)
+	}
+
+	clientGroup := &clientGroup{
+		name:           configuration.Name,
+		blocklistNames: configuration.Blocklists,
+		blocking:       !configuration.DisableBlocking,
+		upstreamPolicy: upstreamPolicy{
+			upstream:   configuration.Upstream,
+			ipBlocking: !configuration.DisableBlocking,
+		},
+	}
+
+	for _, clientCIDR := range configuration.ClientCIDRs {
+		network, err := parseClientNetwork(clientCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("client group %q invalid clientCIDR %q: %w", configuration.Name, clientCIDR, err)
+		}
+		clientGroup.networks = append(clientGroup.networks, network)
+	}
+
+	return clientGroup, nil
+}
+
+// matchPrefixLength returns the prefix length of the most specific network containing ip, or -1
+// if none does.
+func (clientGroup *clientGroup) matchPrefixLength(ip net.IP) int {
+	prefixLength := -1
+	for _, network := range clientGroup.networks {
+		if ones, _ := network.Mask.Size(); (ones > prefixLength) && network.Contains(ip) {
+			prefixLength = ones
+		}
+	}
+	return prefixLength
+}
+
+// remoteIP returns the client address of a DNS or DoH query, or nil.
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
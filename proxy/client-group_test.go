@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNewClientGroup(t *testing.T) {
+	tests := []struct {
+		name          string
+		configuration ClientGroupConfiguration
+		wantNetworks  []string
+		wantErr       bool
+	}{
+		{name: "addresses and CIDRs", configuration: ClientGroupConfiguration{Name: "kids", ClientCIDRs: []string{"192.0.2.10", "198.51.100.0/24", "2001:db8::10", "2001:db8:1::/48"}}, wantNetworks: []string{"192.0.2.10/32", "198.51.100.0/24", "2001:db8::10/128", "2001:db8:1::/48"}},
+		{name: "no name", configuration: ClientGroupConfiguration{ClientCIDRs: []string{"192.0.2.10"}}, wantErr: true},
+		{name: "default name", configuration: ClientGroupConfiguration{Name: defaultClientGroupName}, wantErr: true},
+		{name: "invalid address", configuration: ClientGroupConfiguration{Name: "kids", ClientCIDRs: []string{"tablet"}}, wantErr: true},
+		{name: "invalid CIDR", configuration: ClientGroupConfiguration{Name: "kids", ClientCIDRs: []string{"192.0.2.0/33"}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientGroup, err := newClientGroup(&test.configuration)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("newClientGroup error = %v, wantErr %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			if len(clientGroup.networks) != len(test.wantNetworks) {
+				t.Fatalf("networks = %v, want %v", clientGroup.networks, test.wantNetworks)
+			}
+			for i, network := range clientGroup.networks {
+				if network.String() != test.wantNetworks[i] {
+					t.Errorf("networks[%v] = %v, want %v", i, network, test.wantNetworks[i])
+				}
+			}
+		})
+	}
+}
+
+func newTestClientGroupHandler(t *testing.T, name string, clientCIDRs ...string) *clientGroupHandler {
+	clientGroup, err := newClientGroup(&ClientGroupConfiguration{Name: name, ClientCIDRs: clientCIDRs})
+	if err != nil {
+		t.Fatalf("newClientGroup error: %v", err)
+	}
+	return &clientGroupHandler{clientGroup: clientGroup}
+}
+
+func TestDNSProxyHandlerClientGroup(t *testing.T) {
+	dnsProxyHandler := &dnsProxyHandler{
+		clientGroupHandlers: []*clientGroupHandler{
+			newTestClientGroupHandler(t, "lan", "192.168.1.0/24", "2001:db8::/32"),
+			newTestClientGroupHandler(t, "kids", "192.168.1.64/26", "2001:db8:0:1::/64"),
+			newTestClientGroupHandler(t, "tablet", "192.168.1.70"),
+			newTestClientGroupHandler(t, "kids-too", "192.168.1.64/26"),
+		},
+		defaultClientGroupHandler: &clientGroupHandler{clientGroup: newDefaultClientGroup()},
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr net.Addr
+		want       string
+	}{
+		{name: "lan udp", remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.168.1.10"), Port: 53000}, want: "lan"},
+		{name: "more specific CIDR", remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.168.1.65"), Port: 53000}, want: "kids"},
+		{name: "tie goes to the first configured", remoteAddr: &net.UDPAddr{IP: net.ParseIP("192.168.1.100"), Port: 53000}, want: "kids"},
+		{name: "address over CIDRs", remoteAddr: &net.TCPAddr{IP: net.ParseIP("192.168.1.70"), Port: 53000}, want: "tablet"},
+		{name: "IPv4-mapped IPv6 client", remoteAddr: &net.TCPAddr{IP: net.ParseIP("::ffff:192.168.1.70"), Port: 53000}, want: "tablet"},
+		{name: "lan IPv6", remoteAddr: &net.UDPAddr{IP: net.ParseIP("2001:db8:0:2::1"), Port: 53000}, want: "lan"},
+		{name: "more specific IPv6 CIDR", remoteAddr: &net.UDPAddr{IP: net.ParseIP("2001:db8:0:1::1"), Port: 53000}, want: "kids"},
+		{name: "no group", remoteAddr: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 53000}, want: defaultClientGroupName},
+		{name: "no address", remoteAddr: &net.UnixAddr{Name: "/run/dns.sock", Net: "unix"}, want: defaultClientGroupName},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &testResponseWriter{remoteAddr: test.remoteAddr}
+			if got := dnsProxyHandler.clientGroupHandler(w).clientGroup.name; got != test.want {
+				t.Errorf("client group = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -10,12 +10,38 @@ import (
 
 // MetricsConfiguration is the metrics configuration.
 type MetricsConfiguration struct {
-	TimerIntervalSeconds int `json:"timerIntervalSeconds"`
+	TimerIntervalSeconds                int       `json:"timerIntervalSeconds"`
+	ListenAddress                       string    `json:"listenAddress"`
+	LatencyHistogramBucketsMilliseconds []float64 `json:"latencyHistogramBucketsMilliseconds"`
 }
 
-// DNSServerConfiguration is the DNS server configuration.
+// DNSServerConfiguration is the DNS server configuration.  ListenAddress is the udp and tcp
+// address of older configurations and is used only when Listeners is empty.
 type DNSServerConfiguration struct {
+	ListenAddress          *HostAndPort               `json:"listenAddress"`
+	Listeners              []DNSListenerConfiguration `json:"listeners"`
+	TLSConfiguration       TLSConfiguration           `json:"tlsConfiguration"`
+	DOHServerConfiguration DOHServerConfiguration     `json:"dohServerConfiguration"`
+}
+
+// DNSListenerConfiguration is a listen address and its protocols: udp, tcp, tls (DNS-over-TLS),
+// and https (DNS-over-HTTPS).  tcp, tls, and https each need their own address.
+type DNSListenerConfiguration struct {
 	ListenAddress HostAndPort `json:"listenAddress"`
+	Protocols     []string    `json:"protocols"`
+}
+
+// DOHServerConfiguration is the configuration for https listeners.  Plain http is served
+// when tlsConfiguration has no certFile, e.g. behind a reverse proxy.
+type DOHServerConfiguration struct {
+	Path               string `json:"path"`
+	TrustXForwardedFor bool   `json:"trustXForwardedFor"`
+}
+
+// TLSConfiguration is a certificate and key file pair.  The files are reloaded when they change.
+type TLSConfiguration struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
 }
 
 // HostAndPort is a host and port.
@@ -55,28 +81,133 @@ type ReverseDomainConfiguration struct {
 	ResponseTTLSeconds uint32                 `json:"responseTTLSeconds"`
 }
 
-// DNSProxyConfiguration is the proxy configuration.
+// AllowlistConfiguration lists domains that are not blocked even if in the blocked domains file.
+// "example.com" matches only example.com, "*.example.com" matches example.com and all its
+// subdomains.  File has one entry per line with # comments.
+type AllowlistConfiguration struct {
+	File    string   `json:"file"`
+	Domains []string `json:"domains"`
+}
+
+// BlockResponseConfiguration is the response to blocked queries.  Mode is one of nxdomain
+// (default), nodata, refused, nullIP (0.0.0.0 and :: answers), or sinkhole (SinkholeIPv4 and
+// SinkholeIPv6 answers).  ExtendedDNSError adds an RFC 8914 "Blocked" error for EDNS clients.
+type BlockResponseConfiguration struct {
+	Mode             string `json:"mode"`
+	SinkholeIPv4     string `json:"sinkholeIPv4"`
+	SinkholeIPv6     string `json:"sinkholeIPv6"`
+	TTLSeconds       uint32 `json:"ttlSeconds"`
+	ExtendedDNSError bool   `json:"extendedDNSError"`
+}
+
+// IPBlocklistConfiguration blocks A and AAAA records in upstream responses by address or CIDR.
+// Mode strip (default) removes matching records, block answers the whole response with the
+// block response.  File has one address or CIDR per line with # comments.
+type IPBlocklistConfiguration struct {
+	Mode      string   `json:"mode"`
+	File      string   `json:"file"`
+	Addresses []string `json:"addresses"`
+}
+
+// BlocklistSourceConfiguration is a blocklist in any supported format.  With URL set it is
+// downloaded every RefreshIntervalSeconds (default one day) and the last good copy is kept in
+// File.  Without URL, File is read again when its modification time changes, checked every
+// 10 seconds.  Name defaults to URL or File.
+type BlocklistSourceConfiguration struct {
+	Name                   string `json:"name"`
+	URL                    string `json:"url"`
+	File                   string `json:"file"`
+	RefreshIntervalSeconds int    `json:"refreshIntervalSeconds"`
+}
+
+// ClientGroupConfiguration is the policy for clients with source addresses in ClientCIDRs.  A
+// client in more than one group is in the group with the most specific CIDR.
+// Blocklists names the blocklist sources and "blockedDomainsFile" that apply, all if empty.
+// DisableBlocking turns off domain, CNAME, and IP blocking.  Upstream names the only DoH
+// upstream used, if empty the upstream selection policy is used.
+type ClientGroupConfiguration struct {
+	Name            string   `json:"name"`
+	ClientCIDRs     []string `json:"clientCIDRs"`
+	Blocklists      []string `json:"blocklists"`
+	DisableBlocking bool     `json:"disableBlocking"`
+	Upstream        string   `json:"upstream"`
+}
+
+// ScheduleTimeRangeConfiguration is a time of day range from Start to End, "HH:MM" each.  A range
+// that ends before it starts ends on the next day.
+type ScheduleTimeRangeConfiguration struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// ScheduleConfiguration blocks Blocklists and BlockedDomains for ClientGroups, all if empty, by
+// time.  The schedule is active on Days ("monday" or "mon", every day if empty) during TimeRanges
+// in TimeZone (an IANA time zone, local time if empty).  With Action "enable" (the default) they
+// are blocked while the schedule is active, with "disable" while it is not.  Blocklists named by
+// a schedule are blocked only by the schedule for its client groups.
+type ScheduleConfiguration struct {
+	Name           string                           `json:"name"`
+	ClientGroups   []string                         `json:"clientGroups"`
+	Action         string                           `json:"action"`
+	Days           []string                         `json:"days"`
+	TimeRanges     []ScheduleTimeRangeConfiguration `json:"timeRanges"`
+	TimeZone       string                           `json:"timeZone"`
+	Blocklists     []string                         `json:"blocklists"`
+	BlockedDomains []string                         `json:"blockedDomains"`
+}
+
+// DNSProxyConfiguration is the proxy configuration.  Clients in no ClientGroupConfiguration are
+// in the default group with all blocklists and the upstream selection policy.
 type DNSProxyConfiguration struct {
-	ForwardDomainConfigurations []ForwardDomainConfiguration `json:"forwardDomainConfigurations"`
-	ReverseDomainConfigurations []ReverseDomainConfiguration `json:"reverseDomainConfigurations"`
-	BlockedDomainsFile          string                       `json:"blockedDomainsFile"`
-	ClampMinTTLSeconds          uint32                       `json:"clampMinTTLSeconds"`
-	ClampMaxTTLSeconds          uint32                       `json:"clampMaxTTLSeconds"`
+	ForwardDomainConfigurations   []ForwardDomainConfiguration   `json:"forwardDomainConfigurations"`
+	ReverseDomainConfigurations   []ReverseDomainConfiguration   `json:"reverseDomainConfigurations"`
+	BlockedDomainsFile            string                         `json:"blockedDomainsFile"`
+	BlocklistSourceConfigurations []BlocklistSourceConfiguration `json:"blocklistSourceConfigurations"`
+	AllowlistConfiguration        AllowlistConfiguration         `json:"allowlistConfiguration"`
+	BlockResponseConfiguration    BlockResponseConfiguration     `json:"blockResponseConfiguration"`
+	IPBlocklistConfiguration      IPBlocklistConfiguration       `json:"ipBlocklistConfiguration"`
+	ClientGroupConfigurations     []ClientGroupConfiguration     `json:"clientGroupConfigurations"`
+	ScheduleConfigurations        []ScheduleConfiguration        `json:"scheduleConfigurations"`
+	ClampMinTTLSeconds            uint32                         `json:"clampMinTTLSeconds"`
+	ClampMaxTTLSeconds            uint32                         `json:"clampMaxTTLSeconds"`
+}
+
+// DOHUpstreamConfiguration is a DOH upstream server.
+type DOHUpstreamConfiguration struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
 }
 
-// DOHClientConfiguration is the DOH client configuration
+// DOHClientConfiguration is the DOH client configuration.  URL is the single upstream of older
+// configurations and is used only when Upstreams is empty.
 type DOHClientConfiguration struct {
-	URL                                 string `json:"url"`
-	MaxConcurrentRequests               int64  `json:"maxConcurrentRequests"`
-	SemaphoreAcquireTimeoutMilliseconds int    `json:"semaphoreAcquireTimeoutMilliseconds"`
-	RequestTimeoutMilliseconds          int    `json:"requestTimeoutMilliseconds"`
+	URL                                 string                     `json:"url"`
+	Upstreams                           []DOHUpstreamConfiguration `json:"upstreams"`
+	UpstreamSelectionPolicy             string                     `json:"upstreamSelectionPolicy"`
+	HealthCheckIntervalSeconds          int                        `json:"healthCheckIntervalSeconds"`
+	WireFormat                          bool                       `json:"wireFormat"`
+	HTTPMethod                          string                     `json:"httpMethod"`
+	PaddingBlockSizeBytes               int                        `json:"paddingBlockSizeBytes"`
+	MaxConcurrentRequests               int64                      `json:"maxConcurrentRequests"`
+	SemaphoreAcquireTimeoutMilliseconds int                        `json:"semaphoreAcquireTimeoutMilliseconds"`
+	RequestTimeoutMilliseconds          int                        `json:"requestTimeoutMilliseconds"`
 }
 
 // CacheConfiguration is the cache configuration.
 type CacheConfiguration struct {
-	MaxSize              int `json:"maxSize"`
-	MaxPurgesPerTimerPop int `json:"maxPurgesPerTimerPop"`
-	TimerIntervalSeconds int `json:"timerIntervalSeconds"`
+	MaxSize                    int    `json:"maxSize"`
+	MaxPurgesPerTimerPop       int    `json:"maxPurgesPerTimerPop"`
+	TimerIntervalSeconds       int    `json:"timerIntervalSeconds"`
+	MaxStaleSeconds            int    `json:"maxStaleSeconds"`
+	StaleResponseTTLSeconds    uint32 `json:"staleResponseTTLSeconds"`
+	NegativeClampMinTTLSeconds uint32 `json:"negativeClampMinTTLSeconds"`
+	NegativeClampMaxTTLSeconds uint32 `json:"negativeClampMaxTTLSeconds"`
+}
+
+// CacheSnapshotConfiguration is the cache snapshot configuration.
+type CacheSnapshotConfiguration struct {
+	File                 string `json:"file"`
+	TimerIntervalSeconds int    `json:"timerIntervalSeconds"`
 }
 
 // PrefetchConfiguration is the prefetch configuration.
@@ -93,15 +224,35 @@ type PprofConfiguration struct {
 	ListenAddress string `json:"listenAddress"`
 }
 
+// QueryLogConfiguration is the query log configuration.
+type QueryLogConfiguration struct {
+	Mode          string `json:"mode"`
+	File          string `json:"file"`
+	MaxSizeBytes  int64  `json:"maxSizeBytes"`
+	MaxAgeSeconds int    `json:"maxAgeSeconds"`
+	MaxBackups    int    `json:"maxBackups"`
+}
+
+// DNSTapConfiguration is the dnstap configuration.  At most one of UnixSocket and File may be set.
+type DNSTapConfiguration struct {
+	UnixSocket string `json:"unixSocket"`
+	File       string `json:"file"`
+	Identity   string `json:"identity"`
+	QueueSize  int    `json:"queueSize"`
+}
+
 // Configuration is the DNS proxy configuration.
 type Configuration struct {
-	MetricsConfiguration   MetricsConfiguration   `json:"metricsConfiguration"`
-	DNSServerConfiguration DNSServerConfiguration `json:"dnsServerConfiguration"`
-	DOHClientConfiguration DOHClientConfiguration `json:"dohClientConfiguration"`
-	DNSProxyConfiguration  DNSProxyConfiguration  `json:"dnsProxyConfiguration"`
-	CacheConfiguration     CacheConfiguration     `json:"cacheConfiguration"`
-	PrefetchConfiguration  PrefetchConfiguration  `json:"PrefetchConfiguration"`
-	PprofConfiguration     PprofConfiguration     `json:"pprofConfiguration"`
+	MetricsConfiguration       MetricsConfiguration       `json:"metricsConfiguration"`
+	DNSServerConfiguration     DNSServerConfiguration     `json:"dnsServerConfiguration"`
+	DOHClientConfiguration     DOHClientConfiguration     `json:"dohClientConfiguration"`
+	DNSProxyConfiguration      DNSProxyConfiguration      `json:"dnsProxyConfiguration"`
+	CacheConfiguration         CacheConfiguration         `json:"cacheConfiguration"`
+	CacheSnapshotConfiguration CacheSnapshotConfiguration `json:"cacheSnapshotConfiguration"`
+	PrefetchConfiguration      PrefetchConfiguration      `json:"PrefetchConfiguration"`
+	PprofConfiguration         PprofConfiguration         `json:"pprofConfiguration"`
+	QueryLogConfiguration      QueryLogConfiguration      `json:"queryLogConfiguration"`
+	DNSTapConfiguration        DNSTapConfiguration        `json:"dnstapConfiguration"`
 }
 
 // ReadConfiguration reads the DNS proxy configuration from a json file.
@@ -120,5 +271,47 @@ func ReadConfiguration(configFile string) (*Configuration, error) {
 		return nil, err
 	}
 
+	config.DNSServerConfiguration.convertListenAddress()
+	config.DOHClientConfiguration.convertURL()
+
 	return &config, nil
 }
+
+// convertListenAddress converts the listenAddress of older configurations to listeners.
+func (configuration *DNSServerConfiguration) convertListenAddress() {
+	if configuration.ListenAddress == nil {
+		return
+	}
+
+	if len(configuration.Listeners) > 0 {
+		log.Printf("dnsServerConfiguration listenAddress is replaced by listeners, ignoring listenAddress %v", configuration.ListenAddress.joinHostPort())
+		return
+	}
+
+	log.Printf("dnsServerConfiguration listenAddress is replaced by listeners, using listenAddress %v for udp and tcp", configuration.ListenAddress.joinHostPort())
+	configuration.Listeners = []DNSListenerConfiguration{
+		{
+			ListenAddress: *configuration.ListenAddress,
+			Protocols:     []string{dnsListenerProtocolUDP, dnsListenerProtocolTCP},
+		},
+	}
+}
+
+// convertURL converts the url of older configurations to upstreams.
+func (configuration *DOHClientConfiguration) convertURL() {
+	if len(configuration.URL) == 0 {
+		return
+	}
+
+	if len(configuration.Upstreams) > 0 {
+		log.Printf("dohClientConfiguration url is replaced by upstreams, ignoring url %q", configuration.URL)
+		return
+	}
+
+	log.Printf("dohClientConfiguration url is replaced by upstreams, using url %q as the only upstream", configuration.URL)
+	configuration.Upstreams = []DOHUpstreamConfiguration{
+		{
+			URL: configuration.URL,
+		},
+	}
+}
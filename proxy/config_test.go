@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadConfigurationListeners(t *testing.T) {
+	tests := []struct {
+		name          string
+		json          string
+		wantListeners []DNSListenerConfiguration
+	}{
+		{
+			name: "legacy listenAddress",
+			json: `{"dnsServerConfiguration": {"listenAddress": {"host": "127.0.0.1", "port": "10053"}}}`,
+			wantListeners: []DNSListenerConfiguration{
+				{
+					ListenAddress: HostAndPort{Host: "127.0.0.1", Port: "10053"},
+					Protocols:     []string{dnsListenerProtocolUDP, dnsListenerProtocolTCP},
+				},
+			},
+		},
+		{
+			name: "listeners",
+			json: `{"dnsServerConfiguration": {"listeners": [
+				{"listenAddress": {"host": "127.0.0.1", "port": "10053"}, "protocols": ["udp"]},
+				{"listenAddress": {"host": "::1", "port": "10853"}, "protocols": ["tls"]}
+			]}}`,
+			wantListeners: []DNSListenerConfiguration{
+				{
+					ListenAddress: HostAndPort{Host: "127.0.0.1", Port: "10053"},
+					Protocols:     []string{dnsListenerProtocolUDP},
+				},
+				{
+					ListenAddress: HostAndPort{Host: "::1", Port: "10853"},
+					Protocols:     []string{dnsListenerProtocolTLS},
+				},
+			},
+		},
+		{
+			name: "listeners replace listenAddress",
+			json: `{"dnsServerConfiguration": {
+				"listenAddress": {"host": "127.0.0.1", "port": "10053"},
+				"listeners": [{"listenAddress": {"host": "0.0.0.0", "port": "53"}, "protocols": ["tcp"]}]
+			}}`,
+			wantListeners: []DNSListenerConfiguration{
+				{
+					ListenAddress: HostAndPort{Host: "0.0.0.0", Port: "53"},
+					Protocols:     []string{dnsListenerProtocolTCP},
+				},
+			},
+		},
+		{
+			name: "no listeners",
+			json: `{"dnsServerConfiguration": {}}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "config.json")
+			if err := ioutil.WriteFile(file, []byte(test.json), 0644); err != nil {
+				t.Fatalf("ioutil.WriteFile error: %v", err)
+			}
+
+			configuration, err := ReadConfiguration(file)
+			if err != nil {
+				t.Fatalf("ReadConfiguration error: %v", err)
+			}
+
+			if listeners := configuration.DNSServerConfiguration.Listeners; !reflect.DeepEqual(listeners, test.wantListeners) {
+				t.Errorf("listeners = %+v, want %+v", listeners, test.wantListeners)
+			}
+		})
+	}
+}
@@ -2,45 +2,108 @@ package proxy
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
 )
 
 // DNSProxy is the DNS proxy.
 type DNSProxy interface {
 	Start()
+	Stop(ctx context.Context) error
+	Reload(configuration *Configuration) error
 }
 
 type dnsProxy struct {
-	configuration *Configuration
-	metrics       *metrics
-	dnsServer     *dnsServer
-	dohClient     *dohClient
-	cache         *cache
-	prefetch      *prefetch
+	configuration              *Configuration
+	dnsProxyConfigurationValue atomic.Value
+	ipBlocklistValue           atomic.Value
+	reloadMutex                sync.Mutex
+	metrics                    *metrics
+	dnsServer                  *dnsServer
+	dohClient                  *dohClient
+	cache                      *cache
+	prefetch                   *prefetch
+	blocklistSources           *blocklistSources
+	cacheSnapshot              *cacheSnapshot
+	queryLog                   *queryLog
+	dnstap                     *dnstap
+	systemdWatchdog            *systemdWatchdog
+	pprofServer                *http.Server
+	inFlightRequests           singleflight.Group
 }
 
 // NewDNSProxy creates a DNS proxy.
-func NewDNSProxy(configuration *Configuration) DNSProxy {
+func NewDNSProxy(configuration *Configuration) (DNSProxy, error) {
 	metrics := newMetrics(&configuration.MetricsConfiguration)
+	cache := newCache(&configuration.CacheConfiguration)
+	prefetch := newPrefetch(&configuration.PrefetchConfiguration)
+	dnstap := newDNSTap(&configuration.DNSTapConfiguration, metrics)
 
-	return &dnsProxy{
-		configuration: configuration,
-		metrics:       metrics,
-		dnsServer:     newDNSServer(&configuration.DNSServerConfiguration),
-		dohClient:     newDOHClient(configuration.DOHClientConfiguration, newDOHJSONConverter(metrics)),
-		cache:         newCache(&configuration.CacheConfiguration),
-		prefetch:      newPrefetch(&configuration.PrefetchConfiguration),
+	dohClient, err := newDOHClient(configuration.DOHClientConfiguration, metrics, dnstap, newDOHJSONConverter(metrics), newDOHWireConverter(metrics, configuration.DOHClientConfiguration.PaddingBlockSizeBytes))
+	if err != nil {
+		return nil, fmt.Errorf("newDOHClient error: %w", err)
+	}
+
+	dnsProxy := &dnsProxy{
+		configuration:    configuration,
+		metrics:          metrics,
+		dnsServer:        newDNSServer(&configuration.DNSServerConfiguration),
+		dohClient:        dohClient,
+		cache:            cache,
+		prefetch:         prefetch,
+		blocklistSources: newBlocklistSources(metrics),
+		cacheSnapshot:    newCacheSnapshot(&configuration.CacheSnapshotConfiguration, cache, prefetch),
+		queryLog:         newQueryLog(&configuration.QueryLogConfiguration, metrics),
+		dnstap:           dnstap,
+		systemdWatchdog:  newSystemdWatchdog(),
 	}
+	dnsProxy.dnsProxyConfigurationValue.Store(&configuration.DNSProxyConfiguration)
+
+	dnsProxy.addMetricGauges()
+
+	return dnsProxy, nil
+}
+
+func (dnsProxy *dnsProxy) addMetricGauges() {
+	dnsProxy.metrics.addGauge("cache_size", "Entries in the response cache.", func() int64 {
+		return int64(dnsProxy.cache.len())
+	})
+	dnsProxy.metrics.addGauge("prefetch_size", "Entries in the prefetch cache.", func() int64 {
+		return int64(dnsProxy.prefetch.cacheKeyToQuestion.Len())
+	})
+	dnsProxy.metrics.addGauge("semaphore_in_use", "DoH client semaphore slots in use.", func() int64 {
+		return dnsProxy.dohClient.semaphoreUsage()
+	})
+	dnsProxy.metrics.addGauge("semaphore_capacity", "DoH client semaphore slots.", func() int64 {
+		return dnsProxy.dohClient.maxConcurrentRequests
+	})
+}
+
+// dnsProxyConfiguration returns the current DNSProxyConfiguration which is replaced by Reload.
+func (dnsProxy *dnsProxy) dnsProxyConfiguration() *DNSProxyConfiguration {
+	return dnsProxy.dnsProxyConfigurationValue.Load().(*DNSProxyConfiguration)
+}
+
+// ipBlocklist returns the current ipBlocklist which is replaced by Reload, or nil.
+func (dnsProxy *dnsProxy) ipBlocklist() *ipBlocklist {
+	return dnsProxy.ipBlocklistValue.Load().(*ipBlocklist)
 }
 
 func (dnsProxy *dnsProxy) clampAndGetMinTTLSeconds(m *dns.Msg) uint32 {
-	clampMinTTLSeconds := dnsProxy.configuration.DNSProxyConfiguration.ClampMinTTLSeconds
-	clampMaxTTLSeconds := dnsProxy.configuration.DNSProxyConfiguration.ClampMaxTTLSeconds
+	clampMinTTLSeconds := dnsProxy.dnsProxyConfiguration().ClampMinTTLSeconds
+	clampMaxTTLSeconds := dnsProxy.dnsProxyConfiguration().ClampMaxTTLSeconds
 
 	foundRRHeaderTTL := false
 	rrHeaderMinTTLSeconds := clampMinTTLSeconds
@@ -76,17 +139,69 @@ func (dnsProxy *dnsProxy) clampAndGetMinTTLSeconds(m *dns.Msg) uint32 {
 	return rrHeaderMinTTLSeconds
 }
 
-func (dnsProxy *dnsProxy) getCachedMessageCopyForHit(cacheKey string) *dns.Msg {
+// RFC 2308 section 2: NXDOMAIN, or NOERROR with no answers (NODATA).
+func isNegativeResponse(m *dns.Msg) bool {
+	return (m.Rcode == dns.RcodeNameError) ||
+		((m.Rcode == dns.RcodeSuccess) && (len(m.Answer) == 0))
+}
+
+// RFC 2308 section 5: the negative TTL is the minimum of the SOA TTL and
+// the SOA MINIMUM field.  Responses without an SOA get the min clamp.  Each
+// negative clamp that is not set falls back to the positive clamp.
+func (dnsProxy *dnsProxy) clampAndGetNegativeTTLSeconds(m *dns.Msg) uint32 {
+	clampMinTTLSeconds := dnsProxy.configuration.CacheConfiguration.NegativeClampMinTTLSeconds
+	if clampMinTTLSeconds == 0 {
+		clampMinTTLSeconds = dnsProxy.dnsProxyConfiguration().ClampMinTTLSeconds
+	}
+	clampMaxTTLSeconds := dnsProxy.configuration.CacheConfiguration.NegativeClampMaxTTLSeconds
+	if clampMaxTTLSeconds == 0 {
+		clampMaxTTLSeconds = dnsProxy.dnsProxyConfiguration().ClampMaxTTLSeconds
+	}
+
+	negativeTTLSeconds := clampMinTTLSeconds
+
+	for _, rr := range m.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			negativeTTLSeconds = soa.Hdr.Ttl
+			if soa.Minttl < negativeTTLSeconds {
+				negativeTTLSeconds = soa.Minttl
+			}
+			break
+		}
+	}
+
+	if negativeTTLSeconds < clampMinTTLSeconds {
+		negativeTTLSeconds = clampMinTTLSeconds
+	}
+	if negativeTTLSeconds > clampMaxTTLSeconds {
+		negativeTTLSeconds = clampMaxTTLSeconds
+	}
+
+	for _, rr := range m.Ns {
+		rr.Header().Ttl = negativeTTLSeconds
+	}
+	for _, rr := range m.Extra {
+		rrHeader := rr.Header()
+		if rrHeader.Rrtype != dns.TypeOPT {
+			rrHeader.Ttl = negativeTTLSeconds
+		}
+	}
+
+	return negativeTTLSeconds
+}
+
+// getCachedMessageCopyForHit returns a copy of the cached response and its blocked address.
+func (dnsProxy *dnsProxy) getCachedMessageCopyForHit(cacheKey string) (*dns.Msg, string) {
 
 	uncopiedCacheObject, ok := dnsProxy.cache.get(cacheKey)
 	if !ok {
-		return nil
+		return nil, ""
 	}
 
 	now := time.Now()
 
 	if uncopiedCacheObject.expired(now) {
-		return nil
+		return nil, ""
 	}
 
 	secondsToSubtractFromTTL := uint64(uncopiedCacheObject.durationInCache(now) / time.Second)
@@ -119,18 +234,55 @@ func (dnsProxy *dnsProxy) getCachedMessageCopyForHit(cacheKey string) *dns.Msg {
 	}
 
 	if !ok {
-		return nil
+		return nil, ""
+	}
+
+	return messageCopy, uncopiedCacheObject.blockedAddress
+}
+
+func (dnsProxy *dnsProxy) getStaleMessageCopy(cacheKey string) (*dns.Msg, string) {
+	if !dnsProxy.cache.serveStaleEnabled() {
+		return nil, ""
+	}
+
+	uncopiedCacheObject, ok := dnsProxy.cache.get(cacheKey)
+	if !ok {
+		return nil, ""
+	}
+
+	if uncopiedCacheObject.staleExpired(time.Now(), dnsProxy.cache.maxStale) {
+		return nil, ""
+	}
+
+	messageCopy := uncopiedCacheObject.message.Copy()
+
+	for _, rr := range messageCopy.Answer {
+		rr.Header().Ttl = dnsProxy.cache.staleResponseTTL
+	}
+	for _, rr := range messageCopy.Ns {
+		rr.Header().Ttl = dnsProxy.cache.staleResponseTTL
+	}
+	for _, rr := range messageCopy.Extra {
+		rrHeader := rr.Header()
+		if rrHeader.Rrtype != dns.TypeOPT {
+			rrHeader.Ttl = dnsProxy.cache.staleResponseTTL
+		}
 	}
 
-	return messageCopy
+	return messageCopy, uncopiedCacheObject.blockedAddress
 }
 
-func (dnsProxy *dnsProxy) clampTTLAndCacheResponse(cacheKey string, resp *dns.Msg) {
+func (dnsProxy *dnsProxy) clampTTLAndCacheResponse(cacheKey string, resp *dns.Msg, blockedAddress string) {
 	if !((resp.Rcode == dns.RcodeSuccess) || (resp.Rcode == dns.RcodeNameError)) {
 		return
 	}
 
-	minTTLSeconds := dnsProxy.clampAndGetMinTTLSeconds(resp)
+	var minTTLSeconds uint32
+	if isNegativeResponse(resp) {
+		minTTLSeconds = dnsProxy.clampAndGetNegativeTTLSeconds(resp)
+	} else {
+		minTTLSeconds = dnsProxy.clampAndGetMinTTLSeconds(resp)
+	}
 	if minTTLSeconds <= 0 {
 		return
 	}
@@ -146,6 +298,7 @@ func (dnsProxy *dnsProxy) clampTTLAndCacheResponse(cacheKey string, resp *dns.Ms
 	cacheObject := &cacheObject{
 		cacheTime:      now,
 		expirationTime: expirationTime,
+		blockedAddress: blockedAddress,
 	}
 	resp.CopyTo(&cacheObject.message)
 	cacheObject.message.Id = 0
@@ -153,12 +306,18 @@ func (dnsProxy *dnsProxy) clampTTLAndCacheResponse(cacheKey string, resp *dns.Ms
 	dnsProxy.cache.add(cacheKey, cacheObject)
 }
 
-func (dnsProxy *dnsProxy) addToPrefetch(cacheKey string, question *dns.Question, response *dns.Msg) {
+// addToPrefetch adds the question of request to prefetch.  Prefetch requests are built from
+// the question alone, so DNSSEC OK requests are not prefetched.
+func (dnsProxy *dnsProxy) addToPrefetch(cacheKey string, request *dns.Msg, upstreamPolicy upstreamPolicy, response *dns.Msg) {
 	if !((response.Rcode == dns.RcodeSuccess) || (response.Rcode == dns.RcodeNameError)) {
 		return
 	}
 
-	dnsProxy.prefetch.addToPrefetch(cacheKey, question)
+	if dnssecOK(request) {
+		return
+	}
+
+	dnsProxy.prefetch.addToPrefetch(cacheKey, &(request.Question[0]), upstreamPolicy)
 }
 
 func (dnsProxy *dnsProxy) writeResponse(w dns.ResponseWriter, response *dns.Msg) {
@@ -168,28 +327,161 @@ func (dnsProxy *dnsProxy) writeResponse(w dns.ResponseWriter, response *dns.Msg)
 	}
 }
 
-func (dnsProxy *dnsProxy) makePrefetchRequest(cacheKey string, question *dns.Question) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+// Upstream wire format responses may carry an OPT record and more data than fits in a
+// UDP response, so fix up the response for what the client asked for.
+func (dnsProxy *dnsProxy) adjustResponseForClient(w dns.ResponseWriter, request *dns.Msg, response *dns.Msg) {
+	clientOPT := request.IsEdns0()
+
+	if clientOPT == nil {
+		extra := response.Extra[:0]
+		for _, rr := range response.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		response.Extra = extra
+	}
+
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		udpSize := dns.MinMsgSize
+		if clientOPT != nil {
+			udpSize = int(clientOPT.UDPSize())
+		}
+		response.Truncate(udpSize)
+	}
+}
+
+// applyIPBlocklist strips blocked answer records or returns the blocked address, depending on
+// the ipBlocklist mode.
+func (dnsProxy *dnsProxy) applyIPBlocklist(response *dns.Msg) string {
+	ipBlocklist := dnsProxy.ipBlocklist()
+	if ipBlocklist == nil {
+		return ""
+	}
 
+	blockedAddress, strippedRecords := ipBlocklist.apply(response)
+	if strippedRecords > 0 {
+		dnsProxy.metrics.addStrippedAddressRecords(strippedRecords)
+	}
+	return blockedAddress
+}
+
+// coalescedResponse is the shared result of makeCoalescedRequest.
+type coalescedResponse struct {
+	message        *dns.Msg
+	blockedAddress string
+}
+
+// makeCoalescedRequest makes one upstream request for all concurrent callers with
+// the same cacheKey and caches the response with its IP blocklist decision.
+func (dnsProxy *dnsProxy) makeCoalescedRequest(ctx context.Context, cacheKey string, request *dns.Msg, upstreamPolicy upstreamPolicy) (*dns.Msg, string, error) {
+	executed := false
+
+	value, err, shared := dnsProxy.inFlightRequests.Do(cacheKey, func() (interface{}, error) {
+		executed = true
+
+		responseMsg, err := dnsProxy.dohClient.makeRequest(ctx, request, upstreamPolicy.upstream)
+		if err != nil {
+			return nil, err
+		}
+
+		var blockedAddress string
+		if upstreamPolicy.ipBlocking {
+			blockedAddress = dnsProxy.applyIPBlocklist(responseMsg)
+		}
+
+		dnsProxy.clampTTLAndCacheResponse(cacheKey, responseMsg, blockedAddress)
+
+		return &coalescedResponse{
+			message:        responseMsg,
+			blockedAddress: blockedAddress,
+		}, nil
+	})
+
+	if !executed {
+		dnsProxy.metrics.incrementCoalescedRequests()
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	coalescedResponse := value.(*coalescedResponse)
+	responseMsg := coalescedResponse.message
+	if shared {
+		responseMsg = responseMsg.Copy()
+	}
+
+	return responseMsg, coalescedResponse.blockedAddress, nil
+}
+
+// finishQuery records metrics, the query log entry, and dnstap messages for a handled client query.
+func (dnsProxy *dnsProxy) finishQuery(w dns.ResponseWriter, request, response *dns.Msg, outcome string, queryDetails *queryDetails) {
+	dnsProxy.metrics.recordQueryLatency(outcome, queryDetails.startTime)
+	dnsProxy.metrics.recordClientGroupQuery(queryDetails.clientGroup, outcome)
+	dnsProxy.queryLog.logQuery(w, request, response, outcome, queryDetails)
+	dnsProxy.dnstap.logClientQuery(w, request, response, queryDetails.startTime)
+}
+
+func (dnsProxy *dnsProxy) makePrefetchRequest(cacheKey string, question *dns.Question, upstreamPolicy upstreamPolicy) {
 	dnsProxy.metrics.incrementPrefetchRequests()
 
 	request := new(dns.Msg)
 	request.Question = append(request.Question, *question)
 
-	responseMsg, err := dnsProxy.dohClient.makeRequest(ctx, request)
+	dnsProxy.refreshCacheEntry(cacheKey, request, upstreamPolicy)
+}
+
+func (dnsProxy *dnsProxy) refreshCacheEntry(cacheKey string, request *dns.Msg, upstreamPolicy upstreamPolicy) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, _, err := dnsProxy.makeCoalescedRequest(ctx, cacheKey, request, upstreamPolicy)
 	if err != nil {
 		dnsProxy.metrics.incrementDOHClientErrors()
 		log.Printf("makeHttpRequest error: %v", err)
 		return
 	}
-
-	dnsProxy.clampTTLAndCacheResponse(cacheKey, responseMsg)
 }
 
-func (dnsProxy *dnsProxy) createProxyHandlerFunc() dns.HandlerFunc {
+// createProxyHandlerFunc answers from the cache or upstream.  Responses with an address in the
+// ipBlocklist in block mode or a CNAME to a domain in blocklist or a blocking scheduled blocklist
+// get the block response instead.  CNAMEs are checked on every answer, so a reloaded blocklist or
+// schedule change applies to cached entries.  The ipBlocklist is applied before caching, stripped
+// records are not cached and a blocked address is cached with the response, so setHandler
+// purges the cache when the ipBlocklist changes.
+func (dnsProxy *dnsProxy) createProxyHandlerFunc(clientGroup *clientGroup, blocklist *blocklist, scheduledBlocklists scheduledBlocklists, blockResponder *blockResponder) dns.HandlerFunc {
+	upstreamPolicy := clientGroup.upstreamPolicy
+
+	writeProxyResponse := func(w dns.ResponseWriter, request, response *dns.Msg, blockedAddress, outcome string, queryDetails *queryDetails) {
+		if len(blockedAddress) > 0 {
+			dnsProxy.metrics.incrementBlockedByAddress()
+			dnsProxy.writeBlockResponse(w, request, blockResponder, "blockedAddress "+blockedAddress, queryDetails)
+			return
+		}
+
+		if blocklist != nil {
+			if cnameTarget := blocklist.blockedCNAMETarget(response); len(cnameTarget) > 0 {
+				dnsProxy.metrics.incrementBlockedByCNAME()
+				dnsProxy.writeBlockResponse(w, request, blockResponder, "blockedCNAME "+cnameTarget, queryDetails)
+				return
+			}
+		}
+
+		if cnameTarget := scheduledBlocklists.blockedCNAMETarget(response, time.Now()); len(cnameTarget) > 0 {
+			dnsProxy.metrics.incrementBlockedByCNAME()
+			dnsProxy.metrics.incrementBlockedBySchedule()
+			dnsProxy.writeBlockResponse(w, request, blockResponder, "blockedCNAME "+cnameTarget, queryDetails)
+			return
+		}
+
+		dnsProxy.adjustResponseForClient(w, request, response)
+		dnsProxy.writeResponse(w, response)
+		dnsProxy.finishQuery(w, request, response, outcome, queryDetails)
+	}
 
 	return func(w dns.ResponseWriter, request *dns.Msg) {
+		queryDetails := newQueryDetails(clientGroup.name)
 
 		ctx, cancel := context.WithCancel(context.Background())
 		defer cancel()
@@ -197,61 +489,86 @@ func (dnsProxy *dnsProxy) createProxyHandlerFunc() dns.HandlerFunc {
 		if len(request.Question) != 1 {
 			log.Printf("bad request.Question length %v request %v", len(request.Question), request)
 			dns.HandleFailed(w, request)
+			dnsProxy.finishQuery(w, request, nil, queryOutcomeError, queryDetails)
 			return
 		}
 
 		requestID := request.Id
-		question := &(request.Question[0])
-		cacheKey := getCacheKey(question)
+		cacheKey := getCacheKey(request, upstreamPolicy)
 
-		if cacheMessageCopy := dnsProxy.getCachedMessageCopyForHit(cacheKey); cacheMessageCopy != nil {
-			dnsProxy.addToPrefetch(cacheKey, question, cacheMessageCopy)
+		if cacheMessageCopy, blockedAddress := dnsProxy.getCachedMessageCopyForHit(cacheKey); cacheMessageCopy != nil {
+			dnsProxy.addToPrefetch(cacheKey, request, upstreamPolicy, cacheMessageCopy)
 
 			dnsProxy.metrics.incrementCacheHits()
 			cacheMessageCopy.Id = requestID
-			dnsProxy.writeResponse(w, cacheMessageCopy)
+			writeProxyResponse(w, request, cacheMessageCopy, blockedAddress, queryOutcomeCacheHit, queryDetails)
 			return
 		}
 
 		dnsProxy.metrics.incrementCacheMisses()
 		request.Id = 0
-		responseMsg, err := dnsProxy.dohClient.makeRequest(ctx, request)
+		upstreamStartTime := time.Now()
+		responseMsg, blockedAddress, err := dnsProxy.makeCoalescedRequest(ctx, cacheKey, request, upstreamPolicy)
+		queryDetails.upstreamLatency = time.Since(upstreamStartTime)
+		request.Id = requestID
 		if err != nil {
 			dnsProxy.metrics.incrementDOHClientErrors()
 			log.Printf("makeHttpRequest error: %v", err)
-			request.Id = requestID
+
+			if staleMessageCopy, staleBlockedAddress := dnsProxy.getStaleMessageCopy(cacheKey); staleMessageCopy != nil {
+				dnsProxy.metrics.incrementStaleResponses()
+				staleRequest := request.Copy()
+				staleRequest.Id = 0
+				go dnsProxy.refreshCacheEntry(cacheKey, staleRequest, upstreamPolicy)
+
+				staleMessageCopy.Id = requestID
+				writeProxyResponse(w, request, staleMessageCopy, staleBlockedAddress, queryOutcomeStale, queryDetails)
+				return
+			}
+
 			dns.HandleFailed(w, request)
+			dnsProxy.finishQuery(w, request, nil, queryOutcomeError, queryDetails)
 			return
 		}
 
-		dnsProxy.addToPrefetch(cacheKey, question, responseMsg)
-
-		dnsProxy.clampTTLAndCacheResponse(cacheKey, responseMsg)
+		dnsProxy.addToPrefetch(cacheKey, request, upstreamPolicy, responseMsg)
 
 		responseMsg.Id = requestID
-		dnsProxy.writeResponse(w, responseMsg)
+		writeProxyResponse(w, request, responseMsg, blockedAddress, queryOutcomeCacheMiss, queryDetails)
 	}
 }
 
-func (dnsProxy *dnsProxy) createBlockedDomainHandlerFunc() dns.HandlerFunc {
-	return func(w dns.ResponseWriter, r *dns.Msg) {
-		dnsProxy.metrics.incrementBlocked()
+func (dnsProxy *dnsProxy) writeBlockResponse(w dns.ResponseWriter, r *dns.Msg, blockResponder *blockResponder, blockedReason string, queryDetails *queryDetails) {
+	dnsProxy.metrics.incrementBlocked()
 
-		responseMsg := new(dns.Msg)
-		responseMsg.SetRcode(r, dns.RcodeNameError)
-		dnsProxy.writeResponse(w, responseMsg)
+	queryDetails.blockedReason = blockedReason
+
+	responseMsg := blockResponder.createResponse(r)
+	dnsProxy.writeResponse(w, responseMsg)
+	dnsProxy.finishQuery(w, r, responseMsg, queryOutcomeBlocked, queryDetails)
+}
+
+// blockedDomainHandlerFunc answers a query for a blocked domain.
+type blockedDomainHandlerFunc func(w dns.ResponseWriter, r *dns.Msg, blockedReason string)
+
+func (dnsProxy *dnsProxy) createBlockedDomainHandlerFunc(clientGroup *clientGroup, blockResponder *blockResponder) blockedDomainHandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg, blockedReason string) {
+		dnsProxy.writeBlockResponse(w, r, blockResponder, blockedReason, newQueryDetails(clientGroup.name))
 	}
 }
 
-func (dnsProxy *dnsProxy) createForwardDomainHandlerFunc(forwardDomainConfiguration ForwardDomainConfiguration) dns.HandlerFunc {
+func (dnsProxy *dnsProxy) createForwardDomainHandlerFunc(clientGroup *clientGroup, forwardDomainConfiguration ForwardDomainConfiguration) dns.HandlerFunc {
 	forwardNamesToAddresses := make(map[string]net.IP)
 	for _, forwardNameToAddress := range forwardDomainConfiguration.NamesToAddresses {
 		forwardNamesToAddresses[strings.ToLower(forwardNameToAddress.Name)] = net.ParseIP(forwardNameToAddress.IPAddress)
 	}
 
 	return func(w dns.ResponseWriter, r *dns.Msg) {
+		queryDetails := newQueryDetails(clientGroup.name)
+
 		if len(r.Question) == 0 {
 			dns.HandleFailed(w, r)
+			dnsProxy.finishQuery(w, r, nil, queryOutcomeError, queryDetails)
 			return
 		}
 
@@ -261,6 +578,7 @@ func (dnsProxy *dnsProxy) createForwardDomainHandlerFunc(forwardDomainConfigurat
 			responseMsg.SetRcode(r, dns.RcodeNameError)
 			responseMsg.Authoritative = true
 			dnsProxy.writeResponse(w, responseMsg)
+			dnsProxy.finishQuery(w, r, responseMsg, queryOutcomeLocalZone, queryDetails)
 			return
 		}
 
@@ -269,6 +587,7 @@ func (dnsProxy *dnsProxy) createForwardDomainHandlerFunc(forwardDomainConfigurat
 			responseMsg.SetRcode(r, dns.RcodeNameError)
 			responseMsg.Authoritative = true
 			dnsProxy.writeResponse(w, responseMsg)
+			dnsProxy.finishQuery(w, r, responseMsg, queryOutcomeLocalZone, queryDetails)
 			return
 		}
 
@@ -284,18 +603,22 @@ func (dnsProxy *dnsProxy) createForwardDomainHandlerFunc(forwardDomainConfigurat
 			A: address,
 		})
 		dnsProxy.writeResponse(w, responseMsg)
+		dnsProxy.finishQuery(w, r, responseMsg, queryOutcomeLocalZone, queryDetails)
 	}
 }
 
-func (dnsProxy *dnsProxy) createReverseHandlerFunc(reverseDomainConfiguration ReverseDomainConfiguration) dns.HandlerFunc {
+func (dnsProxy *dnsProxy) createReverseHandlerFunc(clientGroup *clientGroup, reverseDomainConfiguration ReverseDomainConfiguration) dns.HandlerFunc {
 	reverseAddressesToNames := make(map[string]string)
 	for _, reverseAddressToName := range reverseDomainConfiguration.AddressesToNames {
 		reverseAddressesToNames[strings.ToLower(reverseAddressToName.ReverseAddress)] = reverseAddressToName.Name
 	}
 
 	return func(w dns.ResponseWriter, r *dns.Msg) {
+		queryDetails := newQueryDetails(clientGroup.name)
+
 		if len(r.Question) == 0 {
 			dns.HandleFailed(w, r)
+			dnsProxy.finishQuery(w, r, nil, queryOutcomeError, queryDetails)
 			return
 		}
 
@@ -305,6 +628,7 @@ func (dnsProxy *dnsProxy) createReverseHandlerFunc(reverseDomainConfiguration Re
 			responseMsg.SetRcode(r, dns.RcodeNameError)
 			responseMsg.Authoritative = true
 			dnsProxy.writeResponse(w, responseMsg)
+			dnsProxy.finishQuery(w, r, responseMsg, queryOutcomeLocalZone, queryDetails)
 			return
 		}
 
@@ -313,6 +637,7 @@ func (dnsProxy *dnsProxy) createReverseHandlerFunc(reverseDomainConfiguration Re
 			responseMsg.SetRcode(r, dns.RcodeNameError)
 			responseMsg.Authoritative = true
 			dnsProxy.writeResponse(w, responseMsg)
+			dnsProxy.finishQuery(w, r, responseMsg, queryOutcomeLocalZone, queryDetails)
 			return
 		}
 
@@ -328,32 +653,249 @@ func (dnsProxy *dnsProxy) createReverseHandlerFunc(reverseDomainConfiguration Re
 			Ptr: name,
 		})
 		dnsProxy.writeResponse(w, responseMsg)
+		dnsProxy.finishQuery(w, r, responseMsg, queryOutcomeLocalZone, queryDetails)
 	}
 
 }
 
-func (dnsProxy *dnsProxy) createServeMux() *dns.ServeMux {
+// clientGroupHandler checks the blocklist of a client group before routing a query with the
+// serve mux.
+type clientGroupHandler struct {
+	clientGroup         *clientGroup
+	metrics             *metrics
+	blocklist           *blocklist
+	scheduledBlocklists scheduledBlocklists
+	blockedHandler      blockedDomainHandlerFunc
+	serveMux            *dns.ServeMux
+}
 
-	dnsServeMux := dns.NewServeMux()
+func (clientGroupHandler *clientGroupHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if (clientGroupHandler.blocklist != nil) && (len(r.Question) > 0) {
+		switch clientGroupHandler.blocklist.check(r.Question[0].Name) {
+		case blocklistBlocked:
+			clientGroupHandler.blockedHandler(w, r, "blockedDomainsFile")
+			return
+
+		case blocklistAllowed:
+			clientGroupHandler.metrics.incrementAllowlistOverrides()
+		}
+	}
+
+	if len(r.Question) > 0 {
+		if scheduledBlocklist := clientGroupHandler.scheduledBlocklists.blockingScheduledBlocklist(r.Question[0].Name, time.Now()); scheduledBlocklist != nil {
+			clientGroupHandler.metrics.incrementBlockedBySchedule()
+			clientGroupHandler.blockedHandler(w, r, "schedule "+scheduledBlocklist.name)
+			return
+		}
+	}
+
+	clientGroupHandler.serveMux.ServeDNS(w, r)
+}
+
+// dnsProxyHandler resolves the client group of a query from the client address, the group with
+// the most specific matching clientCIDR (the first configured on a tie) or the default group, and
+// passes the query to its clientGroupHandler.
+type dnsProxyHandler struct {
+	ipBlocklist               *ipBlocklist
+	clientGroupHandlers       []*clientGroupHandler
+	defaultClientGroupHandler *clientGroupHandler
+}
 
-	dnsServeMux.HandleFunc(".", dnsProxy.createProxyHandlerFunc())
+func (dnsProxyHandler *dnsProxyHandler) clientGroupHandler(w dns.ResponseWriter) *clientGroupHandler {
+	selectedHandler := dnsProxyHandler.defaultClientGroupHandler
 
-	dnsProxyConfiguration := &dnsProxy.configuration.DNSProxyConfiguration
+	if ip := remoteIP(w); ip != nil {
+		selectedPrefixLength := -1
+		for _, clientGroupHandler := range dnsProxyHandler.clientGroupHandlers {
+			if prefixLength := clientGroupHandler.clientGroup.matchPrefixLength(ip); prefixLength > selectedPrefixLength {
+				selectedHandler = clientGroupHandler
+				selectedPrefixLength = prefixLength
+			}
+		}
+	}
+
+	return selectedHandler
+}
+
+func (dnsProxyHandler *dnsProxyHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	dnsProxyHandler.clientGroupHandler(w).ServeDNS(w, r)
+}
+
+// selectBlocklist returns the blocklist with the blocklists selected by a client group, except
+// those named by its schedules, and the allowlist.  Blocklists are shared by client groups with
+// the same selection.
+func selectBlocklist(clientGroup *clientGroup, blocklistNames []string, scheduledBlocklistNames map[string]bool, namedRules map[string]*blocklistRules, allowlistRules *blocklistRules, blocklists map[string]*blocklist) (*blocklist, error) {
+	selectedNames := blocklistNames
+	if len(clientGroup.blocklistNames) > 0 {
+		selectedNames = append([]string(nil), clientGroup.blocklistNames...)
+		sort.Strings(selectedNames)
+	}
+
+	rulesList := make([]*blocklistRules, 0, len(selectedNames)+1)
+	unscheduledNames := make([]string, 0, len(selectedNames))
+	for _, name := range selectedNames {
+		rules, ok := namedRules[name]
+		if !ok {
+			return nil, fmt.Errorf("client group %q unknown blocklist %q", clientGroup.name, name)
+		}
+		if !scheduledBlocklistNames[name] {
+			rulesList = append(rulesList, rules)
+			unscheduledNames = append(unscheduledNames, name)
+		}
+	}
+	selectedNames = unscheduledNames
+
+	if (!clientGroup.blocking) || (len(selectedNames) == 0) {
+		return nil, nil
+	}
+
+	key := strings.Join(selectedNames, ",")
+	if blocklist, ok := blocklists[key]; ok {
+		return blocklist, nil
+	}
+
+	blocklist := newBlocklist(key, append(rulesList, allowlistRules))
+	blocklists[key] = blocklist
+	return blocklist, nil
+}
+
+func (dnsProxy *dnsProxy) createClientGroupHandler(dnsProxyConfiguration *DNSProxyConfiguration, clientGroup *clientGroup, blocklist *blocklist, scheduledBlocklists scheduledBlocklists, blockResponder *blockResponder) *clientGroupHandler {
+	dnsServeMux := dns.NewServeMux()
+
+	dnsServeMux.HandleFunc(".", dnsProxy.createProxyHandlerFunc(clientGroup, blocklist, scheduledBlocklists, blockResponder))
 
 	for _, forwardDomainConfiguration := range dnsProxyConfiguration.ForwardDomainConfigurations {
-		dnsServeMux.HandleFunc(forwardDomainConfiguration.Domain, dnsProxy.createForwardDomainHandlerFunc(forwardDomainConfiguration))
+		dnsServeMux.HandleFunc(forwardDomainConfiguration.Domain, dnsProxy.createForwardDomainHandlerFunc(clientGroup, forwardDomainConfiguration))
 	}
 
 	for _, reverseDomainConfiguration := range dnsProxyConfiguration.ReverseDomainConfigurations {
-		dnsServeMux.HandleFunc(reverseDomainConfiguration.Domain, dnsProxy.createReverseHandlerFunc(reverseDomainConfiguration))
+		dnsServeMux.HandleFunc(reverseDomainConfiguration.Domain, dnsProxy.createReverseHandlerFunc(clientGroup, reverseDomainConfiguration))
 	}
 
-	if len(dnsProxy.configuration.DNSProxyConfiguration.BlockedDomainsFile) > 0 {
-		blockedHandler := dnsProxy.createBlockedDomainHandlerFunc()
-		installHandlersForBlockedDomains(dnsProxy.configuration.DNSProxyConfiguration.BlockedDomainsFile, dnsServeMux, blockedHandler)
+	return &clientGroupHandler{
+		clientGroup:         clientGroup,
+		metrics:             dnsProxy.metrics,
+		blocklist:           blocklist,
+		scheduledBlocklists: scheduledBlocklists,
+		blockedHandler:      dnsProxy.createBlockedDomainHandlerFunc(clientGroup, blockResponder),
+		serveMux:            dnsServeMux,
 	}
+}
+
+func (dnsProxy *dnsProxy) createHandler(dnsProxyConfiguration *DNSProxyConfiguration) (*dnsProxyHandler, error) {
+
+	blockResponder, err := newBlockResponder(&dnsProxyConfiguration.BlockResponseConfiguration)
+	if err != nil {
+		return nil, fmt.Errorf("blockResponseConfiguration error: %w", err)
+	}
+
+	namedRules := make(map[string]*blocklistRules)
+	var blocklistNames []string
 
-	return dnsServeMux
+	if len(dnsProxyConfiguration.BlockedDomainsFile) > 0 {
+		rules, err := loadBlockedDomainsFile(dnsProxyConfiguration.BlockedDomainsFile)
+		if err != nil {
+			return nil, err
+		}
+		namedRules[blockedDomainsFileBlocklistName] = rules
+		blocklistNames = append(blocklistNames, blockedDomainsFileBlocklistName)
+	}
+
+	sourceRules, err := dnsProxy.blocklistSources.rules(dnsProxyConfiguration.BlocklistSourceConfigurations)
+	if err != nil {
+		return nil, err
+	}
+	for i, blocklistSourceConfiguration := range dnsProxyConfiguration.BlocklistSourceConfigurations {
+		name := blocklistSourceConfiguration.name()
+		if _, ok := namedRules[name]; ok {
+			return nil, fmt.Errorf("duplicate blocklist name %q", name)
+		}
+		namedRules[name] = sourceRules[i]
+		blocklistNames = append(blocklistNames, name)
+	}
+	sort.Strings(blocklistNames)
+
+	allowlistRules, err := loadAllowlist(&dnsProxyConfiguration.AllowlistConfiguration)
+	if err != nil {
+		return nil, err
+	}
+
+	ipBlocklist, err := newIPBlocklist(&dnsProxyConfiguration.IPBlocklistConfiguration)
+	if err != nil {
+		return nil, err
+	}
+
+	clientGroups := []*clientGroup{newDefaultClientGroup()}
+	clientGroupNames := map[string]bool{defaultClientGroupName: true}
+	for i := range dnsProxyConfiguration.ClientGroupConfigurations {
+		clientGroup, err := newClientGroup(&dnsProxyConfiguration.ClientGroupConfigurations[i])
+		if err != nil {
+			return nil, err
+		}
+		if clientGroupNames[clientGroup.name] {
+			return nil, fmt.Errorf("duplicate client group name %q", clientGroup.name)
+		}
+		clientGroupNames[clientGroup.name] = true
+
+		if upstream := clientGroup.upstreamPolicy.upstream; (len(upstream) > 0) && (dnsProxy.dohClient.dohUpstreamSelector.upstreamNamed(upstream) == nil) {
+			return nil, fmt.Errorf("client group %q unknown upstream %q", clientGroup.name, upstream)
+		}
+
+		clientGroups = append(clientGroups, clientGroup)
+	}
+
+	var allScheduledBlocklists scheduledBlocklists
+	scheduleNames := make(map[string]bool)
+	for i := range dnsProxyConfiguration.ScheduleConfigurations {
+		scheduledBlocklist, err := newScheduledBlocklist(&dnsProxyConfiguration.ScheduleConfigurations[i], namedRules, allowlistRules)
+		if err != nil {
+			return nil, err
+		}
+		if scheduleNames[scheduledBlocklist.name] {
+			return nil, fmt.Errorf("duplicate schedule name %q", scheduledBlocklist.name)
+		}
+		scheduleNames[scheduledBlocklist.name] = true
+
+		for clientGroupName := range scheduledBlocklist.clientGroupNames {
+			if !clientGroupNames[clientGroupName] {
+				return nil, fmt.Errorf("schedule %q unknown client group %q", scheduledBlocklist.name, clientGroupName)
+			}
+		}
+
+		allScheduledBlocklists = append(allScheduledBlocklists, scheduledBlocklist)
+	}
+
+	handler := &dnsProxyHandler{
+		ipBlocklist: ipBlocklist,
+	}
+
+	blocklists := make(map[string]*blocklist)
+	for _, clientGroup := range clientGroups {
+		var scheduledBlocklists scheduledBlocklists
+		scheduledBlocklistNames := make(map[string]bool)
+		for _, scheduledBlocklist := range allScheduledBlocklists {
+			if scheduledBlocklist.appliesTo(clientGroup) {
+				scheduledBlocklists = append(scheduledBlocklists, scheduledBlocklist)
+				for _, name := range scheduledBlocklist.blocklistNames {
+					scheduledBlocklistNames[name] = true
+				}
+			}
+		}
+
+		blocklist, err := selectBlocklist(clientGroup, blocklistNames, scheduledBlocklistNames, namedRules, allowlistRules, blocklists)
+		if err != nil {
+			return nil, err
+		}
+
+		clientGroupHandler := dnsProxy.createClientGroupHandler(dnsProxyConfiguration, clientGroup, blocklist, scheduledBlocklists, blockResponder)
+		if clientGroup.name == defaultClientGroupName {
+			handler.defaultClientGroupHandler = clientGroupHandler
+		} else {
+			handler.clientGroupHandlers = append(handler.clientGroupHandlers, clientGroupHandler)
+		}
+	}
+
+	return handler, nil
 }
 
 func (dnsProxy *dnsProxy) Start() {
@@ -361,13 +903,209 @@ func (dnsProxy *dnsProxy) Start() {
 
 	dnsProxy.metrics.start()
 
-	dnsProxy.dnsServer.start(dnsProxy.createServeMux())
+	dnsProxy.cacheSnapshot.load()
+
+	dnsProxy.dohClient.start()
+
+	dnsProxy.queryLog.start()
+
+	dnsProxy.dnstap.start()
+
+	handler, err := dnsProxy.createHandler(dnsProxy.dnsProxyConfiguration())
+	if err != nil {
+		log.Fatalf("createHandler error: %v", err)
+	}
+
+	dnsProxy.ipBlocklistValue.Store(handler.ipBlocklist)
+
+	if listenersStarted := dnsProxy.dnsServer.start(handler); listenersStarted == 0 {
+		log.Fatalf("no dns listeners started")
+	}
 
 	dnsProxy.cache.start()
 
 	dnsProxy.prefetch.start(dnsProxy)
 
-	startPprof(&dnsProxy.configuration.PprofConfiguration)
+	dnsProxy.blocklistSources.start(dnsProxy)
+
+	dnsProxy.cacheSnapshot.start()
+
+	dnsProxy.pprofServer = startPprof(&dnsProxy.configuration.PprofConfiguration)
+
+	logSDNotify("READY=1")
+
+	dnsProxy.systemdWatchdog.start(dnsProxy.healthCheck)
 
 	log.Printf("end dnsProxy.Start")
 }
+
+// healthCheck fails if no listener is still serving.
+func (dnsProxy *dnsProxy) healthCheck() error {
+	if dnsProxy.dnsServer.runningListenerCount() == 0 {
+		return errors.New("no dns listeners running")
+	}
+
+	return nil
+}
+
+func (dnsProxy *dnsProxy) Stop(ctx context.Context) error {
+	log.Printf("begin dnsProxy.Stop")
+
+	logSDNotify("STOPPING=1")
+
+	var errs []error
+
+	if err := dnsProxy.systemdWatchdog.stop(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("systemdWatchdog.stop error: %w", err))
+	}
+
+	if err := dnsProxy.dnsServer.stop(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("dnsServer.stop error: %w", err))
+	}
+
+	if dnsProxy.pprofServer != nil {
+		if err := dnsProxy.pprofServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("pprofServer.Shutdown error: %w", err))
+		}
+	}
+
+	if err := dnsProxy.blocklistSources.stop(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("blocklistSources.stop error: %w", err))
+	}
+
+	if err := dnsProxy.prefetch.stop(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("prefetch.stop error: %w", err))
+	}
+
+	if err := dnsProxy.dohClient.stop(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("dohClient.stop error: %w", err))
+	}
+
+	if err := dnsProxy.cache.stop(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("cache.stop error: %w", err))
+	}
+
+	if err := dnsProxy.cacheSnapshot.stop(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("cacheSnapshot.stop error: %w", err))
+	}
+
+	if err := dnsProxy.queryLog.stop(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("queryLog.stop error: %w", err))
+	}
+
+	if err := dnsProxy.dnstap.stop(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("dnstap.stop error: %w", err))
+	}
+
+	if err := dnsProxy.metrics.stop(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("metrics.stop error: %w", err))
+	}
+
+	log.Printf("end dnsProxy.Stop errors = %v", len(errs))
+
+	if len(errs) > 0 {
+		return stopErrors(errs)
+	}
+	return nil
+}
+
+// stopErrors is the errors of every component that failed to stop.
+type stopErrors []error
+
+func (stopErrors stopErrors) Error() string {
+	messages := make([]string, 0, len(stopErrors))
+	for _, err := range stopErrors {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Reload replaces the DNS proxy configuration and rebuilds the handler and blocklist.  The cache
+// and prefetch state are kept unless the ipBlocklist changed.  Other configuration changes need a
+// restart.
+func (dnsProxy *dnsProxy) Reload(configuration *Configuration) error {
+	dnsProxy.reloadMutex.Lock()
+	defer dnsProxy.reloadMutex.Unlock()
+
+	log.Printf("begin dnsProxy.Reload")
+
+	newDNSProxyConfiguration := configuration.DNSProxyConfiguration
+
+	handler, err := dnsProxy.createHandler(&newDNSProxyConfiguration)
+	if err != nil {
+		return fmt.Errorf("createHandler error: %w", err)
+	}
+
+	for _, section := range restartRequiredSections(dnsProxy.configuration, configuration) {
+		log.Printf("dnsProxy.Reload %v changes require a restart, ignoring", section)
+	}
+
+	dnsProxy.dnsProxyConfigurationValue.Store(&newDNSProxyConfiguration)
+	dnsProxy.setHandler(handler)
+
+	log.Printf("end dnsProxy.Reload")
+
+	return nil
+}
+
+// restartRequiredSections returns the names of the configuration sections other than
+// dnsProxyConfiguration that differ between current and requested.
+func restartRequiredSections(current, requested *Configuration) []string {
+	notReloaded := []struct {
+		name               string
+		current, requested interface{}
+	}{
+		{"metricsConfiguration", current.MetricsConfiguration, requested.MetricsConfiguration},
+		{"dnsServerConfiguration", current.DNSServerConfiguration, requested.DNSServerConfiguration},
+		{"dohClientConfiguration", current.DOHClientConfiguration, requested.DOHClientConfiguration},
+		{"cacheConfiguration", current.CacheConfiguration, requested.CacheConfiguration},
+		{"cacheSnapshotConfiguration", current.CacheSnapshotConfiguration, requested.CacheSnapshotConfiguration},
+		{"prefetchConfiguration", current.PrefetchConfiguration, requested.PrefetchConfiguration},
+		{"pprofConfiguration", current.PprofConfiguration, requested.PprofConfiguration},
+		{"queryLogConfiguration", current.QueryLogConfiguration, requested.QueryLogConfiguration},
+		{"dnstapConfiguration", current.DNSTapConfiguration, requested.DNSTapConfiguration},
+	}
+
+	var sections []string
+	for _, section := range notReloaded {
+		if !reflect.DeepEqual(section.current, section.requested) {
+			sections = append(sections, section.name)
+		}
+	}
+	return sections
+}
+
+// setHandler replaces the handler.  Cached responses had the previous ipBlocklist applied, so
+// the cache is purged if the ipBlocklist changed.
+func (dnsProxy *dnsProxy) setHandler(handler *dnsProxyHandler) {
+	ipBlocklistChanged := !reflect.DeepEqual(dnsProxy.ipBlocklist(), handler.ipBlocklist)
+
+	dnsProxy.ipBlocklistValue.Store(handler.ipBlocklist)
+	dnsProxy.dnsServer.setHandler(handler)
+
+	if ipBlocklistChanged {
+		log.Printf("ipBlocklist changed, purged %v cache entries", dnsProxy.cache.purge())
+	}
+}
+
+func (dnsProxy *dnsProxy) blocklistSourceConfigurations() []BlocklistSourceConfiguration {
+	return dnsProxy.dnsProxyConfiguration().BlocklistSourceConfigurations
+}
+
+// blocklistSourcesUpdated rebuilds the handler with the new blocklist source copies.
+func (dnsProxy *dnsProxy) blocklistSourcesUpdated() {
+	dnsProxy.reloadMutex.Lock()
+	defer dnsProxy.reloadMutex.Unlock()
+
+	log.Printf("begin dnsProxy.blocklistSourcesUpdated")
+
+	handler, err := dnsProxy.createHandler(dnsProxy.dnsProxyConfiguration())
+	if err != nil {
+		log.Printf("createHandler error, keeping previous blocklist: %v", err)
+		return
+	}
+
+	dnsProxy.setHandler(handler)
+
+	log.Printf("end dnsProxy.blocklistSourcesUpdated")
+}
@@ -0,0 +1,599 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestTTLDNSProxy returns a dnsProxy with only the TTL clamp configuration.
+func newTestTTLDNSProxy(cacheConfiguration CacheConfiguration, dnsProxyConfiguration DNSProxyConfiguration) *dnsProxy {
+	dnsProxy := &dnsProxy{
+		configuration: &Configuration{
+			CacheConfiguration: cacheConfiguration,
+		},
+	}
+	dnsProxy.dnsProxyConfigurationValue.Store(&dnsProxyConfiguration)
+	return dnsProxy
+}
+
+func newTestSOA(ttl, minttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "ns.example.com.",
+		Mbox:    "hostmaster.example.com.",
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  minttl,
+	}
+}
+
+func TestIsNegativeResponse(t *testing.T) {
+	answer := &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   []byte{192, 0, 2, 1},
+	}
+
+	tests := []struct {
+		name   string
+		rcode  int
+		answer []dns.RR
+		want   bool
+	}{
+		{name: "NXDOMAIN", rcode: dns.RcodeNameError, want: true},
+		{name: "NODATA", rcode: dns.RcodeSuccess, want: true},
+		{name: "answer", rcode: dns.RcodeSuccess, answer: []dns.RR{answer}, want: false},
+		{name: "SERVFAIL", rcode: dns.RcodeServerFailure, want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := new(dns.Msg)
+			m.Rcode = test.rcode
+			m.Answer = test.answer
+			if got := isNegativeResponse(m); got != test.want {
+				t.Errorf("isNegativeResponse = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestClampAndGetNegativeTTLSeconds(t *testing.T) {
+	tests := []struct {
+		name             string
+		soa              *dns.SOA
+		negativeClampMin uint32
+		negativeClampMax uint32
+		clampMin         uint32
+		clampMax         uint32
+		want             uint32
+	}{
+		{name: "SOA MINIMUM below SOA TTL", soa: newTestSOA(3600, 300), negativeClampMin: 10, negativeClampMax: 900, want: 300},
+		{name: "SOA TTL below SOA MINIMUM", soa: newTestSOA(120, 3600), negativeClampMin: 10, negativeClampMax: 900, want: 120},
+		{name: "negative min clamp", soa: newTestSOA(3600, 5), negativeClampMin: 60, negativeClampMax: 900, want: 60},
+		{name: "negative max clamp", soa: newTestSOA(3600, 1800), negativeClampMin: 60, negativeClampMax: 900, want: 900},
+		{name: "no SOA gets negative min clamp", soa: nil, negativeClampMin: 60, negativeClampMax: 900, clampMin: 10, clampMax: 30, want: 60},
+		{name: "no SOA without negative clamps gets min clamp", soa: nil, clampMin: 10, clampMax: 30, want: 10},
+		{name: "only negative min set", soa: newTestSOA(3600, 5), negativeClampMin: 60, clampMin: 10, clampMax: 300, want: 60},
+		{name: "only negative min set uses max clamp", soa: newTestSOA(3600, 1800), negativeClampMin: 60, clampMin: 10, clampMax: 300, want: 300},
+		{name: "only negative max set", soa: newTestSOA(3600, 5), negativeClampMax: 900, clampMin: 10, clampMax: 30, want: 10},
+		{name: "only negative max set uses min clamp", soa: newTestSOA(3600, 600), negativeClampMax: 900, clampMin: 10, clampMax: 30, want: 600},
+		{name: "no negative clamps", soa: newTestSOA(3600, 600), clampMin: 10, clampMax: 30, want: 30},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dnsProxy := newTestTTLDNSProxy(
+				CacheConfiguration{
+					NegativeClampMinTTLSeconds: test.negativeClampMin,
+					NegativeClampMaxTTLSeconds: test.negativeClampMax,
+				},
+				DNSProxyConfiguration{
+					ClampMinTTLSeconds: test.clampMin,
+					ClampMaxTTLSeconds: test.clampMax,
+				})
+
+			m := new(dns.Msg)
+			m.SetQuestion("missing.example.com.", dns.TypeA)
+			m.Rcode = dns.RcodeNameError
+			if test.soa != nil {
+				m.Ns = append(m.Ns, test.soa)
+			}
+
+			if got := dnsProxy.clampAndGetNegativeTTLSeconds(m); got != test.want {
+				t.Errorf("clampAndGetNegativeTTLSeconds = %v, want %v", got, test.want)
+			}
+			for _, rr := range m.Ns {
+				if rr.Header().Ttl != test.want {
+					t.Errorf("authority TTL = %v, want %v", rr.Header().Ttl, test.want)
+				}
+			}
+		})
+	}
+}
+
+// newTestConfiguration returns a configuration with a udp listener on a free port and
+// upstreamURL as its only upstream.
+func newTestConfiguration(upstreamURL string) *Configuration {
+	return &Configuration{
+		MetricsConfiguration: MetricsConfiguration{
+			TimerIntervalSeconds: 60,
+		},
+		DNSServerConfiguration: DNSServerConfiguration{
+			Listeners: []DNSListenerConfiguration{
+				{
+					ListenAddress: HostAndPort{Host: "127.0.0.1", Port: "0"},
+					Protocols:     []string{dnsListenerProtocolUDP},
+				},
+			},
+		},
+		DOHClientConfiguration: DOHClientConfiguration{
+			Upstreams:                           []DOHUpstreamConfiguration{{Name: "test", URL: upstreamURL}},
+			WireFormat:                          true,
+			MaxConcurrentRequests:               10,
+			SemaphoreAcquireTimeoutMilliseconds: 1000,
+			RequestTimeoutMilliseconds:          5000,
+		},
+		CacheConfiguration: CacheConfiguration{
+			MaxSize:              100,
+			MaxPurgesPerTimerPop: 100,
+			TimerIntervalSeconds: 60,
+		},
+		CacheSnapshotConfiguration: CacheSnapshotConfiguration{
+			TimerIntervalSeconds: 60,
+		},
+		PrefetchConfiguration: PrefetchConfiguration{
+			MaxCacheSize:            100,
+			NumWorkers:              1,
+			SleepIntervalSeconds:    60,
+			MaxCacheEntryAgeSeconds: 60,
+		},
+	}
+}
+
+// startTestDNSProxy starts a dnsProxy and returns it with the udp listener address.
+func startTestDNSProxy(t *testing.T, configuration *Configuration) (*dnsProxy, string) {
+	proxy, err := NewDNSProxy(configuration)
+	if err != nil {
+		t.Fatalf("NewDNSProxy error: %v", err)
+	}
+	dnsProxy := proxy.(*dnsProxy)
+	dnsProxy.Start()
+
+	return dnsProxy, dnsProxy.dnsServer.servers[0].PacketConn.LocalAddr().String()
+}
+
+func TestDNSProxyStop(t *testing.T) {
+	upstreamRequestReceived := make(chan struct{}, 1)
+	releaseUpstream := make(chan struct{})
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := readTestDOHRequest(t, r)
+		if request == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		upstreamRequestReceived <- struct{}{}
+		<-releaseUpstream
+
+		response := new(dns.Msg)
+		response.SetReply(request)
+		body, _ := response.Pack()
+		w.Header().Set("Content-Type", dohWireMIMEType)
+		w.Write(body)
+	}))
+	defer httpServer.Close()
+
+	t.Run("drains in-flight queries", func(t *testing.T) {
+		dnsProxy, address := startTestDNSProxy(t, newTestConfiguration(httpServer.URL+"/dns-query"))
+
+		queryError := make(chan error, 1)
+		go func() {
+			request := new(dns.Msg)
+			request.SetQuestion("drain.example.com.", dns.TypeA)
+			client := &dns.Client{Timeout: 5 * time.Second}
+			_, _, err := client.Exchange(request, address)
+			queryError <- err
+		}()
+		<-upstreamRequestReceived
+
+		time.AfterFunc(100*time.Millisecond, func() { releaseUpstream <- struct{}{} })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := dnsProxy.Stop(ctx); err != nil {
+			t.Errorf("Stop error: %v", err)
+		}
+		if err := <-queryError; err != nil {
+			t.Errorf("in-flight query error: %v", err)
+		}
+	})
+
+	t.Run("returns at the deadline", func(t *testing.T) {
+		dnsProxy, address := startTestDNSProxy(t, newTestConfiguration(httpServer.URL+"/dns-query"))
+		defer func() { releaseUpstream <- struct{}{} }()
+
+		go func() {
+			request := new(dns.Msg)
+			request.SetQuestion("stuck.example.com.", dns.TypeA)
+			client := &dns.Client{Timeout: 5 * time.Second}
+			client.Exchange(request, address)
+		}()
+		<-upstreamRequestReceived
+
+		start := time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		err := dnsProxy.Stop(ctx)
+
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Stop returned after %v, want about 200ms", elapsed)
+		}
+		stopErrors, ok := err.(stopErrors)
+		if !ok || (len(stopErrors) == 0) {
+			t.Fatalf("Stop error = %v, want stopErrors", err)
+		}
+		for _, err := range stopErrors {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Stop error %v, want context.DeadlineExceeded", err)
+			}
+		}
+	})
+}
+
+func TestRestartRequiredSections(t *testing.T) {
+	const configurationJSON = `{
+		"dnsServerConfiguration": {"listenAddress": {"host": "127.0.0.1", "port": "10053"}},
+		"dohClientConfiguration": {"url": "https://dns.example/dns-query", "wireFormat": true},
+		"dnsProxyConfiguration": {"clampMinTTLSeconds": 10, "blocklistSourceConfigurations": [{"file": "blocklist.txt"}]},
+		"cacheConfiguration": {"maxSize": 100}
+	}`
+
+	readTestConfiguration := func(t *testing.T) *Configuration {
+		file := filepath.Join(t.TempDir(), "config.json")
+		if err := ioutil.WriteFile(file, []byte(configurationJSON), 0644); err != nil {
+			t.Fatalf("ioutil.WriteFile error: %v", err)
+		}
+		configuration, err := ReadConfiguration(file)
+		if err != nil {
+			t.Fatalf("ReadConfiguration error: %v", err)
+		}
+		return configuration
+	}
+
+	tests := []struct {
+		name   string
+		change func(configuration *Configuration)
+		want   []string
+	}{
+		{
+			name:   "unchanged",
+			change: func(configuration *Configuration) {},
+		},
+		{
+			name: "dnsProxyConfiguration is reloaded",
+			change: func(configuration *Configuration) {
+				configuration.DNSProxyConfiguration.ClampMinTTLSeconds = 20
+				configuration.DNSProxyConfiguration.BlockedDomainsFile = "blocked.txt"
+			},
+		},
+		{
+			name: "cacheConfiguration",
+			change: func(configuration *Configuration) {
+				configuration.CacheConfiguration.MaxSize = 200
+			},
+			want: []string{"cacheConfiguration"},
+		},
+		{
+			name: "listener protocols",
+			change: func(configuration *Configuration) {
+				configuration.DNSServerConfiguration.Listeners[0].Protocols = []string{dnsListenerProtocolUDP}
+			},
+			want: []string{"dnsServerConfiguration"},
+		},
+		{
+			name: "upstream and dnstap",
+			change: func(configuration *Configuration) {
+				configuration.DOHClientConfiguration.Upstreams[0].Name = "other"
+				configuration.DNSTapConfiguration.File = "dnstap.fstrm"
+			},
+			want: []string{"dohClientConfiguration", "dnstapConfiguration"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			current := readTestConfiguration(t)
+			requested := readTestConfiguration(t)
+			test.change(requested)
+
+			if got := restartRequiredSections(current, requested); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("restartRequiredSections = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDNSProxyReload(t *testing.T) {
+	dnsProxy, _ := startTestDNSProxy(t, newTestConfiguration("https://dns.example/dns-query"))
+	defer dnsProxy.Stop(context.Background())
+
+	requested := *dnsProxy.configuration
+	requested.CacheConfiguration.MaxSize = 200
+	requested.DNSProxyConfiguration.ClampMinTTLSeconds = 30
+
+	if err := dnsProxy.Reload(&requested); err != nil {
+		t.Fatalf("Reload error: %v", err)
+	}
+
+	if clampMin := dnsProxy.dnsProxyConfiguration().ClampMinTTLSeconds; clampMin != 30 {
+		t.Errorf("ClampMinTTLSeconds after Reload = %v, want 30", clampMin)
+	}
+	if maxSize := dnsProxy.configuration.CacheConfiguration.MaxSize; maxSize != 100 {
+		t.Errorf("cache MaxSize after Reload = %v, want 100", maxSize)
+	}
+
+	requested.DNSProxyConfiguration.BlockedDomainsFile = filepath.Join(t.TempDir(), "missing.txt")
+	if err := dnsProxy.Reload(&requested); err == nil {
+		t.Errorf("Reload with missing blockedDomainsFile error = nil, want error")
+	}
+	if clampMin := dnsProxy.dnsProxyConfiguration().ClampMinTTLSeconds; clampMin != 30 {
+		t.Errorf("ClampMinTTLSeconds after failed Reload = %v, want 30", clampMin)
+	}
+}
+
+// newTestUpstream returns a DoH server answering each question name with its records in
+// answers, or NXDOMAIN.
+func newTestUpstream(t *testing.T, answers map[string][]dns.RR) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := readTestDOHRequest(t, r)
+		if request == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		response := new(dns.Msg)
+		if answer, ok := answers[request.Question[0].Name]; ok {
+			response.SetReply(request)
+			response.Answer = answer
+		} else {
+			response.SetRcode(request, dns.RcodeNameError)
+		}
+		body, _ := response.Pack()
+		w.Header().Set("Content-Type", dohWireMIMEType)
+		w.Write(body)
+	}))
+}
+
+func mustNewRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("dns.NewRR(%q) error: %v", s, err)
+	}
+	return rr
+}
+
+func TestCNAMEBlocking(t *testing.T) {
+	answers := map[string][]dns.RR{
+		"direct.example.com.": {
+			mustNewRR(t, "direct.example.com. 60 IN CNAME tracker.blocked.net."),
+			mustNewRR(t, "tracker.blocked.net. 60 IN A 192.0.2.1"),
+		},
+		"chain.example.com.": {
+			mustNewRR(t, "chain.example.com. 60 IN CNAME a.example.org."),
+			mustNewRR(t, "a.example.org. 60 IN CNAME b.tracker.blocked.net."),
+			mustNewRR(t, "b.tracker.blocked.net. 60 IN A 192.0.2.2"),
+		},
+		"allowed-target.example.com.": {
+			mustNewRR(t, "allowed-target.example.com. 60 IN CNAME img.cdn.blocked.net."),
+			mustNewRR(t, "img.cdn.blocked.net. 60 IN A 192.0.2.3"),
+		},
+		"allowed.example.com.": {
+			mustNewRR(t, "allowed.example.com. 60 IN CNAME tracker.blocked.net."),
+			mustNewRR(t, "tracker.blocked.net. 60 IN A 192.0.2.1"),
+		},
+		"clean.example.com.": {
+			mustNewRR(t, "clean.example.com. 60 IN CNAME c.example.org."),
+			mustNewRR(t, "c.example.org. 60 IN A 192.0.2.4"),
+		},
+	}
+	httpServer := newTestUpstream(t, answers)
+	defer httpServer.Close()
+
+	blockedDomainsFile := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := ioutil.WriteFile(blockedDomainsFile, []byte("blocked.net\n"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile error: %v", err)
+	}
+
+	configuration := newTestConfiguration(httpServer.URL + "/dns-query")
+	configuration.DNSProxyConfiguration.BlockedDomainsFile = blockedDomainsFile
+	configuration.DNSProxyConfiguration.AllowlistConfiguration.Domains = []string{"*.cdn.blocked.net", "allowed.example.com"}
+	dnsProxy, address := startTestDNSProxy(t, configuration)
+	defer dnsProxy.Stop(context.Background())
+
+	tests := []struct {
+		name        string
+		wantBlocked bool
+	}{
+		{name: "direct.example.com.", wantBlocked: true},
+		{name: "chain.example.com.", wantBlocked: true},
+		{name: "allowed-target.example.com.", wantBlocked: false},
+		{name: "allowed.example.com.", wantBlocked: false},
+		{name: "clean.example.com.", wantBlocked: false},
+	}
+
+	client := &dns.Client{Timeout: 5 * time.Second}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := new(dns.Msg)
+			request.SetQuestion(test.name, dns.TypeA)
+			response, _, err := client.Exchange(request, address)
+			if err != nil {
+				t.Fatalf("Exchange error: %v", err)
+			}
+
+			if test.wantBlocked {
+				if (response.Rcode != dns.RcodeNameError) || (len(response.Answer) != 0) {
+					t.Errorf("response = %v, want blocked NXDOMAIN", response)
+				}
+			} else if (response.Rcode != dns.RcodeSuccess) || (len(response.Answer) != len(answers[test.name])) {
+				t.Errorf("response = %v, want upstream answer", response)
+			}
+		})
+	}
+
+	if got := dnsProxy.metrics.blockedByCNAME(); got != 2 {
+		t.Errorf("blockedByCNAME = %v, want 2", got)
+	}
+}
+
+func TestIPBlocklistModesAndReload(t *testing.T) {
+	httpServer := newTestUpstream(t, map[string][]dns.RR{
+		"www.example.com.": {
+			mustNewRR(t, "www.example.com. 60 IN A 192.0.2.1"),
+			mustNewRR(t, "www.example.com. 60 IN A 198.51.100.7"),
+		},
+	})
+	defer httpServer.Close()
+
+	configuration := newTestConfiguration(httpServer.URL + "/dns-query")
+	configuration.DNSProxyConfiguration.IPBlocklistConfiguration = IPBlocklistConfiguration{
+		Mode:      ipBlocklistModeStrip,
+		Addresses: []string{"198.51.100.0/24"},
+	}
+	configuration.DNSProxyConfiguration.ClampMinTTLSeconds = 10
+	configuration.DNSProxyConfiguration.ClampMaxTTLSeconds = 300
+	dnsProxy, address := startTestDNSProxy(t, configuration)
+	defer dnsProxy.Stop(context.Background())
+
+	client := &dns.Client{Timeout: 5 * time.Second}
+	query := func(t *testing.T) *dns.Msg {
+		request := new(dns.Msg)
+		request.SetQuestion("www.example.com.", dns.TypeA)
+		response, _, err := client.Exchange(request, address)
+		if err != nil {
+			t.Fatalf("Exchange error: %v", err)
+		}
+		return response
+	}
+
+	reload := func(t *testing.T, ipBlocklistConfiguration IPBlocklistConfiguration) {
+		requested := *dnsProxy.configuration
+		requested.DNSProxyConfiguration.IPBlocklistConfiguration = ipBlocklistConfiguration
+		if err := dnsProxy.Reload(&requested); err != nil {
+			t.Fatalf("Reload error: %v", err)
+		}
+	}
+
+	// each step queries twice, a changed ipBlocklist purges the cache so the first query misses
+	steps := []struct {
+		name          string
+		reload        *IPBlocklistConfiguration
+		wantRcode     int
+		wantAnswer    int
+		wantCacheHits uint64
+	}{
+		{name: "strip", wantRcode: dns.RcodeSuccess, wantAnswer: 1, wantCacheHits: 1},
+		{name: "unchanged reload keeps the cache", reload: &IPBlocklistConfiguration{Mode: ipBlocklistModeStrip, Addresses: []string{"198.51.100.0/24"}}, wantRcode: dns.RcodeSuccess, wantAnswer: 1, wantCacheHits: 2},
+		{name: "block", reload: &IPBlocklistConfiguration{Mode: ipBlocklistModeBlock, Addresses: []string{"198.51.100.0/24"}}, wantRcode: dns.RcodeNameError, wantAnswer: 0, wantCacheHits: 1},
+		{name: "removed", reload: &IPBlocklistConfiguration{}, wantRcode: dns.RcodeSuccess, wantAnswer: 2, wantCacheHits: 1},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			cacheHits := dnsProxy.metrics.cacheHits()
+			if step.reload != nil {
+				reload(t, *step.reload)
+			}
+
+			for i := 0; i < 2; i++ {
+				response := query(t)
+				if (response.Rcode != step.wantRcode) || (len(response.Answer) != step.wantAnswer) {
+					t.Errorf("query %v response = %v, want rcode %v with %v answers", i, response, dns.RcodeToString[step.wantRcode], step.wantAnswer)
+				}
+			}
+
+			if got := dnsProxy.metrics.cacheHits() - cacheHits; got != step.wantCacheHits {
+				t.Errorf("cacheHits = %v, want %v", got, step.wantCacheHits)
+			}
+		})
+	}
+}
+
+func TestSelectBlocklist(t *testing.T) {
+	namedRules := map[string]*blocklistRules{
+		"ads":    {blockedDomains: []string{"ads.example."}},
+		"social": {blockedDomains: []string{"social.example."}},
+	}
+	blocklistNames := []string{"ads", "social"}
+	allowlistRules := &blocklistRules{exactAllowedDomains: []string{"ok.ads.example."}}
+
+	tests := []struct {
+		name                    string
+		configuration           *ClientGroupConfiguration
+		scheduledBlocklistNames map[string]bool
+		wantNil                 bool
+		wantBlocked             []string
+		wantNotBlocked          []string
+		wantErr                 bool
+	}{
+		{name: "default group", wantBlocked: []string{"x.ads.example.", "x.social.example."}, wantNotBlocked: []string{"ok.ads.example."}},
+		{name: "scheduled blocklist removed", scheduledBlocklistNames: map[string]bool{"social": true}, wantBlocked: []string{"x.ads.example."}, wantNotBlocked: []string{"x.social.example."}},
+		{name: "all blocklists scheduled", scheduledBlocklistNames: map[string]bool{"ads": true, "social": true}, wantNil: true},
+		{name: "group blocklists", configuration: &ClientGroupConfiguration{Name: "work", Blocklists: []string{"ads"}}, wantBlocked: []string{"x.ads.example."}, wantNotBlocked: []string{"x.social.example."}},
+		{name: "group blocklist scheduled", configuration: &ClientGroupConfiguration{Name: "kids", Blocklists: []string{"social"}}, scheduledBlocklistNames: map[string]bool{"social": true}, wantNil: true},
+		{name: "blocking disabled", configuration: &ClientGroupConfiguration{Name: "admin", DisableBlocking: true}, wantNil: true},
+		{name: "unknown blocklist", configuration: &ClientGroupConfiguration{Name: "kids", Blocklists: []string{"games"}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientGroup := newDefaultClientGroup()
+			if test.configuration != nil {
+				var err error
+				if clientGroup, err = newClientGroup(test.configuration); err != nil {
+					t.Fatalf("newClientGroup error: %v", err)
+				}
+			}
+
+			blocklist, err := selectBlocklist(clientGroup, blocklistNames, test.scheduledBlocklistNames, namedRules, allowlistRules, make(map[string]*blocklist))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("selectBlocklist error = %v, wantErr %v", err, test.wantErr)
+			}
+			if (blocklist == nil) != (test.wantNil || test.wantErr) {
+				t.Fatalf("selectBlocklist = %v, want nil %v", blocklist, test.wantNil)
+			}
+
+			for _, domainName := range test.wantBlocked {
+				if blocklist.check(domainName) != blocklistBlocked {
+					t.Errorf("%q not blocked", domainName)
+				}
+			}
+			for _, domainName := range test.wantNotBlocked {
+				if blocklist.check(domainName) == blocklistBlocked {
+					t.Errorf("%q blocked", domainName)
+				}
+			}
+		})
+	}
+
+	// groups with the same selection share a blocklist
+	blocklists := make(map[string]*blocklist)
+	first, _ := selectBlocklist(newDefaultClientGroup(), blocklistNames, nil, namedRules, allowlistRules, blocklists)
+	lan, _ := newClientGroup(&ClientGroupConfiguration{Name: "lan", Blocklists: []string{"social", "ads"}})
+	second, _ := selectBlocklist(lan, blocklistNames, nil, namedRules, allowlistRules, blocklists)
+	if (first == nil) || (first != second) {
+		t.Errorf("blocklists for the same selection are not shared")
+	}
+}
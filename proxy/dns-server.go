@@ -1,40 +1,343 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	"log"
+	"net"
+	"sync"
+	"sync/atomic"
 
 	"github.com/miekg/dns"
 )
 
+const (
+	dnsListenerProtocolUDP   = "udp"
+	dnsListenerProtocolTCP   = "tcp"
+	dnsListenerProtocolTLS   = "tls"
+	dnsListenerProtocolHTTPS = "https"
+)
+
+// isDNSOverTLS returns true for queries received on a tls listener.
+func isDNSOverTLS(w dns.ResponseWriter) bool {
+	connectionStater, ok := w.(dns.ConnectionStater)
+	return ok && (connectionStater.ConnectionState() != nil)
+}
+
 type dnsServer struct {
-	configuration *DNSServerConfiguration
+	configuration       *DNSServerConfiguration
+	certificateReloader *tlsCertificateReloader
+	dohServer           *dohServer
+	systemdSockets      []systemdSocket
+	handlerValue        atomic.Value
+	serversMutex        sync.Mutex
+	servers             []*dns.Server
+	runningListeners    int32
+}
+
+// validateListeners returns an error for an unknown protocol, or a listen address with a
+// protocol more than once or more than one of tcp, tls, and https.
+func validateListeners(listeners []DNSListenerConfiguration) (usesTLS, usesHTTPS bool, err error) {
+	addressProtocols := make(map[string]map[string]bool)
+	addressStreamProtocols := make(map[string]int)
+
+	for _, listener := range listeners {
+		listenAddressAndPort := listener.ListenAddress.joinHostPort()
+		if addressProtocols[listenAddressAndPort] == nil {
+			addressProtocols[listenAddressAndPort] = make(map[string]bool)
+		}
+
+		for _, protocol := range listener.Protocols {
+			switch protocol {
+			case dnsListenerProtocolUDP:
+			case dnsListenerProtocolTCP:
+				addressStreamProtocols[listenAddressAndPort]++
+			case dnsListenerProtocolTLS:
+				addressStreamProtocols[listenAddressAndPort]++
+				usesTLS = true
+			case dnsListenerProtocolHTTPS:
+				addressStreamProtocols[listenAddressAndPort]++
+				usesHTTPS = true
+			default:
+				err = fmt.Errorf("invalid protocol %q for listener %v", protocol, listenAddressAndPort)
+				return
+			}
+
+			if addressProtocols[listenAddressAndPort][protocol] {
+				err = fmt.Errorf("duplicate protocol %q for listener %v", protocol, listenAddressAndPort)
+				return
+			}
+			addressProtocols[listenAddressAndPort][protocol] = true
+		}
+
+		if addressStreamProtocols[listenAddressAndPort] > 1 {
+			err = fmt.Errorf("tcp, tls, and https need separate listeners, listener %v protocols %v", listenAddressAndPort, listener.Protocols)
+			return
+		}
+	}
+
+	return
 }
 
 func newDNSServer(configuration *DNSServerConfiguration) *dnsServer {
-	return &dnsServer{
+	usesTLS, usesHTTPS, err := validateListeners(configuration.Listeners)
+	if err != nil {
+		log.Fatalf("dnsServerConfiguration listeners error: %v", err)
+	}
+
+	dnsServer := &dnsServer{
 		configuration: configuration,
 	}
+
+	sockets, err := systemdSockets()
+	if err != nil {
+		log.Printf("systemd socket activation error, using configured listeners: %v", err)
+	} else if len(sockets) > 0 {
+		log.Printf("using %v systemd sockets instead of configured listeners", len(sockets))
+		dnsServer.systemdSockets = sockets
+
+		usesTLS = false
+		usesHTTPS = false
+		for _, socket := range sockets {
+			switch socket.name {
+			case dnsListenerProtocolTLS:
+				usesTLS = true
+			case dnsListenerProtocolHTTPS:
+				usesHTTPS = true
+			}
+		}
+	}
+
+	if usesTLS && (len(configuration.TLSConfiguration.CertFile) == 0) {
+		log.Fatalf("tls protocol requires tlsConfiguration")
+	}
+
+	if len(configuration.TLSConfiguration.CertFile) > 0 {
+		certificateReloader, err := newTLSCertificateReloader(&configuration.TLSConfiguration)
+		if err != nil {
+			log.Fatalf("tlsConfiguration certificate error: %v", err)
+		}
+		dnsServer.certificateReloader = certificateReloader
+	}
+
+	if usesHTTPS {
+		dnsServer.dohServer = newDOHServer(&configuration.DOHServerConfiguration, dnsServer.certificateReloader, dns.HandlerFunc(dnsServer.serveDNS))
+	}
+
+	return dnsServer
+}
+
+// dnsServerHandler wraps the handler so atomic.Value always stores the same type.
+type dnsServerHandler struct {
+	handler dns.Handler
 }
 
-func (dnsServer *dnsServer) runServer(listenAddrAndPort, net string, serveMux *dns.ServeMux) {
-	srv := &dns.Server{
-		Handler: serveMux,
-		Addr:    listenAddrAndPort,
-		Net:     net,
+// serveDNS dispatches to the current handler so it can be replaced while running.
+func (dnsServer *dnsServer) serveDNS(w dns.ResponseWriter, r *dns.Msg) {
+	dnsServer.handlerValue.Load().(dnsServerHandler).handler.ServeDNS(w, r)
+}
+
+func (dnsServer *dnsServer) setHandler(handler dns.Handler) {
+	dnsServer.handlerValue.Store(dnsServerHandler{handler: handler})
+}
+
+// runServer calls notifyStarted if the server fails before it starts.
+func (dnsServer *dnsServer) runServer(srv *dns.Server, protocol string, listenAddress net.Addr, notifyStarted func()) {
+	defer atomic.AddInt32(&dnsServer.runningListeners, -1)
+
+	log.Printf("starting %v server on %v", protocol, listenAddress)
+
+	if err := srv.ActivateAndServe(); err != nil {
+		log.Printf("ActivateAndServe error for %v server on %v: %v", protocol, listenAddress, err)
+		notifyStarted()
+		return
 	}
 
-	log.Printf("starting %v server on %v", net, listenAddrAndPort)
+	log.Printf("stopped %v server on %v", protocol, listenAddress)
+}
+
+func (dnsServer *dnsServer) runDOHServer(httpsListener net.Listener) {
+	defer atomic.AddInt32(&dnsServer.runningListeners, -1)
+
+	dnsServer.dohServer.serve(httpsListener)
+}
 
-	err := srv.ListenAndServe()
-	log.Fatalf("ListenAndServe error for net %s: %v", net, err)
+// runningListenerCount is the number of listeners still serving.
+func (dnsServer *dnsServer) runningListenerCount() int32 {
+	return atomic.LoadInt32(&dnsServer.runningListeners)
 }
 
-func (dnsServer *dnsServer) start(serveMux *dns.ServeMux) {
+// listen binds a socket for one listener protocol.  https listeners return a net.Listener for the DoH server.
+func (dnsServer *dnsServer) listen(listenAddressAndPort, protocol string) (srv *dns.Server, httpsListener net.Listener, err error) {
+	srv = &dns.Server{
+		Handler: dns.HandlerFunc(dnsServer.serveDNS),
+	}
+
+	switch protocol {
+	case dnsListenerProtocolUDP:
+		srv.Net = "udp"
+		srv.PacketConn, err = net.ListenPacket("udp", listenAddressAndPort)
+
+	case dnsListenerProtocolTCP:
+		srv.Net = "tcp"
+		srv.Listener, err = net.Listen("tcp", listenAddressAndPort)
+
+	case dnsListenerProtocolTLS:
+		srv.Net = "tcp-tls"
+		srv.Listener, err = tls.Listen("tcp", listenAddressAndPort, dnsServer.certificateReloader.tlsConfig())
+
+	case dnsListenerProtocolHTTPS:
+		srv = nil
+		httpsListener, err = net.Listen("tcp", listenAddressAndPort)
+	}
+
+	if err != nil {
+		srv = nil
+		err = fmt.Errorf("%v listen error on %v: %w", protocol, listenAddressAndPort, err)
+	}
+	return
+}
+
+// systemdSocketServer wraps a systemd socket by protocol.  Stream sockets named "tls" or
+// "https" by FileDescriptorName are DNS-over-TLS or DNS-over-HTTPS, others are tcp.
+func (dnsServer *dnsServer) systemdSocketServer(socket systemdSocket) (protocol string, srv *dns.Server, httpsListener net.Listener) {
+	if socket.packetConn != nil {
+		protocol = dnsListenerProtocolUDP
+		srv = &dns.Server{
+			Handler:    dns.HandlerFunc(dnsServer.serveDNS),
+			Net:        "udp",
+			PacketConn: socket.packetConn,
+		}
+		return
+	}
+
+	switch socket.name {
+	case dnsListenerProtocolHTTPS:
+		protocol = dnsListenerProtocolHTTPS
+		httpsListener = socket.listener
+
+	case dnsListenerProtocolTLS:
+		protocol = dnsListenerProtocolTLS
+		srv = &dns.Server{
+			Handler:  dns.HandlerFunc(dnsServer.serveDNS),
+			Net:      "tcp-tls",
+			Listener: tls.NewListener(socket.listener, dnsServer.certificateReloader.tlsConfig()),
+		}
+
+	default:
+		protocol = dnsListenerProtocolTCP
+		srv = &dns.Server{
+			Handler:  dns.HandlerFunc(dnsServer.serveDNS),
+			Net:      "tcp",
+			Listener: socket.listener,
+		}
+	}
+	return
+}
+
+// serve starts serving a bound socket.  startedWaitGroup is done when a dns.Server is serving.
+func (dnsServer *dnsServer) serve(protocol string, srv *dns.Server, httpsListener net.Listener, startedWaitGroup *sync.WaitGroup) {
+	atomic.AddInt32(&dnsServer.runningListeners, 1)
+
+	if httpsListener != nil {
+		go dnsServer.runDOHServer(httpsListener)
+		return
+	}
+
+	var listenAddress net.Addr
+	if srv.PacketConn != nil {
+		listenAddress = srv.PacketConn.LocalAddr()
+	} else {
+		listenAddress = srv.Listener.Addr()
+	}
+
+	var startedOnce sync.Once
+	notifyStarted := func() {
+		startedOnce.Do(startedWaitGroup.Done)
+	}
+
+	startedWaitGroup.Add(1)
+	srv.NotifyStartedFunc = notifyStarted
+	dnsServer.servers = append(dnsServer.servers, srv)
+
+	go dnsServer.runServer(srv, protocol, listenAddress, notifyStarted)
+}
+
+// start returns the number of listeners started after they are serving.  Bind failures are
+// logged and do not stop the other listeners.  Sockets from systemd socket activation
+// replace the configured listeners.
+func (dnsServer *dnsServer) start(handler dns.Handler) (listenersStarted int) {
 	log.Printf("dnsServer.start")
 
-	listenAddressAndPort := dnsServer.configuration.ListenAddress.joinHostPort()
+	dnsServer.setHandler(handler)
+
+	if dnsServer.certificateReloader != nil {
+		dnsServer.certificateReloader.start()
+	}
+
+	var startedWaitGroup sync.WaitGroup
+
+	dnsServer.serversMutex.Lock()
+	defer dnsServer.serversMutex.Unlock()
+
+	if len(dnsServer.systemdSockets) > 0 {
+		for _, socket := range dnsServer.systemdSockets {
+			protocol, srv, httpsListener := dnsServer.systemdSocketServer(socket)
+			dnsServer.serve(protocol, srv, httpsListener, &startedWaitGroup)
+			listenersStarted++
+		}
+	} else {
+		for _, listener := range dnsServer.configuration.Listeners {
+			listenAddressAndPort := listener.ListenAddress.joinHostPort()
+
+			for _, protocol := range listener.Protocols {
+				srv, httpsListener, err := dnsServer.listen(listenAddressAndPort, protocol)
+				if err != nil {
+					log.Printf("dnsServer bind failure: %v", err)
+					continue
+				}
+
+				dnsServer.serve(protocol, srv, httpsListener, &startedWaitGroup)
+				listenersStarted++
+			}
+		}
+	}
+
+	startedWaitGroup.Wait()
+
+	return
+}
+
+// stop shuts down all servers and waits for in-flight queries to finish.
+func (dnsServer *dnsServer) stop(ctx context.Context) (err error) {
+	log.Printf("dnsServer.stop")
+
+	dnsServer.serversMutex.Lock()
+	servers := dnsServer.servers
+	dnsServer.servers = nil
+	dnsServer.serversMutex.Unlock()
 
-	go dnsServer.runServer(listenAddressAndPort, "tcp", serveMux)
-	go dnsServer.runServer(listenAddressAndPort, "udp", serveMux)
+	for _, srv := range servers {
+		if shutdownErr := srv.ShutdownContext(ctx); shutdownErr != nil {
+			log.Printf("ShutdownContext error for net %s: %v", srv.Net, shutdownErr)
+			err = shutdownErr
+		}
+	}
+
+	if dnsServer.dohServer != nil {
+		if shutdownErr := dnsServer.dohServer.stop(ctx); shutdownErr != nil {
+			log.Printf("dohServer.stop error: %v", shutdownErr)
+			err = shutdownErr
+		}
+	}
+
+	if dnsServer.certificateReloader != nil {
+		if stopErr := dnsServer.certificateReloader.stop(ctx); stopErr != nil {
+			log.Printf("certificateReloader.stop error: %v", stopErr)
+			err = stopErr
+		}
+	}
 
+	return
 }
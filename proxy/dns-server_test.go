@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestValidateListeners(t *testing.T) {
+	listener := func(host, port string, protocols ...string) DNSListenerConfiguration {
+		return DNSListenerConfiguration{
+			ListenAddress: HostAndPort{Host: host, Port: port},
+			Protocols:     protocols,
+		}
+	}
+
+	tests := []struct {
+		name          string
+		listeners     []DNSListenerConfiguration
+		wantUsesTLS   bool
+		wantUsesHTTPS bool
+		wantErr       string
+	}{
+		{
+			name:      "udp and tcp",
+			listeners: []DNSListenerConfiguration{listener("127.0.0.1", "53", "udp", "tcp")},
+		},
+		{
+			name: "udp with tls and https on other addresses",
+			listeners: []DNSListenerConfiguration{
+				listener("127.0.0.1", "853", "udp", "tls"),
+				listener("127.0.0.1", "443", "https"),
+				listener("::1", "853", "tls"),
+			},
+			wantUsesTLS:   true,
+			wantUsesHTTPS: true,
+		},
+		{
+			name:      "tcp and tls on one listener",
+			listeners: []DNSListenerConfiguration{listener("127.0.0.1", "53", "tcp", "tls")},
+			wantErr:   "need separate listeners",
+		},
+		{
+			name: "tcp and https on one address in two listeners",
+			listeners: []DNSListenerConfiguration{
+				listener("127.0.0.1", "53", "udp", "tcp"),
+				listener("127.0.0.1", "53", "https"),
+			},
+			wantErr: "need separate listeners",
+		},
+		{
+			name:      "duplicate protocol",
+			listeners: []DNSListenerConfiguration{listener("127.0.0.1", "53", "udp", "udp")},
+			wantErr:   "duplicate protocol",
+		},
+		{
+			name: "duplicate protocol on one address in two listeners",
+			listeners: []DNSListenerConfiguration{
+				listener("127.0.0.1", "53", "tcp"),
+				listener("127.0.0.1", "53", "tcp"),
+			},
+			wantErr: "duplicate protocol",
+		},
+		{
+			name:      "invalid protocol",
+			listeners: []DNSListenerConfiguration{listener("127.0.0.1", "53", "quic")},
+			wantErr:   "invalid protocol",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			usesTLS, usesHTTPS, err := validateListeners(test.listeners)
+			if len(test.wantErr) > 0 {
+				if (err == nil) || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("validateListeners error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("validateListeners error: %v", err)
+			}
+
+			if (usesTLS != test.wantUsesTLS) || (usesHTTPS != test.wantUsesHTTPS) {
+				t.Errorf("usesTLS, usesHTTPS = %v %v, want %v %v", usesTLS, usesHTTPS, test.wantUsesTLS, test.wantUsesHTTPS)
+			}
+		})
+	}
+}
+
+func TestDNSServerStartListeners(t *testing.T) {
+	tests := []struct {
+		name          string
+		configuration DNSServerConfiguration
+		wantStarted   int
+	}{
+		{
+			name: "legacy listenAddress",
+			configuration: DNSServerConfiguration{
+				ListenAddress: &HostAndPort{Host: "127.0.0.1", Port: "0"},
+			},
+			wantStarted: 2,
+		},
+		{
+			name: "listeners",
+			configuration: DNSServerConfiguration{
+				Listeners: []DNSListenerConfiguration{
+					{ListenAddress: HostAndPort{Host: "127.0.0.1", Port: "0"}, Protocols: []string{"udp"}},
+					{ListenAddress: HostAndPort{Host: "127.0.0.2", Port: "0"}, Protocols: []string{"udp", "tcp"}},
+				},
+			},
+			wantStarted: 3,
+		},
+		{
+			name: "bind failure",
+			configuration: DNSServerConfiguration{
+				Listeners: []DNSListenerConfiguration{
+					{ListenAddress: HostAndPort{Host: "127.0.0.1", Port: "0"}, Protocols: []string{"udp"}},
+					{ListenAddress: HostAndPort{Host: "192.0.2.1", Port: "0"}, Protocols: []string{"tcp"}},
+				},
+			},
+			wantStarted: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configuration := test.configuration
+			configuration.convertListenAddress()
+
+			dnsServer := newDNSServer(&configuration)
+			listenersStarted := dnsServer.start(dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+				response := new(dns.Msg)
+				response.SetReply(r)
+				w.WriteMsg(response)
+			}))
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				dnsServer.stop(ctx)
+			}()
+
+			if listenersStarted != test.wantStarted {
+				t.Fatalf("listenersStarted = %v, want %v", listenersStarted, test.wantStarted)
+			}
+			if running := dnsServer.runningListenerCount(); int(running) != test.wantStarted {
+				t.Errorf("runningListenerCount = %v, want %v", running, test.wantStarted)
+			}
+
+			for _, srv := range dnsServer.servers {
+				var address string
+				if srv.PacketConn != nil {
+					address = srv.PacketConn.LocalAddr().String()
+				} else {
+					address = srv.Listener.Addr().String()
+				}
+
+				request := new(dns.Msg)
+				request.SetQuestion("example.com.", dns.TypeA)
+				client := &dns.Client{Net: srv.Net, Timeout: time.Second}
+				if _, _, err := client.Exchange(request, address); err != nil {
+					t.Errorf("%v query to %v error: %v", srv.Net, address, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,535 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnstap messages (https://dnstap.info) are protobuf encoded by hand to avoid the
+// protobuf dependency, and written with the Frame Streams protocol.
+
+const (
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+	dnstapVersion     = "go-doh-proxy"
+)
+
+const (
+	dnstapDefaultQueueSize    = 1000
+	dnstapReconnectInterval   = 5 * time.Second
+	dnstapSocketTimeout       = 2 * time.Second
+	dnstapMaxControlFrameSize = 512
+)
+
+// dnstap.proto Dnstap and Message field numbers and enum values
+const (
+	dnstapFieldIdentity = 1
+	dnstapFieldVersion  = 2
+	dnstapFieldMessage  = 14
+	dnstapFieldType     = 15
+
+	dnstapTypeMessage = 1
+
+	dnstapMessageFieldType             = 1
+	dnstapMessageFieldSocketFamily     = 2
+	dnstapMessageFieldSocketProtocol   = 3
+	dnstapMessageFieldQueryAddress     = 4
+	dnstapMessageFieldResponseAddress  = 5
+	dnstapMessageFieldQueryPort        = 6
+	dnstapMessageFieldResponsePort     = 7
+	dnstapMessageFieldQueryTimeSec     = 8
+	dnstapMessageFieldQueryTimeNsec    = 9
+	dnstapMessageFieldQueryMessage     = 10
+	dnstapMessageFieldResponseTimeSec  = 12
+	dnstapMessageFieldResponseTimeNsec = 13
+	dnstapMessageFieldResponseMessage  = 14
+
+	dnstapMessageTypeClientQuery       = 5
+	dnstapMessageTypeClientResponse    = 6
+	dnstapMessageTypeForwarderQuery    = 7
+	dnstapMessageTypeForwarderResponse = 8
+
+	dnstapSocketFamilyINET  = 1
+	dnstapSocketFamilyINET6 = 2
+
+	dnstapSocketProtocolUDP = 1
+	dnstapSocketProtocolTCP = 2
+	dnstapSocketProtocolDOT = 3
+	dnstapSocketProtocolDOH = 4
+)
+
+// Frame Streams control frame types and fields
+const (
+	frameStreamControlAccept = 0x01
+	frameStreamControlStart  = 0x02
+	frameStreamControlStop   = 0x03
+	frameStreamControlReady  = 0x04
+	frameStreamControlFinish = 0x05
+
+	frameStreamControlFieldContentType = 0x01
+)
+
+func appendProtobufVarint(b []byte, value uint64) []byte {
+	for value >= 0x80 {
+		b = append(b, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(b, byte(value))
+}
+
+func appendProtobufVarintField(b []byte, fieldNumber int, value uint64) []byte {
+	b = appendProtobufVarint(b, uint64(fieldNumber<<3))
+	return appendProtobufVarint(b, value)
+}
+
+func appendProtobufBytesField(b []byte, fieldNumber int, value []byte) []byte {
+	b = appendProtobufVarint(b, uint64(fieldNumber<<3|2))
+	b = appendProtobufVarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendProtobufFixed32Field(b []byte, fieldNumber int, value uint32) []byte {
+	b = appendProtobufVarint(b, uint64(fieldNumber<<3|5))
+	return append(b, byte(value), byte(value>>8), byte(value>>16), byte(value>>24))
+}
+
+// dnstapMessage is the subset of the dnstap Message fields this proxy records.
+type dnstapMessage struct {
+	messageType     uint64
+	socketProtocol  uint64
+	queryAddress    net.Addr
+	responseAddress net.Addr
+	queryTime       time.Time
+	queryMessage    *dns.Msg
+	responseTime    time.Time
+	responseMessage *dns.Msg
+}
+
+func addrIPAndPort(addr net.Addr) (net.IP, int) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP, addr.Port
+	case *net.TCPAddr:
+		return addr.IP, addr.Port
+	}
+	return nil, 0
+}
+
+func appendDNSTapAddress(b []byte, addressFieldNumber, portFieldNumber int, addr net.Addr) []byte {
+	ip, port := addrIPAndPort(addr)
+	if ip == nil {
+		return b
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	b = appendProtobufBytesField(b, addressFieldNumber, ip)
+	return appendProtobufVarintField(b, portFieldNumber, uint64(port))
+}
+
+func (dnstapMessage *dnstapMessage) encode(identity, version []byte) []byte {
+	var message []byte
+
+	message = appendProtobufVarintField(message, dnstapMessageFieldType, dnstapMessage.messageType)
+
+	socketAddr := dnstapMessage.queryAddress
+	if socketAddr == nil {
+		socketAddr = dnstapMessage.responseAddress
+	}
+	if ip, _ := addrIPAndPort(socketAddr); ip != nil {
+		socketFamily := uint64(dnstapSocketFamilyINET6)
+		if ip.To4() != nil {
+			socketFamily = dnstapSocketFamilyINET
+		}
+		message = appendProtobufVarintField(message, dnstapMessageFieldSocketFamily, socketFamily)
+	}
+
+	if dnstapMessage.socketProtocol != 0 {
+		message = appendProtobufVarintField(message, dnstapMessageFieldSocketProtocol, dnstapMessage.socketProtocol)
+	}
+
+	message = appendDNSTapAddress(message, dnstapMessageFieldQueryAddress, dnstapMessageFieldQueryPort, dnstapMessage.queryAddress)
+	message = appendDNSTapAddress(message, dnstapMessageFieldResponseAddress, dnstapMessageFieldResponsePort, dnstapMessage.responseAddress)
+
+	if !dnstapMessage.queryTime.IsZero() {
+		message = appendProtobufVarintField(message, dnstapMessageFieldQueryTimeSec, uint64(dnstapMessage.queryTime.Unix()))
+		message = appendProtobufFixed32Field(message, dnstapMessageFieldQueryTimeNsec, uint32(dnstapMessage.queryTime.Nanosecond()))
+	}
+
+	if dnstapMessage.queryMessage != nil {
+		if packed, err := dnstapMessage.queryMessage.Pack(); err == nil {
+			message = appendProtobufBytesField(message, dnstapMessageFieldQueryMessage, packed)
+		}
+	}
+
+	if !dnstapMessage.responseTime.IsZero() {
+		message = appendProtobufVarintField(message, dnstapMessageFieldResponseTimeSec, uint64(dnstapMessage.responseTime.Unix()))
+		message = appendProtobufFixed32Field(message, dnstapMessageFieldResponseTimeNsec, uint32(dnstapMessage.responseTime.Nanosecond()))
+	}
+
+	if dnstapMessage.responseMessage != nil {
+		if packed, err := dnstapMessage.responseMessage.Pack(); err == nil {
+			message = appendProtobufBytesField(message, dnstapMessageFieldResponseMessage, packed)
+		}
+	}
+
+	var frame []byte
+	if len(identity) > 0 {
+		frame = appendProtobufBytesField(frame, dnstapFieldIdentity, identity)
+	}
+	if len(version) > 0 {
+		frame = appendProtobufBytesField(frame, dnstapFieldVersion, version)
+	}
+	frame = appendProtobufBytesField(frame, dnstapFieldMessage, message)
+	frame = appendProtobufVarintField(frame, dnstapFieldType, dnstapTypeMessage)
+
+	return frame
+}
+
+func appendFrameStreamUint32(b []byte, value uint32) []byte {
+	return append(b, byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+}
+
+func encodeFrameStreamControlFrame(controlType uint32, withContentType bool) []byte {
+	var payload []byte
+	payload = appendFrameStreamUint32(payload, controlType)
+	if withContentType {
+		payload = appendFrameStreamUint32(payload, frameStreamControlFieldContentType)
+		payload = appendFrameStreamUint32(payload, uint32(len(dnstapContentType)))
+		payload = append(payload, dnstapContentType...)
+	}
+
+	// escape sequence, control frame length, control frame
+	var frame []byte
+	frame = appendFrameStreamUint32(frame, 0)
+	frame = appendFrameStreamUint32(frame, uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func readFrameStreamControlFrame(reader io.Reader) (controlType uint32, err error) {
+	var header [8]byte
+	if _, err = io.ReadFull(reader, header[:]); err != nil {
+		return
+	}
+
+	if escape := binary.BigEndian.Uint32(header[0:4]); escape != 0 {
+		err = fmt.Errorf("expected control frame escape got %v", escape)
+		return
+	}
+
+	length := binary.BigEndian.Uint32(header[4:8])
+	if (length < 4) || (length > dnstapMaxControlFrameSize) {
+		err = fmt.Errorf("invalid control frame length %v", length)
+		return
+	}
+
+	payload := make([]byte, length)
+	if _, err = io.ReadFull(reader, payload); err != nil {
+		return
+	}
+
+	controlType = binary.BigEndian.Uint32(payload[0:4])
+	return
+}
+
+type dnstap struct {
+	configuration  *DNSTapConfiguration
+	metrics        *metrics
+	backgroundTask *backgroundTask
+	identity       []byte
+	version        []byte
+	frameChannel   chan []byte
+	conn           io.ReadWriteCloser
+	writer         *bufio.Writer
+	lastOpenTime   time.Time
+}
+
+func newDNSTap(configuration *DNSTapConfiguration, metrics *metrics) *dnstap {
+	if (len(configuration.UnixSocket) > 0) && (len(configuration.File) > 0) {
+		log.Fatalf("dnstapConfiguration unixSocket and file are exclusive")
+	}
+
+	queueSize := configuration.QueueSize
+	if queueSize <= 0 {
+		queueSize = dnstapDefaultQueueSize
+	}
+
+	return &dnstap{
+		configuration:  configuration,
+		metrics:        metrics,
+		backgroundTask: newBackgroundTask(),
+		identity:       []byte(configuration.Identity),
+		version:        []byte(dnstapVersion),
+		frameChannel:   make(chan []byte, queueSize),
+	}
+}
+
+func (dnstap *dnstap) enabled() bool {
+	return (len(dnstap.configuration.UnixSocket) > 0) || (len(dnstap.configuration.File) > 0)
+}
+
+// send queues a message for the writer goroutine, messages are dropped if the queue is full.
+func (dnstap *dnstap) send(dnstapMessage *dnstapMessage) {
+	if !dnstap.enabled() {
+		return
+	}
+
+	frame := dnstapMessage.encode(dnstap.identity, dnstap.version)
+
+	select {
+	case dnstap.frameChannel <- frame:
+	default:
+		dnstap.metrics.incrementDNSTapDropped()
+	}
+}
+
+func (dnstap *dnstap) logClientQuery(w dns.ResponseWriter, request, response *dns.Msg, queryTime time.Time) {
+	if !dnstap.enabled() {
+		return
+	}
+
+	var socketProtocol uint64 = dnstapSocketProtocolUDP
+	if _, isDOH := w.(*dohResponseWriter); isDOH {
+		socketProtocol = dnstapSocketProtocolDOH
+	} else if isDNSOverTLS(w) {
+		socketProtocol = dnstapSocketProtocolDOT
+	} else if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+		socketProtocol = dnstapSocketProtocolTCP
+	}
+
+	dnstap.send(&dnstapMessage{
+		messageType:     dnstapMessageTypeClientQuery,
+		socketProtocol:  socketProtocol,
+		queryAddress:    w.RemoteAddr(),
+		responseAddress: w.LocalAddr(),
+		queryTime:       queryTime,
+		queryMessage:    request,
+	})
+
+	if response != nil {
+		dnstap.send(&dnstapMessage{
+			messageType:     dnstapMessageTypeClientResponse,
+			socketProtocol:  socketProtocol,
+			queryAddress:    w.RemoteAddr(),
+			responseAddress: w.LocalAddr(),
+			queryTime:       queryTime,
+			queryMessage:    request,
+			responseTime:    time.Now(),
+			responseMessage: response,
+		})
+	}
+}
+
+// logForwarderQuery logs the message sent upstream, with EDNS padding for wire format.
+func (dnstap *dnstap) logForwarderQuery(request *dns.Msg, queryTime time.Time) {
+	dnstap.send(&dnstapMessage{
+		messageType:    dnstapMessageTypeForwarderQuery,
+		socketProtocol: dnstapSocketProtocolDOH,
+		queryTime:      queryTime,
+		queryMessage:   request,
+	})
+}
+
+func (dnstap *dnstap) logForwarderResponse(request, response *dns.Msg, queryTime time.Time) {
+	dnstap.send(&dnstapMessage{
+		messageType:     dnstapMessageTypeForwarderResponse,
+		socketProtocol:  dnstapSocketProtocolDOH,
+		queryTime:       queryTime,
+		queryMessage:    request,
+		responseTime:    time.Now(),
+		responseMessage: response,
+	})
+}
+
+// renameExistingFile renames a non-empty file from a previous frame stream with a timestamp
+// suffix, so each file is a single frame stream.
+func (dnstap *dnstap) renameExistingFile() error {
+	fileInfo, err := os.Stat(dnstap.configuration.File)
+	if (err != nil) || (fileInfo.Size() == 0) {
+		return nil
+	}
+
+	backupFile := dnstap.configuration.File + "." + time.Now().Format("20060102-150405.000000")
+	if err := os.Rename(dnstap.configuration.File, backupFile); err != nil {
+		return fmt.Errorf("os.Rename error: %w", err)
+	}
+	return nil
+}
+
+// open connects to the socket or creates the file and starts a frame stream.
+func (dnstap *dnstap) open() (err error) {
+	dnstap.lastOpenTime = time.Now()
+
+	if len(dnstap.configuration.UnixSocket) > 0 {
+		var conn net.Conn
+		conn, err = net.DialTimeout("unix", dnstap.configuration.UnixSocket, dnstapSocketTimeout)
+		if err != nil {
+			return fmt.Errorf("net.DialTimeout error: %w", err)
+		}
+
+		// bidirectional handshake: READY, ACCEPT, START
+		conn.SetDeadline(time.Now().Add(dnstapSocketTimeout))
+		if _, err = conn.Write(encodeFrameStreamControlFrame(frameStreamControlReady, true)); err != nil {
+			conn.Close()
+			return fmt.Errorf("write READY error: %w", err)
+		}
+		var controlType uint32
+		controlType, err = readFrameStreamControlFrame(conn)
+		if err != nil {
+			conn.Close()
+			return fmt.Errorf("read ACCEPT error: %w", err)
+		}
+		if controlType != frameStreamControlAccept {
+			conn.Close()
+			return fmt.Errorf("expected ACCEPT got control type %v", controlType)
+		}
+		conn.SetDeadline(time.Time{})
+
+		dnstap.conn = conn
+	} else {
+		if err = dnstap.renameExistingFile(); err != nil {
+			return err
+		}
+
+		var file *os.File
+		file, err = os.OpenFile(dnstap.configuration.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("os.OpenFile error: %w", err)
+		}
+		dnstap.conn = file
+	}
+
+	dnstap.writer = bufio.NewWriter(dnstap.conn)
+	if _, err = dnstap.writer.Write(encodeFrameStreamControlFrame(frameStreamControlStart, true)); err != nil {
+		dnstap.closeWithoutStop()
+		return fmt.Errorf("write START error: %w", err)
+	}
+
+	log.Printf("dnstap opened frame stream")
+
+	return nil
+}
+
+func (dnstap *dnstap) closeWithoutStop() {
+	if dnstap.conn != nil {
+		dnstap.conn.Close()
+	}
+	dnstap.conn = nil
+	dnstap.writer = nil
+}
+
+// close ends the frame stream with STOP, and waits for FINISH from a socket reader.
+func (dnstap *dnstap) close() {
+	if dnstap.conn == nil {
+		return
+	}
+
+	if conn, ok := dnstap.conn.(net.Conn); ok {
+		conn.SetDeadline(time.Now().Add(dnstapSocketTimeout))
+	}
+
+	dnstap.writer.Write(encodeFrameStreamControlFrame(frameStreamControlStop, false))
+	if err := dnstap.writer.Flush(); err == nil {
+		if _, isSocket := dnstap.conn.(net.Conn); isSocket {
+			if controlType, err := readFrameStreamControlFrame(dnstap.conn); (err != nil) || (controlType != frameStreamControlFinish) {
+				log.Printf("dnstap expected FINISH got control type %v error %v", controlType, err)
+			}
+		}
+	}
+
+	dnstap.closeWithoutStop()
+}
+
+func (dnstap *dnstap) writeFrame(frame []byte) error {
+	if conn, ok := dnstap.conn.(net.Conn); ok {
+		conn.SetWriteDeadline(time.Now().Add(dnstapSocketTimeout))
+	}
+
+	var lengthBuffer [4]byte
+	binary.BigEndian.PutUint32(lengthBuffer[:], uint32(len(frame)))
+	if _, err := dnstap.writer.Write(lengthBuffer[:]); err != nil {
+		return err
+	}
+	if _, err := dnstap.writer.Write(frame); err != nil {
+		return err
+	}
+
+	// batch frames while more are queued
+	if len(dnstap.frameChannel) == 0 {
+		return dnstap.writer.Flush()
+	}
+	return nil
+}
+
+func (dnstap *dnstap) handleFrame(frame []byte) {
+	if dnstap.conn == nil {
+		if time.Since(dnstap.lastOpenTime) < dnstapReconnectInterval {
+			dnstap.metrics.incrementDNSTapDropped()
+			return
+		}
+
+		if err := dnstap.open(); err != nil {
+			log.Printf("dnstap open error: %v", err)
+			dnstap.metrics.incrementDNSTapDropped()
+			return
+		}
+	}
+
+	if err := dnstap.writeFrame(frame); err != nil {
+		var netError net.Error
+		if !(errors.As(err, &netError) && netError.Timeout()) {
+			log.Printf("dnstap write error: %v", err)
+		}
+		dnstap.metrics.incrementDNSTapDropped()
+		dnstap.closeWithoutStop()
+	}
+}
+
+func (dnstap *dnstap) runWriter() {
+	if err := dnstap.open(); err != nil {
+		log.Printf("dnstap open error: %v", err)
+	}
+
+	for {
+		select {
+		case frame := <-dnstap.frameChannel:
+			dnstap.handleFrame(frame)
+
+		case <-dnstap.backgroundTask.stopping():
+			for {
+				select {
+				case frame := <-dnstap.frameChannel:
+					dnstap.handleFrame(frame)
+				default:
+					dnstap.close()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (dnstap *dnstap) start() {
+	log.Printf("dnstap.start")
+
+	if dnstap.enabled() {
+		dnstap.backgroundTask.run(dnstap.runWriter)
+	}
+}
+
+func (dnstap *dnstap) stop(ctx context.Context) error {
+	log.Printf("dnstap.stop")
+
+	return dnstap.backgroundTask.stop(ctx)
+}
@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testResponseWriter is a dns.ResponseWriter that records the response.  With tls set it is a
+// DNS-over-TLS connection.
+type testResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	tls        bool
+	response   *dns.Msg
+}
+
+func newTestUDPResponseWriter() *testResponseWriter {
+	return &testResponseWriter{
+		localAddr:  &net.UDPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 53},
+		remoteAddr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53000},
+	}
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr       { return w.localAddr }
+func (w *testResponseWriter) RemoteAddr() net.Addr      { return w.remoteAddr }
+func (w *testResponseWriter) WriteMsg(m *dns.Msg) error { w.response = m; return nil }
+func (w *testResponseWriter) Write(b []byte) (int, error) {
+	w.response = new(dns.Msg)
+	return len(b), w.response.Unpack(b)
+}
+func (w *testResponseWriter) Close() error        { return nil }
+func (w *testResponseWriter) TsigStatus() error   { return nil }
+func (w *testResponseWriter) TsigTimersOnly(bool) {}
+func (w *testResponseWriter) Hijack()             {}
+
+func (w *testResponseWriter) ConnectionState() *tls.ConnectionState {
+	if !w.tls {
+		return nil
+	}
+	return &tls.ConnectionState{}
+}
+
+func mustDecodeHex(t *testing.T, hexStrings ...string) []byte {
+	b, err := hex.DecodeString(strings.Join(hexStrings, ""))
+	if err != nil {
+		t.Fatalf("hex.DecodeString error: %v", err)
+	}
+	return b
+}
+
+func newTestDNSTapMessages() (query, response *dnstapMessage) {
+	request := new(dns.Msg)
+	request.SetQuestion("example.com.", dns.TypeA)
+	request.Id = 0x1234
+
+	reply := new(dns.Msg)
+	reply.SetReply(request)
+	reply.RecursionAvailable = true
+	reply.Answer = append(reply.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.IPv4(192, 0, 2, 1),
+	})
+
+	w := newTestUDPResponseWriter()
+	queryTime := time.Unix(1600000000, 500)
+
+	query = &dnstapMessage{
+		messageType:     dnstapMessageTypeClientQuery,
+		socketProtocol:  dnstapSocketProtocolUDP,
+		queryAddress:    w.RemoteAddr(),
+		responseAddress: w.LocalAddr(),
+		queryTime:       queryTime,
+		queryMessage:    request,
+	}
+	response = &dnstapMessage{
+		messageType:     dnstapMessageTypeClientResponse,
+		socketProtocol:  dnstapSocketProtocolUDP,
+		queryAddress:    w.RemoteAddr(),
+		responseAddress: w.LocalAddr(),
+		queryTime:       queryTime,
+		queryMessage:    request,
+		responseTime:    time.Unix(1600000000, 1500),
+		responseMessage: reply,
+	}
+	return
+}
+
+// the golden frames were encoded independently of this package
+const (
+	testDNSTapQueryMessageHex    = "123401000001000000000000076578616d706c6503636f6d0000010001"
+	testDNSTapResponseMessageHex = "123481800001000100000000076578616d706c6503636f6d0000010001" +
+		"076578616d706c6503636f6d00000100010000003c0004c0000201"
+)
+
+func testDNSTapGoldenFrames(t *testing.T) (queryFrame, responseFrame []byte) {
+	queryFrame = mustDecodeHex(t,
+		"0a0474657374",                   // identity "test"
+		"120c676f2d646f682d70726f7879",   // version "go-doh-proxy"
+		"7242",                           // message, 66 bytes
+		"0805",                           // type CLIENT_QUERY
+		"1001",                           // socket_family INET
+		"1801",                           // socket_protocol UDP
+		"2204c0000201",                   // query_address 192.0.2.1
+		"30889e03",                       // query_port 53000
+		"2a04c0000235",                   // response_address 192.0.2.53
+		"3835",                           // response_port 53
+		"4080a0f8fa05",                   // query_time_sec 1600000000
+		"4df4010000",                     // query_time_nsec 500
+		"521d"+testDNSTapQueryMessageHex, // query_message, 29 bytes
+		"7801",                           // type MESSAGE
+	)
+
+	responseFrame = mustDecodeHex(t,
+		"0a0474657374",
+		"120c676f2d646f682d70726f7879",
+		"728701", // message, 135 bytes
+		"0806",   // type CLIENT_RESPONSE
+		"1001",
+		"1801",
+		"2204c0000201",
+		"30889e03",
+		"2a04c0000235",
+		"3835",
+		"4080a0f8fa05",
+		"4df4010000",
+		"521d"+testDNSTapQueryMessageHex,
+		"6080a0f8fa05",                      // response_time_sec 1600000000
+		"6ddc050000",                        // response_time_nsec 1500
+		"7238"+testDNSTapResponseMessageHex, // response_message, 56 bytes
+		"7801",
+	)
+	return
+}
+
+func TestDNSTapMessageEncode(t *testing.T) {
+	query, response := newTestDNSTapMessages()
+	wantQueryFrame, wantResponseFrame := testDNSTapGoldenFrames(t)
+
+	if got := query.encode([]byte("test"), []byte(dnstapVersion)); !bytes.Equal(got, wantQueryFrame) {
+		t.Errorf("CLIENT_QUERY encode =\n%x\nwant\n%x", got, wantQueryFrame)
+	}
+	if got := response.encode([]byte("test"), []byte(dnstapVersion)); !bytes.Equal(got, wantResponseFrame) {
+		t.Errorf("CLIENT_RESPONSE encode =\n%x\nwant\n%x", got, wantResponseFrame)
+	}
+}
+
+func TestFrameStreamControlFrames(t *testing.T) {
+	tests := []struct {
+		name            string
+		controlType     uint32
+		withContentType bool
+		want            []byte
+	}{
+		{
+			name:            "START",
+			controlType:     frameStreamControlStart,
+			withContentType: true,
+			want: mustDecodeHex(t,
+				"00000000", // escape
+				"00000022", // control frame length 34
+				"00000002", // START
+				"00000001", // content type field
+				"00000016", // content type length 22
+				hex.EncodeToString([]byte("protobuf:dnstap.Dnstap")),
+			),
+		},
+		{
+			name:            "READY",
+			controlType:     frameStreamControlReady,
+			withContentType: true,
+			want: mustDecodeHex(t,
+				"00000000", "00000022", "00000004", "00000001", "00000016",
+				hex.EncodeToString([]byte("protobuf:dnstap.Dnstap")),
+			),
+		},
+		{
+			name:        "STOP",
+			controlType: frameStreamControlStop,
+			want:        mustDecodeHex(t, "00000000", "00000004", "00000003"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := encodeFrameStreamControlFrame(test.controlType, test.withContentType)
+			if !bytes.Equal(got, test.want) {
+				t.Errorf("encodeFrameStreamControlFrame =\n%x\nwant\n%x", got, test.want)
+			}
+
+			controlType, err := readFrameStreamControlFrame(bytes.NewReader(got))
+			if err != nil {
+				t.Fatalf("readFrameStreamControlFrame error: %v", err)
+			}
+			if controlType != test.controlType {
+				t.Errorf("readFrameStreamControlFrame = %v, want %v", controlType, test.controlType)
+			}
+		})
+	}
+
+	for _, invalid := range [][]byte{
+		mustDecodeHex(t, "00000001", "00000004", "00000003"), // data frame
+		mustDecodeHex(t, "00000000", "00000002", "0003"),     // too short
+		mustDecodeHex(t, "00000000", "00000004", "0000"),     // truncated
+	} {
+		if _, err := readFrameStreamControlFrame(bytes.NewReader(invalid)); err == nil {
+			t.Errorf("readFrameStreamControlFrame(%x) error = nil, want error", invalid)
+		}
+	}
+}
+
+func TestDNSTapFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dnstap.fstrm")
+	if err := ioutil.WriteFile(file, []byte("previous"), 0644); err != nil {
+		t.Fatalf("ioutil.WriteFile error: %v", err)
+	}
+
+	dnstap := newDNSTap(&DNSTapConfiguration{File: file, Identity: "test"}, newMetrics(&MetricsConfiguration{}))
+	dnstap.start()
+
+	query, response := newTestDNSTapMessages()
+	dnstap.send(query)
+	dnstap.send(response)
+
+	if err := dnstap.stop(context.Background()); err != nil {
+		t.Fatalf("stop error: %v", err)
+	}
+
+	queryFrame, responseFrame := testDNSTapGoldenFrames(t)
+	var want []byte
+	want = append(want, encodeFrameStreamControlFrame(frameStreamControlStart, true)...)
+	for _, frame := range [][]byte{queryFrame, responseFrame} {
+		want = appendFrameStreamUint32(want, uint32(len(frame)))
+		want = append(want, frame...)
+	}
+	want = append(want, encodeFrameStreamControlFrame(frameStreamControlStop, false)...)
+
+	got, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("ioutil.ReadFile error: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("file =\n%x\nwant\n%x", got, want)
+	}
+
+	backupFiles, err := filepath.Glob(file + ".*")
+	if err != nil {
+		t.Fatalf("filepath.Glob error: %v", err)
+	}
+	if len(backupFiles) != 1 {
+		t.Fatalf("backupFiles = %v, want the previous file", backupFiles)
+	}
+	if previous, err := ioutil.ReadFile(backupFiles[0]); (err != nil) || (string(previous) != "previous") {
+		t.Errorf("previous file contents = %q, error = %v", previous, err)
+	}
+}
+
+func TestDNSTapClientSocketProtocol(t *testing.T) {
+	tcpWriter := func(tls bool) *testResponseWriter {
+		return &testResponseWriter{
+			localAddr:  &net.TCPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 853},
+			remoteAddr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 53000},
+			tls:        tls,
+		}
+	}
+
+	tests := []struct {
+		name string
+		w    dns.ResponseWriter
+		want uint64
+	}{
+		{name: "udp", w: newTestUDPResponseWriter(), want: dnstapSocketProtocolUDP},
+		{name: "tcp", w: tcpWriter(false), want: dnstapSocketProtocolTCP},
+		{name: "tls", w: tcpWriter(true), want: dnstapSocketProtocolDOT},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dnstap := newDNSTap(&DNSTapConfiguration{File: filepath.Join(t.TempDir(), "dnstap.fstrm")}, newMetrics(&MetricsConfiguration{}))
+
+			request := new(dns.Msg)
+			request.SetQuestion("example.com.", dns.TypeA)
+			dnstap.logClientQuery(test.w, request, nil, time.Now())
+
+			frame := <-dnstap.frameChannel
+			// socket_protocol follows type and socket_family in the message
+			index := bytes.Index(frame, []byte{0x08, dnstapMessageTypeClientQuery, 0x10, dnstapSocketFamilyINET, 0x18})
+			if (index < 0) || (uint64(frame[index+5]) != test.want) {
+				t.Errorf("frame %x does not have socket_protocol %v", frame, test.want)
+			}
+		})
+	}
+}
@@ -1,12 +1,17 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"mime"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -14,35 +19,77 @@ import (
 )
 
 type dohClient struct {
-	urlObject               url.URL
+	metrics                 *metrics
+	dnstap                  *dnstap
+	backgroundTask          *backgroundTask
+	dohUpstreamSelector     *dohUpstreamSelector
+	healthCheckInterval     time.Duration
+	wireFormat              bool
+	httpMethod              string
 	sepaphoreAcquireTimeout time.Duration
 	requestTimeout          time.Duration
 	semaphore               *semaphore.Weighted
+	maxConcurrentRequests   int64
+	semaphoreInUse          int64
 	dohJSONConverter        *dohJSONConverter
+	dohWireConverter        *dohWireConverter
 }
 
-func newDOHClient(configuration DOHClientConfiguration, dohJSONConverter *dohJSONConverter) *dohClient {
-	urlObject, err := url.Parse(configuration.URL)
+func newDOHClient(configuration DOHClientConfiguration, metrics *metrics, dnstap *dnstap, dohJSONConverter *dohJSONConverter, dohWireConverter *dohWireConverter) (*dohClient, error) {
+	dohUpstreamSelector, err := newDOHUpstreamSelector(&configuration)
 	if err != nil {
-		log.Fatalf("error parsing url %q", configuration.URL)
+		return nil, err
+	}
+
+	httpMethod := strings.ToUpper(configuration.HTTPMethod)
+	switch httpMethod {
+	case "":
+		httpMethod = http.MethodGet
+
+	case http.MethodGet:
+
+	case http.MethodPost:
+		if !configuration.WireFormat {
+			return nil, fmt.Errorf("httpMethod %q requires wireFormat", configuration.HTTPMethod)
+		}
+
+	default:
+		return nil, fmt.Errorf("invalid httpMethod %q", configuration.HTTPMethod)
+	}
+
+	if (configuration.PaddingBlockSizeBytes > 0) && (!configuration.WireFormat) {
+		return nil, fmt.Errorf("paddingBlockSizeBytes %v requires wireFormat", configuration.PaddingBlockSizeBytes)
 	}
 
 	sepaphoreAcquireTimeout := time.Duration(configuration.SemaphoreAcquireTimeoutMilliseconds) * time.Millisecond
 	requestTimeout := time.Duration(configuration.RequestTimeoutMilliseconds) * time.Millisecond
+	healthCheckInterval := time.Duration(configuration.HealthCheckIntervalSeconds) * time.Second
 
-	log.Printf("newDOHClient sepaphoreAcquireTimeout = %v requestTimeout = %v maxConcurrentRequests = %v", sepaphoreAcquireTimeout, requestTimeout, configuration.MaxConcurrentRequests)
+	log.Printf("newDOHClient upstreams = %v upstreamSelectionPolicy = %v healthCheckInterval = %v",
+		len(dohUpstreamSelector.upstreams), dohUpstreamSelector.policy, healthCheckInterval)
+
+	log.Printf("newDOHClient wireFormat = %v httpMethod = %v paddingBlockSizeBytes = %v sepaphoreAcquireTimeout = %v requestTimeout = %v maxConcurrentRequests = %v",
+		configuration.WireFormat, httpMethod, configuration.PaddingBlockSizeBytes, sepaphoreAcquireTimeout, requestTimeout, configuration.MaxConcurrentRequests)
 
 	return &dohClient{
-		urlObject:               *urlObject,
+		metrics:                 metrics,
+		dnstap:                  dnstap,
+		backgroundTask:          newBackgroundTask(),
+		dohUpstreamSelector:     dohUpstreamSelector,
+		healthCheckInterval:     healthCheckInterval,
+		wireFormat:              configuration.WireFormat,
+		httpMethod:              httpMethod,
 		sepaphoreAcquireTimeout: sepaphoreAcquireTimeout,
 		requestTimeout:          requestTimeout,
 		dohJSONConverter:        dohJSONConverter,
+		dohWireConverter:        dohWireConverter,
 		semaphore:               semaphore.NewWeighted(configuration.MaxConcurrentRequests),
-	}
+		maxConcurrentRequests:   configuration.MaxConcurrentRequests,
+	}, nil
 }
 
-func (dohClient *dohClient) buildRequestURL(question *dns.Question) string {
-	urlObject := dohClient.urlObject
+func (dohClient *dohClient) buildRequestURL(upstream *dohUpstream, question *dns.Question) string {
+	urlObject := upstream.urlObject
 
 	queryParameters := url.Values{}
 	queryParameters.Set("name", question.Name)
@@ -57,35 +104,43 @@ func (dohClient *dohClient) acquireSemaphore(ctx context.Context) (err error) {
 	ctx, cancel := context.WithTimeout(ctx, dohClient.sepaphoreAcquireTimeout)
 	defer cancel()
 
+	startTime := time.Now()
 	err = dohClient.semaphore.Acquire(ctx, 1)
+	dohClient.metrics.recordSemaphoreWaitLatency(time.Since(startTime))
+	if err == nil {
+		atomic.AddInt64(&(dohClient.semaphoreInUse), 1)
+	}
 	return
 }
 
 func (dohClient *dohClient) releaseSemaphore() {
+	atomic.AddInt64(&(dohClient.semaphoreInUse), -1)
 	dohClient.semaphore.Release(1)
 }
 
-func (dohClient *dohClient) internalMakeHTTPRequest(ctx context.Context, urlString string) (responseBuffer []byte, err error) {
-	const requestMethod = "GET"
-	const dnsMessageMIMEType = "application/dns-json"
-
-	err = dohClient.acquireSemaphore(ctx)
-	if err != nil {
-		err = fmt.Errorf("dohClient.acquireSemaphore error: %w", err)
-		return
-	}
-	defer dohClient.releaseSemaphore()
+func (dohClient *dohClient) semaphoreUsage() int64 {
+	return atomic.LoadInt64(&(dohClient.semaphoreInUse))
+}
 
+func (dohClient *dohClient) internalMakeHTTPRequest(ctx context.Context, requestMethod, urlString string, requestBody []byte, mimeType string) (responseBuffer []byte, err error) {
 	ctx, cancel := context.WithTimeout(ctx, dohClient.requestTimeout)
 	defer cancel()
 
-	httpRequest, err := http.NewRequestWithContext(ctx, requestMethod, urlString, nil)
+	var requestBodyReader io.Reader
+	if requestBody != nil {
+		requestBodyReader = bytes.NewReader(requestBody)
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, requestMethod, urlString, requestBodyReader)
 	if err != nil {
 		err = fmt.Errorf("http.NewRequestWithContext error: %w", err)
 		return
 	}
 
-	httpRequest.Header.Set("Accept", dnsMessageMIMEType)
+	httpRequest.Header.Set("Accept", mimeType)
+	if requestBody != nil {
+		httpRequest.Header.Set("Content-Type", mimeType)
+	}
 	httpRequest.Header.Set("User-Agent", "")
 
 	httpResponse, err := http.DefaultClient.Do(httpRequest)
@@ -100,6 +155,14 @@ func (dohClient *dohClient) internalMakeHTTPRequest(ctx context.Context, urlStri
 		return
 	}
 
+	if mimeType == dohWireMIMEType {
+		contentType := httpResponse.Header.Get("Content-Type")
+		if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != dohWireMIMEType {
+			err = fmt.Errorf("unexpected response content type %q", contentType)
+			return
+		}
+	}
+
 	responseBuffer, err = ioutil.ReadAll(httpResponse.Body)
 	if err != nil {
 		err = fmt.Errorf("ioutil.ReadAll error: %w", err)
@@ -110,22 +173,44 @@ func (dohClient *dohClient) internalMakeHTTPRequest(ctx context.Context, urlStri
 	return
 }
 
-func (dohClient *dohClient) makeRequest(ctx context.Context, request *dns.Msg) (responseMessage *dns.Msg, err error) {
-	if len(request.Question) != 1 {
-		err = fmt.Errorf("invalid question len %v request %v", len(request.Question), request)
+func (dohClient *dohClient) makeJSONRequest(ctx context.Context, upstream *dohUpstream, request *dns.Msg) (responseMessage *dns.Msg, err error) {
+	question := &(request.Question[0])
+
+	urlString := dohClient.buildRequestURL(upstream, question)
+
+	responseBuffer, err := dohClient.internalMakeHTTPRequest(ctx, http.MethodGet, urlString, nil, dohJSONMIMEType)
+	if err != nil {
 		return
 	}
 
-	question := &(request.Question[0])
+	responseMessage, err = dohClient.dohJSONConverter.decodeJSONResponse(request, responseBuffer)
+	if err != nil {
+		responseMessage = nil
+		return
+	}
 
-	urlString := dohClient.buildRequestURL(question)
+	return
+}
 
-	responseBuffer, err := dohClient.internalMakeHTTPRequest(ctx, urlString)
+// makeWireRequest sends upstreamRequest, built by dohWireConverter.buildUpstreamRequest.
+func (dohClient *dohClient) makeWireRequest(ctx context.Context, upstream *dohUpstream, upstreamRequest *dns.Msg) (responseMessage *dns.Msg, err error) {
+	requestBuffer, err := dohClient.dohWireConverter.encodeRequest(upstreamRequest)
 	if err != nil {
 		return
 	}
 
-	responseMessage, err = dohClient.dohJSONConverter.decodeJSONResponse(request, responseBuffer)
+	var responseBuffer []byte
+	if dohClient.httpMethod == http.MethodPost {
+		responseBuffer, err = dohClient.internalMakeHTTPRequest(ctx, http.MethodPost, upstream.urlObject.String(), requestBuffer, dohWireMIMEType)
+	} else {
+		urlString := dohClient.dohWireConverter.buildGETRequestURL(upstream.urlObject, requestBuffer)
+		responseBuffer, err = dohClient.internalMakeHTTPRequest(ctx, http.MethodGet, urlString, nil, dohWireMIMEType)
+	}
+	if err != nil {
+		return
+	}
+
+	responseMessage, err = dohClient.dohWireConverter.decodeWireResponse(upstreamRequest, responseBuffer)
 	if err != nil {
 		responseMessage = nil
 		return
@@ -133,3 +218,128 @@ func (dohClient *dohClient) makeRequest(ctx context.Context, request *dns.Msg) (
 
 	return
 }
+
+func (dohClient *dohClient) makeUpstreamRequest(ctx context.Context, upstream *dohUpstream, request *dns.Msg) (responseMessage *dns.Msg, err error) {
+	startTime := time.Now()
+
+	if dohClient.wireFormat {
+		upstreamRequest := dohClient.dohWireConverter.buildUpstreamRequest(request)
+		dohClient.dnstap.logForwarderQuery(upstreamRequest, startTime)
+		responseMessage, err = dohClient.makeWireRequest(ctx, upstream, upstreamRequest)
+	} else {
+		dohClient.dnstap.logForwarderQuery(request, startTime)
+		responseMessage, err = dohClient.makeJSONRequest(ctx, upstream, request)
+	}
+
+	latency := time.Since(startTime)
+	dohClient.metrics.recordDOHRequestLatency(latency)
+
+	if err != nil {
+		dohClient.metrics.recordUpstreamError(upstream.name)
+		err = fmt.Errorf("upstream %q error: %w", upstream.name, err)
+		return
+	}
+
+	upstream.recordLatency(latency)
+	dohClient.metrics.recordUpstreamSuccess(upstream.name, latency)
+	dohClient.dnstap.logForwarderResponse(request, responseMessage, startTime)
+
+	return
+}
+
+// upstreamsToTry returns only the upstream named upstreamName if set, otherwise the upstreams
+// in selection policy order.
+func (dohClient *dohClient) upstreamsToTry(upstreamName string) ([]*dohUpstream, error) {
+	if len(upstreamName) == 0 {
+		return dohClient.dohUpstreamSelector.upstreamsToTry(), nil
+	}
+
+	upstream := dohClient.dohUpstreamSelector.upstreamNamed(upstreamName)
+	if upstream == nil {
+		return nil, fmt.Errorf("unknown upstream %q", upstreamName)
+	}
+	return []*dohUpstream{upstream}, nil
+}
+
+func (dohClient *dohClient) makeRequest(ctx context.Context, request *dns.Msg, upstreamName string) (responseMessage *dns.Msg, err error) {
+	if len(request.Question) != 1 {
+		err = fmt.Errorf("invalid question len %v request %v", len(request.Question), request)
+		return
+	}
+
+	upstreams, err := dohClient.upstreamsToTry(upstreamName)
+	if err != nil {
+		return
+	}
+
+	err = dohClient.acquireSemaphore(ctx)
+	if err != nil {
+		err = fmt.Errorf("dohClient.acquireSemaphore error: %w", err)
+		return
+	}
+	defer dohClient.releaseSemaphore()
+
+	for _, upstream := range upstreams {
+		responseMessage, err = dohClient.makeUpstreamRequest(ctx, upstream, request)
+		if err == nil {
+			upstream.markHealthy()
+			return
+		}
+
+		// do not blame the upstream if our caller gave up
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("makeUpstreamRequest error: %v", err)
+		upstream.markUnhealthy()
+	}
+
+	return
+}
+
+func (dohClient *dohClient) probeUpstream(upstream *dohUpstream) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	request := new(dns.Msg)
+	request.SetQuestion(".", dns.TypeNS)
+
+	if _, err := dohClient.makeUpstreamRequest(ctx, upstream, request); err != nil {
+		log.Printf("probeUpstream error: %v", err)
+		return
+	}
+
+	upstream.markHealthy()
+}
+
+func (dohClient *dohClient) runHealthCheckTimer() {
+	ticker := time.NewTicker(dohClient.healthCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, upstream := range dohClient.dohUpstreamSelector.unhealthyUpstreams() {
+				dohClient.probeUpstream(upstream)
+			}
+
+		case <-dohClient.backgroundTask.stopping():
+			return
+		}
+	}
+}
+
+func (dohClient *dohClient) start() {
+	log.Printf("dohClient.start")
+
+	if dohClient.healthCheckInterval > 0 {
+		dohClient.backgroundTask.run(dohClient.runHealthCheckTimer)
+	}
+}
+
+func (dohClient *dohClient) stop(ctx context.Context) error {
+	log.Printf("dohClient.stop")
+
+	return dohClient.backgroundTask.stop(ctx)
+}
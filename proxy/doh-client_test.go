@@ -0,0 +1,363 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newTestDOHClient returns a wire format dohClient with the single upstream upstreamURL.
+func newTestDOHClient(t *testing.T, upstreamURL, httpMethod string) *dohClient {
+	metrics := newMetrics(&MetricsConfiguration{})
+
+	dohClient, err := newDOHClient(DOHClientConfiguration{
+		Upstreams: []DOHUpstreamConfiguration{
+			{Name: "test", URL: upstreamURL},
+		},
+		WireFormat:                          true,
+		HTTPMethod:                          httpMethod,
+		MaxConcurrentRequests:               1,
+		SemaphoreAcquireTimeoutMilliseconds: 1000,
+		RequestTimeoutMilliseconds:          1000,
+	}, metrics, newDNSTap(&DNSTapConfiguration{}, metrics), newDOHJSONConverter(metrics), newDOHWireConverter(metrics, 0))
+	if err != nil {
+		t.Fatalf("newDOHClient error: %v", err)
+	}
+	return dohClient
+}
+
+// readTestDOHRequest returns the wire format request of a GET or POST DoH request.
+func readTestDOHRequest(t *testing.T, r *http.Request) *dns.Msg {
+	var requestBuffer []byte
+	var err error
+
+	switch r.Method {
+	case http.MethodGet:
+		requestBuffer, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if contentType := r.Header.Get("Content-Type"); contentType != dohWireMIMEType {
+			t.Errorf("request Content-Type = %q, want %q", contentType, dohWireMIMEType)
+		}
+		requestBuffer, err = ioutil.ReadAll(r.Body)
+	}
+	if err != nil {
+		t.Errorf("error reading %v request: %v", r.Method, err)
+		return nil
+	}
+
+	if accept := r.Header.Get("Accept"); accept != dohWireMIMEType {
+		t.Errorf("request Accept = %q, want %q", accept, dohWireMIMEType)
+	}
+
+	request := new(dns.Msg)
+	if err := request.Unpack(requestBuffer); err != nil {
+		t.Errorf("request Unpack error: %v", err)
+		return nil
+	}
+	return request
+}
+
+func TestDOHClientWireRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		httpMethod  string
+		status      int
+		contentType string
+		body        func(request *dns.Msg) []byte
+		wantErr     bool
+	}{
+		{
+			name:        "GET",
+			httpMethod:  http.MethodGet,
+			status:      http.StatusOK,
+			contentType: dohWireMIMEType,
+		},
+		{
+			name:        "POST",
+			httpMethod:  http.MethodPost,
+			status:      http.StatusOK,
+			contentType: dohWireMIMEType,
+		},
+		{
+			name:        "content type with parameters",
+			httpMethod:  http.MethodGet,
+			status:      http.StatusOK,
+			contentType: dohWireMIMEType + "; charset=utf-8",
+		},
+		{
+			name:        "server error",
+			httpMethod:  http.MethodGet,
+			status:      http.StatusInternalServerError,
+			contentType: dohWireMIMEType,
+			wantErr:     true,
+		},
+		{
+			name:        "wrong content type",
+			httpMethod:  http.MethodPost,
+			status:      http.StatusOK,
+			contentType: dohJSONMIMEType,
+			wantErr:     true,
+		},
+		{
+			name:        "truncated body",
+			httpMethod:  http.MethodGet,
+			status:      http.StatusOK,
+			contentType: dohWireMIMEType,
+			body: func(request *dns.Msg) []byte {
+				return []byte{0, 0, 0x81}
+			},
+			wantErr: true,
+		},
+		{
+			name:        "question mismatch",
+			httpMethod:  http.MethodGet,
+			status:      http.StatusOK,
+			contentType: dohWireMIMEType,
+			body: func(request *dns.Msg) []byte {
+				response := new(dns.Msg)
+				response.SetQuestion("other.example.", dns.TypeA)
+				response.Response = true
+				buffer, _ := response.Pack()
+				return buffer
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != test.httpMethod {
+					t.Errorf("request method = %v, want %v", r.Method, test.httpMethod)
+				}
+
+				request := readTestDOHRequest(t, r)
+				if request == nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				if request.Id != 0 {
+					t.Errorf("request id = %v, want 0", request.Id)
+				}
+
+				var body []byte
+				if test.body != nil {
+					body = test.body(request)
+				} else {
+					response := new(dns.Msg)
+					response.SetReply(request)
+					response.Answer = append(response.Answer, &dns.A{
+						Hdr: dns.RR_Header{Name: request.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+						A:   []byte{192, 0, 2, 1},
+					})
+					body, _ = response.Pack()
+				}
+
+				w.Header().Set("Content-Type", test.contentType)
+				w.WriteHeader(test.status)
+				w.Write(body)
+			}))
+			defer httpServer.Close()
+
+			dohClient := newTestDOHClient(t, httpServer.URL+"/dns-query", test.httpMethod)
+
+			request := new(dns.Msg)
+			request.SetQuestion("example.com.", dns.TypeA)
+
+			response, err := dohClient.makeRequest(context.Background(), request, "")
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("makeRequest error = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("makeRequest error: %v", err)
+			}
+
+			if (len(response.Answer) != 1) || (response.Answer[0].(*dns.A).A.String() != "192.0.2.1") {
+				t.Errorf("response answer = %v", response.Answer)
+			}
+		})
+	}
+}
+
+func TestBuildUpstreamRequestEDNS(t *testing.T) {
+	tests := []struct {
+		name        string
+		clientEDNS  bool
+		dnssecOK    bool
+		options     []dns.EDNS0
+		wantDO      bool
+		wantOptions []uint16
+	}{
+		{
+			name:       "no client EDNS",
+			clientEDNS: false,
+		},
+		{
+			name:       "DNSSEC OK",
+			clientEDNS: true,
+			dnssecOK:   true,
+			wantDO:     true,
+		},
+		{
+			name:       "options kept except padding and cookie",
+			clientEDNS: true,
+			options: []dns.EDNS0{
+				&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+				&dns.EDNS0_NSID{Code: dns.EDNS0NSID},
+				&dns.EDNS0_PADDING{Padding: make([]byte, 16)},
+				&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: []byte{192, 0, 2, 0}},
+			},
+			wantOptions: []uint16{dns.EDNS0NSID, dns.EDNS0SUBNET},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dohWireConverter := newDOHWireConverter(newMetrics(&MetricsConfiguration{}), 0)
+
+			request := new(dns.Msg)
+			request.SetQuestion("example.com.", dns.TypeA)
+			request.Id = 1234
+			if test.clientEDNS {
+				request.SetEdns0(1232, test.dnssecOK)
+				request.IsEdns0().Option = test.options
+			}
+
+			upstreamRequest := dohWireConverter.buildUpstreamRequest(request)
+
+			if upstreamRequest.Id != 0 {
+				t.Errorf("upstream request id = %v, want 0", upstreamRequest.Id)
+			}
+
+			opt := upstreamRequest.IsEdns0()
+			if opt == nil {
+				t.Fatalf("upstream request has no OPT record")
+			}
+			if opt.UDPSize() != dohWireUDPSize {
+				t.Errorf("UDPSize = %v, want %v", opt.UDPSize(), dohWireUDPSize)
+			}
+			if opt.Do() != test.wantDO {
+				t.Errorf("DO = %v, want %v", opt.Do(), test.wantDO)
+			}
+
+			var gotOptions []uint16
+			for _, option := range opt.Option {
+				gotOptions = append(gotOptions, option.Option())
+			}
+			if len(gotOptions) != len(test.wantOptions) {
+				t.Fatalf("options = %v, want %v", gotOptions, test.wantOptions)
+			}
+			for i := range gotOptions {
+				if gotOptions[i] != test.wantOptions[i] {
+					t.Errorf("options = %v, want %v", gotOptions, test.wantOptions)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildGETRequestURL(t *testing.T) {
+	tests := []struct {
+		name          string
+		url           string
+		requestBuffer []byte
+		wantURL       string
+	}{
+		{
+			name:          "no padding characters",
+			url:           "https://dns.example/dns-query",
+			requestBuffer: []byte{0, 0, 1, 0, 0, 1},
+			wantURL:       "https://dns.example/dns-query?dns=AAABAAAB",
+		},
+		{
+			name:          "url safe alphabet",
+			url:           "https://dns.example/dns-query",
+			requestBuffer: []byte{0xfb, 0xff, 0xbf},
+			wantURL:       "https://dns.example/dns-query?dns=-_-_",
+		},
+		{
+			name:          "existing query parameters kept",
+			url:           "https://dns.example/dns-query?ct=1",
+			requestBuffer: []byte{0xff},
+			wantURL:       "https://dns.example/dns-query?ct=1&dns=_w",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dohWireConverter := newDOHWireConverter(newMetrics(&MetricsConfiguration{}), 0)
+
+			urlObject, err := url.Parse(test.url)
+			if err != nil {
+				t.Fatalf("url.Parse error: %v", err)
+			}
+			if got := dohWireConverter.buildGETRequestURL(*urlObject, test.requestBuffer); got != test.wantURL {
+				t.Errorf("buildGETRequestURL = %q, want %q", got, test.wantURL)
+			}
+		})
+	}
+}
+
+func TestDOHClientFailover(t *testing.T) {
+	failingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failingServer.Close()
+
+	workingServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := readTestDOHRequest(t, r)
+		if request == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		response := new(dns.Msg)
+		response.SetReply(request)
+		body, _ := response.Pack()
+
+		w.Header().Set("Content-Type", dohWireMIMEType)
+		w.Write(body)
+	}))
+	defer workingServer.Close()
+
+	metrics := newMetrics(&MetricsConfiguration{})
+	dohClient, err := newDOHClient(DOHClientConfiguration{
+		Upstreams: []DOHUpstreamConfiguration{
+			{Name: "failing", URL: failingServer.URL + "/dns-query"},
+			{Name: "working", URL: workingServer.URL + "/dns-query"},
+		},
+		WireFormat:                          true,
+		MaxConcurrentRequests:               1,
+		SemaphoreAcquireTimeoutMilliseconds: 1000,
+		RequestTimeoutMilliseconds:          1000,
+	}, metrics, newDNSTap(&DNSTapConfiguration{}, metrics), newDOHJSONConverter(metrics), newDOHWireConverter(metrics, 0))
+	if err != nil {
+		t.Fatalf("newDOHClient error: %v", err)
+	}
+
+	request := new(dns.Msg)
+	request.SetQuestion("example.com.", dns.TypeA)
+
+	if _, err := dohClient.makeRequest(context.Background(), request, ""); err != nil {
+		t.Fatalf("makeRequest error: %v", err)
+	}
+	if unhealthy := upstreamNames(dohClient.dohUpstreamSelector.unhealthyUpstreams()); !reflect.DeepEqual(unhealthy, []string{"failing"}) {
+		t.Errorf("unhealthyUpstreams = %v, want [failing]", unhealthy)
+	}
+
+	if _, err := dohClient.makeRequest(context.Background(), request, "failing"); err == nil {
+		t.Errorf("makeRequest to upstream failing error = nil, want error")
+	}
+	if _, err := dohClient.makeRequest(context.Background(), request, "unknown"); err == nil {
+		t.Errorf("makeRequest to unknown upstream error = nil, want error")
+	}
+}
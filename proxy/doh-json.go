@@ -5,11 +5,19 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 
 	"github.com/miekg/dns"
 )
 
+const dohJSONMIMEType = "application/dns-json"
+
+type dohJSONResponseQuestion struct {
+	Name string `json:"name"`
+	Type int    `json:"type"`
+}
+
 type dohJSONResponseAnswer struct {
 	Name string `json:"name"`
 	Type int    `json:"type"`
@@ -18,8 +26,15 @@ type dohJSONResponseAnswer struct {
 }
 
 type dohJSONResponse struct {
-	Status int                     `json:"Status"`
-	Answer []dohJSONResponseAnswer `json:"Answer"`
+	Status    int                       `json:"Status"`
+	TC        bool                      `json:"TC"`
+	RD        bool                      `json:"RD"`
+	RA        bool                      `json:"RA"`
+	AD        bool                      `json:"AD"`
+	CD        bool                      `json:"CD"`
+	Question  []dohJSONResponseQuestion `json:"Question,omitempty"`
+	Answer    []dohJSONResponseAnswer   `json:"Answer,omitempty"`
+	Authority []dohJSONResponseAnswer   `json:"Authority,omitempty"`
 }
 
 type dohJSONConverter struct {
@@ -50,55 +65,143 @@ func (dohJSONConverter *dohJSONConverter) decodeJSONResponse(request *dns.Msg, j
 
 	for i := range dohJSONResponse.Answer {
 		answer := &(dohJSONResponse.Answer[i])
-		rrType := uint16(answer.Type)
 
 		dohJSONConverter.metrics.recordRRTypeMetric(dns.Type(answer.Type))
 
-		createRRHeader := func() dns.RR_Header {
-			return dns.RR_Header{
-				Name:   dns.Fqdn(answer.Name),
-				Rrtype: rrType,
-				Class:  dns.ClassINET,
-				Ttl:    uint32(answer.TTL),
-			}
+		if rr := dohJSONConverter.createRR(request, answer); rr != nil {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+
+	for i := range dohJSONResponse.Authority {
+		authority := &(dohJSONResponse.Authority[i])
+
+		if rr := dohJSONConverter.createRR(request, authority); rr != nil {
+			resp.Ns = append(resp.Ns, rr)
+		}
+	}
+
+	return
+}
+
+func (dohJSONConverter *dohJSONConverter) createRR(request *dns.Msg, answer *dohJSONResponseAnswer) dns.RR {
+	rrType := uint16(answer.Type)
+
+	createRRHeader := func() dns.RR_Header {
+		return dns.RR_Header{
+			Name:   dns.Fqdn(answer.Name),
+			Rrtype: rrType,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(answer.TTL),
+		}
+	}
+
+	switch rrType {
+	case dns.TypeA:
+		return &dns.A{
+			Hdr: createRRHeader(),
+			A:   net.ParseIP(answer.Data),
+		}
+
+	case dns.TypeAAAA:
+		return &dns.AAAA{
+			Hdr:  createRRHeader(),
+			AAAA: net.ParseIP(answer.Data),
+		}
+
+	case dns.TypeCNAME:
+		return &dns.CNAME{
+			Hdr:    createRRHeader(),
+			Target: dns.Fqdn(answer.Data),
+		}
+
+	case dns.TypePTR:
+		return &dns.PTR{
+			Hdr: createRRHeader(),
+			Ptr: dns.Fqdn(answer.Data),
+		}
+
+	case dns.TypeTXT:
+		return &dns.TXT{
+			Hdr: createRRHeader(),
+			// Trim leading and trailing \" from Data
+			Txt: []string{strings.Trim(answer.Data, "\"")},
+		}
+
+	case dns.TypeSOA:
+		// Data is "mname rname serial refresh retry expire minimum"
+		fields := strings.Fields(answer.Data)
+		if len(fields) != 7 {
+			log.Printf("invalid json SOA data = %q request = %v", answer.Data, request)
+			return nil
+		}
+
+		soa := &dns.SOA{
+			Hdr:  createRRHeader(),
+			Ns:   dns.Fqdn(fields[0]),
+			Mbox: dns.Fqdn(fields[1]),
 		}
 
-		switch rrType {
-		case dns.TypeA:
-			resp.Answer = append(resp.Answer, &dns.A{
-				Hdr: createRRHeader(),
-				A:   net.ParseIP(answer.Data),
-			})
-
-		case dns.TypeAAAA:
-			resp.Answer = append(resp.Answer, &dns.AAAA{
-				Hdr:  createRRHeader(),
-				AAAA: net.ParseIP(answer.Data),
-			})
-
-		case dns.TypeCNAME:
-			resp.Answer = append(resp.Answer, &dns.CNAME{
-				Hdr:    createRRHeader(),
-				Target: dns.Fqdn(answer.Data),
-			})
-
-		case dns.TypePTR:
-			resp.Answer = append(resp.Answer, &dns.PTR{
-				Hdr: createRRHeader(),
-				Ptr: dns.Fqdn(answer.Data),
-			})
-
-		case dns.TypeTXT:
-			resp.Answer = append(resp.Answer, &dns.TXT{
-				Hdr: createRRHeader(),
-				// Trim leading and trailing \" from Data
-				Txt: []string{strings.Trim(answer.Data, "\"")},
-			})
-
-		default:
-			log.Printf("unknown json rrType = %v request = %v", rrType, request)
+		soaValues := []*uint32{&soa.Serial, &soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minttl}
+		for i, soaValue := range soaValues {
+			value, err := strconv.ParseUint(fields[i+2], 10, 32)
+			if err != nil {
+				log.Printf("invalid json SOA data = %q request = %v", answer.Data, request)
+				return nil
+			}
+			*soaValue = uint32(value)
 		}
+
+		return soa
+
+	default:
+		log.Printf("unknown json rrType = %v request = %v", rrType, request)
+		return nil
 	}
+}
+
+// rrData returns the rdata of a record in presentation format, e.g. "192.0.2.1".
+func rrData(rr dns.RR) string {
+	headerString := rr.Header().String()
+	rrString := rr.String()
+	if len(rrString) >= len(headerString) {
+		return rrString[len(headerString):]
+	}
+	return rrString
+}
 
+func createJSONAnswers(rrs []dns.RR) (answers []dohJSONResponseAnswer) {
+	for _, rr := range rrs {
+		header := rr.Header()
+		answers = append(answers, dohJSONResponseAnswer{
+			Name: header.Name,
+			Type: int(header.Rrtype),
+			TTL:  int(header.Ttl),
+			Data: rrData(rr),
+		})
+	}
 	return
 }
+
+// encodeJSONResponse encodes a response in the JSON format decodeJSONResponse reads.
+func encodeJSONResponse(response *dns.Msg) ([]byte, error) {
+	dohJSONResponse := dohJSONResponse{
+		Status:    response.Rcode,
+		TC:        response.Truncated,
+		RD:        response.RecursionDesired,
+		RA:        response.RecursionAvailable,
+		AD:        response.AuthenticatedData,
+		CD:        response.CheckingDisabled,
+		Answer:    createJSONAnswers(response.Answer),
+		Authority: createJSONAnswers(response.Ns),
+	}
+
+	for _, question := range response.Question {
+		dohJSONResponse.Question = append(dohJSONResponse.Question, dohJSONResponseQuestion{
+			Name: question.Name,
+			Type: int(question.Qtype),
+		})
+	}
+
+	return json.Marshal(&dohJSONResponse)
+}
@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const dohServerDefaultPath = "/dns-query"
+
+// errDOHUnsupportedMediaType is a POST request that is not application/dns-message.
+var errDOHUnsupportedMediaType = errors.New("unsupported content type")
+
+// dohResponseWriter is the dns.ResponseWriter for a DoH request.  The response is
+// written to the http client after the handler returns.
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	response   *dns.Msg
+}
+
+func (dohResponseWriter *dohResponseWriter) LocalAddr() net.Addr {
+	return dohResponseWriter.localAddr
+}
+
+func (dohResponseWriter *dohResponseWriter) RemoteAddr() net.Addr {
+	return dohResponseWriter.remoteAddr
+}
+
+func (dohResponseWriter *dohResponseWriter) WriteMsg(msg *dns.Msg) error {
+	dohResponseWriter.response = msg
+	return nil
+}
+
+func (dohResponseWriter *dohResponseWriter) Write(buffer []byte) (int, error) {
+	msg := new(dns.Msg)
+	if err := msg.Unpack(buffer); err != nil {
+		return 0, err
+	}
+	dohResponseWriter.response = msg
+	return len(buffer), nil
+}
+
+func (dohResponseWriter *dohResponseWriter) Close() error {
+	return nil
+}
+
+func (dohResponseWriter *dohResponseWriter) TsigStatus() error {
+	return nil
+}
+
+func (dohResponseWriter *dohResponseWriter) TsigTimersOnly(bool) {
+}
+
+func (dohResponseWriter *dohResponseWriter) Hijack() {
+}
+
+// dohServer serves RFC 8484 and JSON API DoH requests with the same handler as the DNS listeners.
+// One http server serves all https listeners.
+type dohServer struct {
+	configuration       *DOHServerConfiguration
+	path                string
+	certificateReloader *tlsCertificateReloader
+	handler             dns.Handler
+	httpServer          *http.Server
+}
+
+// newDOHServer serves plain http if certificateReloader is nil.
+func newDOHServer(configuration *DOHServerConfiguration, certificateReloader *tlsCertificateReloader, handler dns.Handler) *dohServer {
+	path := configuration.Path
+	if len(path) == 0 {
+		path = dohServerDefaultPath
+	}
+
+	dohServer := &dohServer{
+		configuration:       configuration,
+		path:                path,
+		certificateReloader: certificateReloader,
+		handler:             handler,
+	}
+
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc(path, dohServer.serveHTTP)
+
+	dohServer.httpServer = &http.Server{
+		Handler:      serveMux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	if certificateReloader != nil {
+		dohServer.httpServer.TLSConfig = certificateReloader.tlsConfig()
+	}
+
+	return dohServer
+}
+
+// clientAddr is the http client address, or the last X-Forwarded-For address if trusted.
+func (dohServer *dohServer) clientAddr(r *http.Request) net.Addr {
+	if dohServer.configuration.TrustXForwardedFor {
+		if xForwardedFor := r.Header.Values("X-Forwarded-For"); len(xForwardedFor) > 0 {
+			addresses := strings.Split(xForwardedFor[len(xForwardedFor)-1], ",")
+			if ip := net.ParseIP(strings.TrimSpace(addresses[len(addresses)-1])); ip != nil {
+				return &net.TCPAddr{IP: ip}
+			}
+		}
+	}
+
+	tcpAddr := &net.TCPAddr{}
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		tcpAddr.IP = net.ParseIP(host)
+		tcpAddr.Port, _ = strconv.Atoi(port)
+	}
+	return tcpAddr
+}
+
+func readWireRequest(r *http.Request) (request *dns.Msg, err error) {
+	var requestBuffer []byte
+
+	switch r.Method {
+	case http.MethodGet:
+		requestBuffer, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err != nil {
+			err = fmt.Errorf("base64 decode error: %w", err)
+			return
+		}
+
+	case http.MethodPost:
+		contentType := r.Header.Get("Content-Type")
+		if mediaType, _, parseErr := mime.ParseMediaType(contentType); (parseErr != nil) || (mediaType != dohWireMIMEType) {
+			err = fmt.Errorf("%w %q", errDOHUnsupportedMediaType, contentType)
+			return
+		}
+
+		requestBuffer, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if err != nil {
+			err = fmt.Errorf("ioutil.ReadAll error: %w", err)
+			return
+		}
+		if len(requestBuffer) > dns.MaxMsgSize {
+			err = fmt.Errorf("request too large")
+			return
+		}
+	}
+
+	request = new(dns.Msg)
+	if err = request.Unpack(requestBuffer); err != nil {
+		err = fmt.Errorf("request.Unpack error: %w", err)
+		request = nil
+	}
+	return
+}
+
+// readJSONRequest builds a request from the JSON API name, type, cd, and do parameters.
+func readJSONRequest(r *http.Request) (request *dns.Msg, err error) {
+	query := r.URL.Query()
+
+	name := query.Get("name")
+	if _, ok := dns.IsDomainName(name); !ok {
+		err = fmt.Errorf("invalid name %q", name)
+		return
+	}
+
+	qtype := dns.TypeA
+	if typeParam := query.Get("type"); len(typeParam) > 0 {
+		if value, parseErr := strconv.ParseUint(typeParam, 10, 16); parseErr == nil {
+			qtype = uint16(value)
+		} else if value, ok := dns.StringToType[strings.ToUpper(typeParam)]; ok {
+			qtype = value
+		} else {
+			err = fmt.Errorf("invalid type %q", typeParam)
+			return
+		}
+	}
+
+	parseBool := func(value string) bool {
+		return (value == "1") || strings.EqualFold(value, "true")
+	}
+
+	request = new(dns.Msg)
+	request.SetQuestion(dns.Fqdn(name), qtype)
+	request.CheckingDisabled = parseBool(query.Get("cd"))
+	if parseBool(query.Get("do")) {
+		request.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return
+}
+
+// minTTLSeconds is the http cache lifetime of a response per RFC 8484 section 5.1.
+func minTTLSeconds(response *dns.Msg) (minTTL uint32, found bool) {
+	for _, rrs := range [][]dns.RR{response.Answer, response.Ns} {
+		for _, rr := range rrs {
+			if ttl := rr.Header().Ttl; (!found) || (ttl < minTTL) {
+				minTTL = ttl
+				found = true
+			}
+		}
+	}
+	return
+}
+
+func (dohServer *dohServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if (r.Method != http.MethodGet) && (r.Method != http.MethodPost) {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonAPI := (r.Method == http.MethodGet) && (len(r.URL.Query().Get("name")) > 0)
+
+	var request *dns.Msg
+	var err error
+	if jsonAPI {
+		request, err = readJSONRequest(r)
+	} else {
+		request, err = readWireRequest(r)
+	}
+	if errors.Is(err, errDOHUnsupportedMediaType) {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	localAddr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	responseWriter := &dohResponseWriter{
+		localAddr:  localAddr,
+		remoteAddr: dohServer.clientAddr(r),
+	}
+
+	dohServer.handler.ServeDNS(responseWriter, request)
+
+	response := responseWriter.response
+	if response == nil {
+		http.Error(w, "no response", http.StatusInternalServerError)
+		return
+	}
+
+	var responseBuffer []byte
+	if jsonAPI {
+		responseBuffer, err = encodeJSONResponse(response)
+		w.Header().Set("Content-Type", dohJSONMIMEType)
+	} else {
+		responseBuffer, err = response.Pack()
+		w.Header().Set("Content-Type", dohWireMIMEType)
+	}
+	if err != nil {
+		log.Printf("dohServer encode response error: %v", err)
+		http.Error(w, "encode response error", http.StatusInternalServerError)
+		return
+	}
+
+	if minTTL, found := minTTLSeconds(response); found {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%v", minTTL))
+	}
+
+	if _, err := w.Write(responseBuffer); err != nil {
+		log.Printf("dohServer write response error: %v", err)
+	}
+}
+
+// serve serves DoH requests on listener until stop is called.  TLS is used if a certificate is configured.
+func (dohServer *dohServer) serve(listener net.Listener) {
+	log.Printf("starting doh server on %v path %q tls = %v", listener.Addr(), dohServer.path, (dohServer.certificateReloader != nil))
+
+	var err error
+	if dohServer.certificateReloader != nil {
+		err = dohServer.httpServer.ServeTLS(listener, "", "")
+	} else {
+		err = dohServer.httpServer.Serve(listener)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("doh server Serve error on %v: %v", listener.Addr(), err)
+		return
+	}
+
+	log.Printf("stopped doh server on %v", listener.Addr())
+}
+
+func (dohServer *dohServer) stop(ctx context.Context) error {
+	return dohServer.httpServer.Shutdown(ctx)
+}
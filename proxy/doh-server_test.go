@@ -0,0 +1,336 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testDOHHandler answers A and AAAA queries with one 300 second answer and a 60 second
+// authority record, and other types with an empty NOERROR response.
+type testDOHHandler struct {
+	request    *dns.Msg
+	remoteAddr net.Addr
+}
+
+func (handler *testDOHHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	handler.request = r
+	handler.remoteAddr = w.RemoteAddr()
+
+	response := new(dns.Msg)
+	response.SetReply(r)
+
+	question := r.Question[0]
+	switch question.Qtype {
+	case dns.TypeA:
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+	case dns.TypeAAAA:
+		response.Answer = append(response.Answer, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: question.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 300},
+			AAAA: net.ParseIP("2001:db8::1"),
+		})
+	default:
+		w.WriteMsg(response)
+		return
+	}
+	response.Ns = append(response.Ns, &dns.NS{
+		Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+		Ns:  "ns." + question.Name,
+	})
+
+	w.WriteMsg(response)
+}
+
+func packTestQuestion(t *testing.T, name string, qtype uint16) []byte {
+	request := new(dns.Msg)
+	request.SetQuestion(name, qtype)
+	request.Id = 0
+	buffer, err := request.Pack()
+	if err != nil {
+		t.Fatalf("request.Pack error: %v", err)
+	}
+	return buffer
+}
+
+func TestDOHServerServeHTTP(t *testing.T) {
+	aRequest := packTestQuestion(t, "example.com.", dns.TypeA)
+	txtRequest := packTestQuestion(t, "example.com.", dns.TypeTXT)
+
+	tests := []struct {
+		name             string
+		method           string
+		target           string
+		contentType      string
+		body             []byte
+		wantStatus       int
+		wantContentType  string
+		wantCacheControl string
+		wantQtype        uint16
+	}{
+		{
+			name:             "GET wire format",
+			method:           http.MethodGet,
+			target:           "/dns-query?dns=" + base64.RawURLEncoding.EncodeToString(aRequest),
+			wantStatus:       http.StatusOK,
+			wantContentType:  dohWireMIMEType,
+			wantCacheControl: "max-age=60",
+			wantQtype:        dns.TypeA,
+		},
+		{
+			name:             "POST wire format",
+			method:           http.MethodPost,
+			target:           "/dns-query",
+			contentType:      dohWireMIMEType,
+			body:             aRequest,
+			wantStatus:       http.StatusOK,
+			wantContentType:  dohWireMIMEType,
+			wantCacheControl: "max-age=60",
+			wantQtype:        dns.TypeA,
+		},
+		{
+			name:            "no records has no Cache-Control",
+			method:          http.MethodPost,
+			target:          "/dns-query",
+			contentType:     dohWireMIMEType,
+			body:            txtRequest,
+			wantStatus:      http.StatusOK,
+			wantContentType: dohWireMIMEType,
+			wantQtype:       dns.TypeTXT,
+		},
+		{
+			name:             "JSON API",
+			method:           http.MethodGet,
+			target:           "/dns-query?name=example.com&type=AAAA",
+			wantStatus:       http.StatusOK,
+			wantContentType:  dohJSONMIMEType,
+			wantCacheControl: "max-age=60",
+			wantQtype:        dns.TypeAAAA,
+		},
+		{
+			name:             "JSON API numeric type",
+			method:           http.MethodGet,
+			target:           "/dns-query?name=example.com.&type=1",
+			wantStatus:       http.StatusOK,
+			wantContentType:  dohJSONMIMEType,
+			wantCacheControl: "max-age=60",
+			wantQtype:        dns.TypeA,
+		},
+		{
+			name:        "POST unsupported content type",
+			method:      http.MethodPost,
+			target:      "/dns-query",
+			contentType: "application/octet-stream",
+			body:        aRequest,
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "POST missing content type",
+			method:     http.MethodPost,
+			target:     "/dns-query",
+			body:       aRequest,
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "GET invalid base64",
+			method:     http.MethodGet,
+			target:     "/dns-query?dns=AAAB=+",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "GET missing dns parameter",
+			method:     http.MethodGet,
+			target:     "/dns-query",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "POST truncated message",
+			method:      http.MethodPost,
+			target:      "/dns-query",
+			contentType: dohWireMIMEType,
+			body:        aRequest[:len(aRequest)-3],
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:       "JSON API invalid type",
+			method:     http.MethodGet,
+			target:     "/dns-query?name=example.com&type=BOGUS",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "method not allowed",
+			method:     http.MethodPut,
+			target:     "/dns-query",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := &testDOHHandler{}
+			dohServer := newDOHServer(&DOHServerConfiguration{}, nil, handler)
+
+			r := httptest.NewRequest(test.method, test.target, bytes.NewReader(test.body))
+			if len(test.contentType) > 0 {
+				r.Header.Set("Content-Type", test.contentType)
+			}
+			recorder := httptest.NewRecorder()
+
+			dohServer.httpServer.Handler.ServeHTTP(recorder, r)
+
+			if recorder.Code != test.wantStatus {
+				t.Fatalf("status = %v, want %v body %q", recorder.Code, test.wantStatus, recorder.Body.String())
+			}
+			if test.wantStatus != http.StatusOK {
+				if handler.request != nil {
+					t.Errorf("handler called for a rejected request")
+				}
+				return
+			}
+
+			if contentType := recorder.Header().Get("Content-Type"); contentType != test.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", contentType, test.wantContentType)
+			}
+			if cacheControl := recorder.Header().Get("Cache-Control"); cacheControl != test.wantCacheControl {
+				t.Errorf("Cache-Control = %q, want %q", cacheControl, test.wantCacheControl)
+			}
+			if qtype := handler.request.Question[0].Qtype; qtype != test.wantQtype {
+				t.Errorf("request qtype = %v, want %v", qtype, test.wantQtype)
+			}
+
+			switch test.wantContentType {
+			case dohWireMIMEType:
+				response := new(dns.Msg)
+				if err := response.Unpack(recorder.Body.Bytes()); err != nil {
+					t.Fatalf("response Unpack error: %v", err)
+				}
+				if !response.Response || (response.Question[0].Qtype != test.wantQtype) {
+					t.Errorf("response = %v", response)
+				}
+
+			case dohJSONMIMEType:
+				var response dohJSONResponse
+				if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+					t.Fatalf("json.Unmarshal error: %v", err)
+				}
+				if (len(response.Question) != 1) || (response.Question[0].Name != "example.com.") || (response.Question[0].Type != int(test.wantQtype)) {
+					t.Errorf("response Question = %+v", response.Question)
+				}
+				if (len(response.Answer) != 1) || (response.Answer[0].TTL != 300) {
+					t.Errorf("response Answer = %+v", response.Answer)
+				}
+			}
+		})
+	}
+}
+
+func TestDOHServerPath(t *testing.T) {
+	dohServer := newDOHServer(&DOHServerConfiguration{Path: "/custom"}, nil, &testDOHHandler{})
+
+	for target, wantStatus := range map[string]int{
+		"/custom?name=example.com":    http.StatusOK,
+		"/dns-query?name=example.com": http.StatusNotFound,
+	} {
+		recorder := httptest.NewRecorder()
+		dohServer.httpServer.Handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, target, nil))
+		if recorder.Code != wantStatus {
+			t.Errorf("%v status = %v, want %v", target, recorder.Code, wantStatus)
+		}
+	}
+}
+
+func TestDOHServerClientAddr(t *testing.T) {
+	tests := []struct {
+		name               string
+		trustXForwardedFor bool
+		xForwardedFor      []string
+		want               string
+	}{
+		{name: "remote address", want: "192.0.2.10:41000"},
+		{name: "X-Forwarded-For not trusted", xForwardedFor: []string{"198.51.100.1"}, want: "192.0.2.10:41000"},
+		{name: "single address", trustXForwardedFor: true, xForwardedFor: []string{"198.51.100.1"}, want: "198.51.100.1:0"},
+		{name: "right-most address", trustXForwardedFor: true, xForwardedFor: []string{"203.0.113.9, 198.51.100.1"}, want: "198.51.100.1:0"},
+		{name: "last header", trustXForwardedFor: true, xForwardedFor: []string{"203.0.113.9", "198.51.100.2 , 2001:db8::2"}, want: "[2001:db8::2]:0"},
+		{name: "invalid address", trustXForwardedFor: true, xForwardedFor: []string{"198.51.100.1, unknown"}, want: "192.0.2.10:41000"},
+		{name: "no header", trustXForwardedFor: true, want: "192.0.2.10:41000"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler := &testDOHHandler{}
+			dohServer := newDOHServer(&DOHServerConfiguration{TrustXForwardedFor: test.trustXForwardedFor}, nil, handler)
+
+			r := httptest.NewRequest(http.MethodGet, "/dns-query?name=example.com", nil)
+			r.RemoteAddr = "192.0.2.10:41000"
+			for _, value := range test.xForwardedFor {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+
+			dohServer.httpServer.Handler.ServeHTTP(httptest.NewRecorder(), r)
+
+			if handler.remoteAddr == nil {
+				t.Fatalf("handler not called")
+			}
+			if got := handler.remoteAddr.String(); got != test.want {
+				t.Errorf("client address = %v, want %v", got, test.want)
+			}
+			if _, ok := handler.remoteAddr.(*net.TCPAddr); !ok {
+				t.Errorf("client address type = %T, want *net.TCPAddr", handler.remoteAddr)
+			}
+		})
+	}
+}
+
+func TestDOHServerQueryLogClientAddress(t *testing.T) {
+	tests := []struct {
+		name              string
+		remoteAddr        net.Addr
+		wantClientAddress string
+	}{
+		{name: "tcp address", remoteAddr: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}, wantClientAddress: "198.51.100.1"},
+		{name: "other address type", remoteAddr: &net.UnixAddr{Name: "/run/doh.sock", Net: "unix"}, wantClientAddress: "/run/doh.sock"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clientAddress, protocol := clientAddressAndProtocol(&dohResponseWriter{remoteAddr: test.remoteAddr})
+			if (clientAddress != test.wantClientAddress) || (protocol != "https") {
+				t.Errorf("clientAddressAndProtocol = %q %q, want %q https", clientAddress, protocol, test.wantClientAddress)
+			}
+		})
+	}
+
+	if _, protocol := clientAddressAndProtocol(&dohResponseWriter{}); protocol != "" {
+		t.Errorf("clientAddressAndProtocol without address protocol = %q, want none", protocol)
+	}
+}
+
+func TestMinTTLSeconds(t *testing.T) {
+	response := new(dns.Msg)
+	if _, found := minTTLSeconds(response); found {
+		t.Errorf("minTTLSeconds of empty response found")
+	}
+
+	for _, ttl := range []uint32{300, 30} {
+		response.Answer = append(response.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.IPv4(192, 0, 2, 1),
+		})
+	}
+	response.Ns = append(response.Ns, &dns.NS{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 120},
+		Ns:  "ns.example.com.",
+	})
+
+	if minTTL, found := minTTLSeconds(response); !found || (minTTL != 30) {
+		t.Errorf("minTTLSeconds = %v %v, want 30 true", minTTL, found)
+	}
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	upstreamSelectionPolicyFailover      = "failover"
+	upstreamSelectionPolicyRoundRobin    = "roundRobin"
+	upstreamSelectionPolicyLowestLatency = "lowestLatency"
+)
+
+// weight of the newest sample in the latency moving average, out of 8
+const upstreamLatencyNewSampleWeight = 2
+
+type dohUpstream struct {
+	name                string
+	urlObject           url.URL
+	unhealthy           int32
+	averageLatencyNanos int64
+}
+
+func newDOHUpstream(configuration DOHUpstreamConfiguration) (*dohUpstream, error) {
+	urlObject, err := url.Parse(configuration.URL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing url %q: %w", configuration.URL, err)
+	}
+
+	name := configuration.Name
+	if len(name) == 0 {
+		name = urlObject.Host
+	}
+
+	return &dohUpstream{
+		name:      name,
+		urlObject: *urlObject,
+	}, nil
+}
+
+func (dohUpstream *dohUpstream) healthy() bool {
+	return atomic.LoadInt32(&(dohUpstream.unhealthy)) == 0
+}
+
+func (dohUpstream *dohUpstream) markHealthy() {
+	if atomic.CompareAndSwapInt32(&(dohUpstream.unhealthy), 1, 0) {
+		log.Printf("upstream %q is healthy", dohUpstream.name)
+	}
+}
+
+func (dohUpstream *dohUpstream) markUnhealthy() {
+	if atomic.CompareAndSwapInt32(&(dohUpstream.unhealthy), 0, 1) {
+		log.Printf("upstream %q is unhealthy", dohUpstream.name)
+	}
+}
+
+func (dohUpstream *dohUpstream) averageLatency() time.Duration {
+	return time.Duration(atomic.LoadInt64(&(dohUpstream.averageLatencyNanos)))
+}
+
+func (dohUpstream *dohUpstream) recordLatency(latency time.Duration) {
+	for {
+		oldAverage := atomic.LoadInt64(&(dohUpstream.averageLatencyNanos))
+
+		newAverage := int64(latency)
+		if oldAverage != 0 {
+			newAverage = ((oldAverage * (8 - upstreamLatencyNewSampleWeight)) + (int64(latency) * upstreamLatencyNewSampleWeight)) / 8
+		}
+
+		if atomic.CompareAndSwapInt64(&(dohUpstream.averageLatencyNanos), oldAverage, newAverage) {
+			return
+		}
+	}
+}
+
+type dohUpstreamSelector struct {
+	policy            string
+	upstreams         []*dohUpstream
+	roundRobinCounter uint64
+}
+
+func newDOHUpstreamSelector(configuration *DOHClientConfiguration) (*dohUpstreamSelector, error) {
+	if len(configuration.Upstreams) == 0 {
+		return nil, errors.New("no dohClientConfiguration upstreams configured")
+	}
+
+	policy := configuration.UpstreamSelectionPolicy
+	switch policy {
+	case "":
+		policy = upstreamSelectionPolicyFailover
+
+	case upstreamSelectionPolicyFailover, upstreamSelectionPolicyRoundRobin, upstreamSelectionPolicyLowestLatency:
+
+	default:
+		return nil, fmt.Errorf("invalid upstreamSelectionPolicy %q", configuration.UpstreamSelectionPolicy)
+	}
+
+	upstreams := make([]*dohUpstream, 0, len(configuration.Upstreams))
+	for _, upstreamConfiguration := range configuration.Upstreams {
+		upstream, err := newDOHUpstream(upstreamConfiguration)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+
+	return &dohUpstreamSelector{
+		policy:    policy,
+		upstreams: upstreams,
+	}, nil
+}
+
+// upstreamsToTry returns healthy upstreams in policy order followed by unhealthy
+// upstreams as a last resort.
+func (dohUpstreamSelector *dohUpstreamSelector) upstreamsToTry() []*dohUpstream {
+	numUpstreams := len(dohUpstreamSelector.upstreams)
+
+	ordered := make([]*dohUpstream, 0, numUpstreams)
+
+	switch dohUpstreamSelector.policy {
+	case upstreamSelectionPolicyRoundRobin:
+		start := int(atomic.AddUint64(&(dohUpstreamSelector.roundRobinCounter), 1) % uint64(numUpstreams))
+		for i := 0; i < numUpstreams; i++ {
+			ordered = append(ordered, dohUpstreamSelector.upstreams[(start+i)%numUpstreams])
+		}
+
+	case upstreamSelectionPolicyLowestLatency:
+		ordered = append(ordered, dohUpstreamSelector.upstreams...)
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].averageLatency() < ordered[j].averageLatency()
+		})
+
+	default:
+		ordered = append(ordered, dohUpstreamSelector.upstreams...)
+	}
+
+	result := make([]*dohUpstream, 0, numUpstreams)
+	for _, upstream := range ordered {
+		if upstream.healthy() {
+			result = append(result, upstream)
+		}
+	}
+	for _, upstream := range ordered {
+		if !upstream.healthy() {
+			result = append(result, upstream)
+		}
+	}
+
+	return result
+}
+
+// upstreamNamed returns the upstream with name, or nil.
+func (dohUpstreamSelector *dohUpstreamSelector) upstreamNamed(name string) *dohUpstream {
+	for _, upstream := range dohUpstreamSelector.upstreams {
+		if upstream.name == name {
+			return upstream
+		}
+	}
+	return nil
+}
+
+func (dohUpstreamSelector *dohUpstreamSelector) unhealthyUpstreams() []*dohUpstream {
+	var unhealthyUpstreams []*dohUpstream
+
+	for _, upstream := range dohUpstreamSelector.upstreams {
+		if !upstream.healthy() {
+			unhealthyUpstreams = append(unhealthyUpstreams, upstream)
+		}
+	}
+
+	return unhealthyUpstreams
+}
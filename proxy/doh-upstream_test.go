@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestDOHUpstreamSelector(t *testing.T, policy string, names ...string) *dohUpstreamSelector {
+	configuration := &DOHClientConfiguration{
+		UpstreamSelectionPolicy: policy,
+	}
+	for _, name := range names {
+		configuration.Upstreams = append(configuration.Upstreams, DOHUpstreamConfiguration{
+			Name: name,
+			URL:  "https://" + name + ".example/dns-query",
+		})
+	}
+
+	dohUpstreamSelector, err := newDOHUpstreamSelector(configuration)
+	if err != nil {
+		t.Fatalf("newDOHUpstreamSelector error: %v", err)
+	}
+	return dohUpstreamSelector
+}
+
+func upstreamNames(upstreams []*dohUpstream) []string {
+	names := make([]string, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		names = append(names, upstream.name)
+	}
+	return names
+}
+
+func TestNewDOHUpstreamSelector(t *testing.T) {
+	tests := []struct {
+		name          string
+		configuration DOHClientConfiguration
+		wantPolicy    string
+		wantNames     []string
+		wantErr       bool
+	}{
+		{
+			name: "default policy and name",
+			configuration: DOHClientConfiguration{
+				Upstreams: []DOHUpstreamConfiguration{{URL: "https://dns.example/dns-query"}},
+			},
+			wantPolicy: upstreamSelectionPolicyFailover,
+			wantNames:  []string{"dns.example"},
+		},
+		{
+			name: "round robin",
+			configuration: DOHClientConfiguration{
+				Upstreams:               []DOHUpstreamConfiguration{{Name: "a", URL: "https://a.example/dns-query"}},
+				UpstreamSelectionPolicy: upstreamSelectionPolicyRoundRobin,
+			},
+			wantPolicy: upstreamSelectionPolicyRoundRobin,
+			wantNames:  []string{"a"},
+		},
+		{
+			name:          "no upstreams",
+			configuration: DOHClientConfiguration{},
+			wantErr:       true,
+		},
+		{
+			name: "invalid policy",
+			configuration: DOHClientConfiguration{
+				Upstreams:               []DOHUpstreamConfiguration{{URL: "https://dns.example/dns-query"}},
+				UpstreamSelectionPolicy: "random",
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid url",
+			configuration: DOHClientConfiguration{
+				Upstreams: []DOHUpstreamConfiguration{{URL: "https://dns.example/%zz"}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dohUpstreamSelector, err := newDOHUpstreamSelector(&test.configuration)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("newDOHUpstreamSelector error = nil, want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newDOHUpstreamSelector error: %v", err)
+			}
+
+			if dohUpstreamSelector.policy != test.wantPolicy {
+				t.Errorf("policy = %q, want %q", dohUpstreamSelector.policy, test.wantPolicy)
+			}
+			if names := upstreamNames(dohUpstreamSelector.upstreams); !reflect.DeepEqual(names, test.wantNames) {
+				t.Errorf("upstreams = %v, want %v", names, test.wantNames)
+			}
+		})
+	}
+}
+
+func TestUpstreamsToTry(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		latencies map[string]time.Duration
+		unhealthy []string
+		// wantOrders are the orders of successive calls
+		wantOrders [][]string
+	}{
+		{
+			name:       "failover",
+			policy:     upstreamSelectionPolicyFailover,
+			wantOrders: [][]string{{"a", "b", "c"}, {"a", "b", "c"}},
+		},
+		{
+			name:       "failover with unhealthy first upstream",
+			policy:     upstreamSelectionPolicyFailover,
+			unhealthy:  []string{"a"},
+			wantOrders: [][]string{{"b", "c", "a"}},
+		},
+		{
+			name:       "failover with all unhealthy",
+			policy:     upstreamSelectionPolicyFailover,
+			unhealthy:  []string{"a", "b", "c"},
+			wantOrders: [][]string{{"a", "b", "c"}},
+		},
+		{
+			name:       "round robin",
+			policy:     upstreamSelectionPolicyRoundRobin,
+			wantOrders: [][]string{{"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}, {"b", "c", "a"}},
+		},
+		{
+			name:       "round robin with unhealthy upstream",
+			policy:     upstreamSelectionPolicyRoundRobin,
+			unhealthy:  []string{"c"},
+			wantOrders: [][]string{{"b", "a", "c"}, {"a", "b", "c"}, {"a", "b", "c"}},
+		},
+		{
+			name:       "lowest latency",
+			policy:     upstreamSelectionPolicyLowestLatency,
+			latencies:  map[string]time.Duration{"a": 30 * time.Millisecond, "b": 10 * time.Millisecond, "c": 20 * time.Millisecond},
+			wantOrders: [][]string{{"b", "c", "a"}},
+		},
+		{
+			name:       "lowest latency ties keep configuration order",
+			policy:     upstreamSelectionPolicyLowestLatency,
+			latencies:  map[string]time.Duration{"a": 20 * time.Millisecond, "b": 20 * time.Millisecond, "c": 10 * time.Millisecond},
+			wantOrders: [][]string{{"c", "a", "b"}},
+		},
+		{
+			name:       "lowest latency with unhealthy fastest upstream",
+			policy:     upstreamSelectionPolicyLowestLatency,
+			latencies:  map[string]time.Duration{"a": 30 * time.Millisecond, "b": 10 * time.Millisecond, "c": 20 * time.Millisecond},
+			unhealthy:  []string{"b"},
+			wantOrders: [][]string{{"c", "a", "b"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dohUpstreamSelector := newTestDOHUpstreamSelector(t, test.policy, "a", "b", "c")
+			for name, latency := range test.latencies {
+				dohUpstreamSelector.upstreamNamed(name).recordLatency(latency)
+			}
+			for _, name := range test.unhealthy {
+				dohUpstreamSelector.upstreamNamed(name).markUnhealthy()
+			}
+
+			for i, wantOrder := range test.wantOrders {
+				if order := upstreamNames(dohUpstreamSelector.upstreamsToTry()); !reflect.DeepEqual(order, wantOrder) {
+					t.Errorf("call %v upstreamsToTry = %v, want %v", i, order, wantOrder)
+				}
+			}
+
+			if unhealthy := upstreamNames(dohUpstreamSelector.unhealthyUpstreams()); len(unhealthy) != len(test.unhealthy) {
+				t.Errorf("unhealthyUpstreams = %v, want %v", unhealthy, test.unhealthy)
+			}
+		})
+	}
+}
+
+func TestUpstreamRecovery(t *testing.T) {
+	dohUpstreamSelector := newTestDOHUpstreamSelector(t, upstreamSelectionPolicyFailover, "a", "b")
+	a := dohUpstreamSelector.upstreamNamed("a")
+
+	a.markUnhealthy()
+	if order := upstreamNames(dohUpstreamSelector.upstreamsToTry()); !reflect.DeepEqual(order, []string{"b", "a"}) {
+		t.Errorf("upstreamsToTry after markUnhealthy = %v, want [b a]", order)
+	}
+	if unhealthy := upstreamNames(dohUpstreamSelector.unhealthyUpstreams()); !reflect.DeepEqual(unhealthy, []string{"a"}) {
+		t.Errorf("unhealthyUpstreams = %v, want [a]", unhealthy)
+	}
+
+	a.markHealthy()
+	if order := upstreamNames(dohUpstreamSelector.upstreamsToTry()); !reflect.DeepEqual(order, []string{"a", "b"}) {
+		t.Errorf("upstreamsToTry after markHealthy = %v, want [a b]", order)
+	}
+	if unhealthy := dohUpstreamSelector.unhealthyUpstreams(); len(unhealthy) != 0 {
+		t.Errorf("unhealthyUpstreams = %v, want none", upstreamNames(unhealthy))
+	}
+}
+
+func TestRecordLatency(t *testing.T) {
+	upstream, err := newDOHUpstream(DOHUpstreamConfiguration{URL: "https://dns.example/dns-query"})
+	if err != nil {
+		t.Fatalf("newDOHUpstream error: %v", err)
+	}
+
+	upstream.recordLatency(80 * time.Millisecond)
+	if latency := upstream.averageLatency(); latency != 80*time.Millisecond {
+		t.Errorf("first averageLatency = %v, want 80ms", latency)
+	}
+
+	// the newest sample has weight 2 out of 8
+	upstream.recordLatency(160 * time.Millisecond)
+	if latency := upstream.averageLatency(); latency != 100*time.Millisecond {
+		t.Errorf("second averageLatency = %v, want 100ms", latency)
+	}
+}
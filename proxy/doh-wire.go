@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const dohWireMIMEType = "application/dns-message"
+
+const dohWireUDPSize = 4096
+
+type dohWireConverter struct {
+	metrics          *metrics
+	paddingBlockSize int
+}
+
+func newDOHWireConverter(metrics *metrics, paddingBlockSize int) *dohWireConverter {
+	return &dohWireConverter{
+		metrics:          metrics,
+		paddingBlockSize: paddingBlockSize,
+	}
+}
+
+// RFC 8484 section 4.1: use DNS ID 0 in every DoH request to be cache friendly.
+// The client's DNSSEC OK bit and EDNS options are kept, except padding and cookies that only
+// apply to the client's own transport.
+func (dohWireConverter *dohWireConverter) buildUpstreamRequest(request *dns.Msg) *dns.Msg {
+	question := &(request.Question[0])
+
+	upstreamRequest := new(dns.Msg)
+	upstreamRequest.SetQuestion(question.Name, question.Qtype)
+	upstreamRequest.Question[0].Qclass = question.Qclass
+	upstreamRequest.Id = 0
+	upstreamRequest.RecursionDesired = true
+	upstreamRequest.CheckingDisabled = request.CheckingDisabled
+	upstreamRequest.SetEdns0(dohWireUDPSize, false)
+
+	if clientOPT := request.IsEdns0(); clientOPT != nil {
+		upstreamOPT := upstreamRequest.IsEdns0()
+		upstreamOPT.SetDo(clientOPT.Do())
+		for _, option := range clientOPT.Option {
+			switch option.Option() {
+			case dns.EDNS0PADDING, dns.EDNS0COOKIE:
+			default:
+				upstreamOPT.Option = append(upstreamOPT.Option, option)
+			}
+		}
+	}
+
+	dohWireConverter.padRequest(upstreamRequest)
+
+	return upstreamRequest
+}
+
+// RFC 8467 section 4.1: pad queries to the closest multiple of the block size.
+func (dohWireConverter *dohWireConverter) padRequest(upstreamRequest *dns.Msg) {
+	// option code and option length
+	const paddingOptionHeaderLength = 4
+
+	if dohWireConverter.paddingBlockSize <= 0 {
+		return
+	}
+
+	opt := upstreamRequest.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	unpaddedLength := upstreamRequest.Len() + paddingOptionHeaderLength
+	paddingLength := (dohWireConverter.paddingBlockSize - (unpaddedLength % dohWireConverter.paddingBlockSize)) % dohWireConverter.paddingBlockSize
+
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{
+		Padding: make([]byte, paddingLength),
+	})
+}
+
+// Padding only protects the message on the wire, remove it before the
+// response is cached or sent to clients.
+func removeEDNS0Padding(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0PADDING {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
+
+func (dohWireConverter *dohWireConverter) encodeRequest(upstreamRequest *dns.Msg) (requestBuffer []byte, err error) {
+	requestBuffer, err = upstreamRequest.Pack()
+	if err != nil {
+		err = fmt.Errorf("upstreamRequest.Pack error: %w", err)
+		return
+	}
+	return
+}
+
+func (dohWireConverter *dohWireConverter) buildGETRequestURL(urlObject url.URL, requestBuffer []byte) string {
+	queryParameters := urlObject.Query()
+	queryParameters.Set("dns", base64.RawURLEncoding.EncodeToString(requestBuffer))
+
+	urlObject.RawQuery = queryParameters.Encode()
+
+	return urlObject.String()
+}
+
+func (dohWireConverter *dohWireConverter) decodeWireResponse(upstreamRequest *dns.Msg, wireResponse []byte) (resp *dns.Msg, err error) {
+	resp = new(dns.Msg)
+	if err = resp.Unpack(wireResponse); err != nil {
+		err = fmt.Errorf("error unpacking wire response: %w", err)
+		resp = nil
+		return
+	}
+
+	if resp.Id != upstreamRequest.Id {
+		err = fmt.Errorf("wire response id mismatch response id %v request id %v", resp.Id, upstreamRequest.Id)
+		resp = nil
+		return
+	}
+
+	if (len(resp.Question) != 1) ||
+		(!strings.EqualFold(resp.Question[0].Name, upstreamRequest.Question[0].Name)) ||
+		(resp.Question[0].Qtype != upstreamRequest.Question[0].Qtype) {
+		err = fmt.Errorf("wire response question mismatch response %v request %v", resp.Question, upstreamRequest.Question)
+		resp = nil
+		return
+	}
+
+	removeEDNS0Padding(resp)
+
+	dohWireConverter.metrics.recordRcodeMetric(resp.Rcode)
+
+	for _, rr := range resp.Answer {
+		dohWireConverter.metrics.recordRRTypeMetric(dns.Type(rr.Header().Rrtype))
+	}
+
+	return
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPadRequest(t *testing.T) {
+	tests := []struct {
+		name             string
+		questionName     string
+		paddingBlockSize int
+		wantPadding      bool
+	}{
+		{name: "block 128", questionName: "example.com.", paddingBlockSize: 128, wantPadding: true},
+		{name: "block 128 long name", questionName: "a-long-label.another-long-label.example.com.", paddingBlockSize: 128, wantPadding: true},
+		{name: "block 468", questionName: "example.com.", paddingBlockSize: 468, wantPadding: true},
+		{name: "disabled", questionName: "example.com.", paddingBlockSize: 0, wantPadding: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dohWireConverter := newDOHWireConverter(newMetrics(&MetricsConfiguration{}), test.paddingBlockSize)
+
+			request := new(dns.Msg)
+			request.SetQuestion(test.questionName, dns.TypeA)
+			upstreamRequest := dohWireConverter.buildUpstreamRequest(request)
+
+			packed, err := upstreamRequest.Pack()
+			if err != nil {
+				t.Fatalf("Pack error: %v", err)
+			}
+
+			hasPadding := false
+			for _, option := range upstreamRequest.IsEdns0().Option {
+				if option.Option() == dns.EDNS0PADDING {
+					hasPadding = true
+				}
+			}
+			if hasPadding != test.wantPadding {
+				t.Fatalf("padding option present = %v, want %v", hasPadding, test.wantPadding)
+			}
+
+			if test.wantPadding && ((len(packed) % test.paddingBlockSize) != 0) {
+				t.Errorf("packed length %v is not a multiple of %v", len(packed), test.paddingBlockSize)
+			}
+		})
+	}
+}
+
+func TestDecodeWireResponseRemovesPadding(t *testing.T) {
+	tests := []struct {
+		name        string
+		options     []dns.EDNS0
+		wantOptions []uint16
+	}{
+		{
+			name:        "padding only",
+			options:     []dns.EDNS0{&dns.EDNS0_PADDING{Padding: make([]byte, 32)}},
+			wantOptions: nil,
+		},
+		{
+			name: "padding and cookie",
+			options: []dns.EDNS0{
+				&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"},
+				&dns.EDNS0_PADDING{Padding: make([]byte, 32)},
+				&dns.EDNS0_LOCAL{Code: 15, Data: []byte{0, 15}},
+			},
+			wantOptions: []uint16{dns.EDNS0COOKIE, 15},
+		},
+		{
+			name:        "no padding",
+			options:     []dns.EDNS0{&dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: "0102030405060708"}},
+			wantOptions: []uint16{dns.EDNS0COOKIE},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dohWireConverter := newDOHWireConverter(newMetrics(&MetricsConfiguration{}), 128)
+
+			request := new(dns.Msg)
+			request.SetQuestion("example.com.", dns.TypeA)
+			upstreamRequest := dohWireConverter.buildUpstreamRequest(request)
+
+			response := new(dns.Msg)
+			response.SetReply(upstreamRequest)
+			response.Extra = nil
+			response.SetEdns0(dohWireUDPSize, false)
+			response.IsEdns0().Option = test.options
+
+			wireResponse, err := response.Pack()
+			if err != nil {
+				t.Fatalf("Pack error: %v", err)
+			}
+
+			decoded, err := dohWireConverter.decodeWireResponse(upstreamRequest, wireResponse)
+			if err != nil {
+				t.Fatalf("decodeWireResponse error: %v", err)
+			}
+
+			opt := decoded.IsEdns0()
+			if opt == nil {
+				t.Fatalf("OPT record removed")
+			}
+
+			var gotOptions []uint16
+			for _, option := range opt.Option {
+				gotOptions = append(gotOptions, option.Option())
+			}
+			if len(gotOptions) != len(test.wantOptions) {
+				t.Fatalf("options = %v, want %v", gotOptions, test.wantOptions)
+			}
+			for i := range gotOptions {
+				if gotOptions[i] != test.wantOptions[i] {
+					t.Errorf("options = %v, want %v", gotOptions, test.wantOptions)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	ipBlocklistModeStrip = "strip"
+	ipBlocklistModeBlock = "block"
+)
+
+// ipBlocklist matches A and AAAA records in upstream responses against blocked addresses and CIDRs.
+type ipBlocklist struct {
+	mode string
+	// addresses keys are string(ip.To16())
+	addresses map[string]bool
+	networks  []*net.IPNet
+}
+
+func (ipBlocklist *ipBlocklist) addEntry(entry string) error {
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return err
+		}
+		ipBlocklist.networks = append(ipBlocklist.networks, network)
+		return nil
+	}
+
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return errors.New("invalid IP address")
+	}
+	ipBlocklist.addresses[string(ip.To16())] = true
+	return nil
+}
+
+func (ipBlocklist *ipBlocklist) addFile(file string) error {
+	log.Printf("reading ipBlocklist file %q", file)
+	reader, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("error reading ipBlocklist file: %w", err)
+	}
+	defer reader.Close()
+
+	lineNumber := 0
+	invalidLines := 0
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		lineNumber++
+		line := removeHashComment(scanner.Text())
+		if len(line) == 0 {
+			continue
+		}
+
+		if err := ipBlocklist.addEntry(line); err != nil {
+			invalidLines++
+			logInvalidBlocklistLine(file, lineNumber, line, err, invalidLines)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("ipBlocklist file scanner error: %w", err)
+	}
+
+	if invalidLines > 0 {
+		log.Printf("%v: %v invalid lines skipped", file, invalidLines)
+	}
+
+	return nil
+}
+
+// newIPBlocklist returns nil if no addresses are configured.
+func newIPBlocklist(configuration *IPBlocklistConfiguration) (*ipBlocklist, error) {
+	ipBlocklist := &ipBlocklist{
+		mode:      configuration.Mode,
+		addresses: make(map[string]bool),
+	}
+
+	if len(ipBlocklist.mode) == 0 {
+		ipBlocklist.mode = ipBlocklistModeStrip
+	}
+
+	switch ipBlocklist.mode {
+	case ipBlocklistModeStrip, ipBlocklistModeBlock:
+	default:
+		return nil, fmt.Errorf("invalid ipBlocklist mode %q", configuration.Mode)
+	}
+
+	if len(configuration.File) > 0 {
+		if err := ipBlocklist.addFile(configuration.File); err != nil {
+			return nil, err
+		}
+	}
+
+	invalidLines := 0
+	for i, address := range configuration.Addresses {
+		if err := ipBlocklist.addEntry(address); err != nil {
+			invalidLines++
+			logInvalidBlocklistLine("ipBlocklistConfiguration.addresses", i+1, address, err, invalidLines)
+		}
+	}
+
+	if (len(ipBlocklist.addresses) == 0) && (len(ipBlocklist.networks) == 0) {
+		return nil, nil
+	}
+
+	log.Printf("ipBlocklist mode %v addresses %v networks %v", ipBlocklist.mode, len(ipBlocklist.addresses), len(ipBlocklist.networks))
+
+	return ipBlocklist, nil
+}
+
+func (ipBlocklist *ipBlocklist) blocked(ip net.IP) bool {
+	if ipBlocklist.addresses[string(ip.To16())] {
+		return true
+	}
+
+	for _, network := range ipBlocklist.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerAddress returns the address of an A or AAAA record, or nil.
+func answerAddress(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+// apply checks the answers in an upstream response.  In strip mode blocked records are removed
+// and the number removed is returned.  In block mode the response is not changed and the first
+// blocked address is returned.
+func (ipBlocklist *ipBlocklist) apply(response *dns.Msg) (blockedAddress string, strippedRecords int) {
+	if ipBlocklist.mode == ipBlocklistModeBlock {
+		for _, rr := range response.Answer {
+			if ip := answerAddress(rr); (ip != nil) && ipBlocklist.blocked(ip) {
+				return ip.String(), 0
+			}
+		}
+		return "", 0
+	}
+
+	answer := response.Answer[:0]
+	for _, rr := range response.Answer {
+		if ip := answerAddress(rr); (ip != nil) && ipBlocklist.blocked(ip) {
+			strippedRecords++
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	response.Answer = answer
+
+	return "", strippedRecords
+}
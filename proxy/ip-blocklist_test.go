@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIPBlocklistApply(t *testing.T) {
+	answer := func(t *testing.T) []dns.RR {
+		return []dns.RR{
+			mustNewRR(t, "www.example.com. 60 IN CNAME cdn.example.net."),
+			mustNewRR(t, "cdn.example.net. 60 IN A 192.0.2.1"),
+			mustNewRR(t, "cdn.example.net. 60 IN A 198.51.100.7"),
+			mustNewRR(t, "cdn.example.net. 60 IN AAAA 2001:db8::1"),
+			mustNewRR(t, "cdn.example.net. 60 IN AAAA 2001:db8:bad::1"),
+		}
+	}
+
+	tests := []struct {
+		name                string
+		mode                string
+		wantBlockedAddress  string
+		wantStrippedRecords int
+		wantAnswerLen       int
+	}{
+		{name: "default strips", mode: "", wantStrippedRecords: 2, wantAnswerLen: 3},
+		{name: "strip", mode: ipBlocklistModeStrip, wantStrippedRecords: 2, wantAnswerLen: 3},
+		{name: "block", mode: ipBlocklistModeBlock, wantBlockedAddress: "198.51.100.7", wantAnswerLen: 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ipBlocklist, err := newIPBlocklist(&IPBlocklistConfiguration{
+				Mode:      test.mode,
+				Addresses: []string{"198.51.100.7", "2001:db8:bad::/48", "not an address"},
+			})
+			if err != nil {
+				t.Fatalf("newIPBlocklist error: %v", err)
+			}
+
+			response := new(dns.Msg)
+			response.SetQuestion("www.example.com.", dns.TypeA)
+			response.Answer = answer(t)
+
+			blockedAddress, strippedRecords := ipBlocklist.apply(response)
+			if (blockedAddress != test.wantBlockedAddress) || (strippedRecords != test.wantStrippedRecords) {
+				t.Errorf("apply = %q, %v, want %q, %v", blockedAddress, strippedRecords, test.wantBlockedAddress, test.wantStrippedRecords)
+			}
+			if len(response.Answer) != test.wantAnswerLen {
+				t.Errorf("Answer = %v, want %v records", response.Answer, test.wantAnswerLen)
+			}
+			for _, rr := range response.Answer {
+				if ip := answerAddress(rr); (test.mode != ipBlocklistModeBlock) && (ip != nil) && ipBlocklist.blocked(ip) {
+					t.Errorf("blocked record %v not stripped", rr)
+				}
+			}
+		})
+	}
+}
+
+func TestNewIPBlocklist(t *testing.T) {
+	if ipBlocklist, err := newIPBlocklist(&IPBlocklistConfiguration{Mode: ipBlocklistModeBlock}); (ipBlocklist != nil) || (err != nil) {
+		t.Errorf("newIPBlocklist without addresses = %v, %v, want nil", ipBlocklist, err)
+	}
+	if _, err := newIPBlocklist(&IPBlocklistConfiguration{Mode: "drop", Addresses: []string{"192.0.2.1"}}); err == nil {
+		t.Errorf("newIPBlocklist with invalid mode error = nil, want error")
+	}
+
+	// Reload purges the cache when the ipBlocklist is not deeply equal to the previous one
+	first, _ := newIPBlocklist(&IPBlocklistConfiguration{Addresses: []string{"192.0.2.1", "198.51.100.0/24"}})
+	second, _ := newIPBlocklist(&IPBlocklistConfiguration{Addresses: []string{"192.0.2.1", "198.51.100.0/24"}})
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("ipBlocklists from the same configuration are not equal")
+	}
+	third, _ := newIPBlocklist(&IPBlocklistConfiguration{Mode: ipBlocklistModeBlock, Addresses: []string{"192.0.2.1", "198.51.100.0/24"}})
+	if reflect.DeepEqual(first, third) {
+		t.Errorf("ipBlocklists with different modes are equal")
+	}
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var defaultLatencyHistogramBucketsMilliseconds = []float64{1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+const (
+	queryOutcomeCacheHit  = "cacheHit"
+	queryOutcomeCacheMiss = "cacheMiss"
+	queryOutcomeStale     = "stale"
+	queryOutcomeBlocked   = "blocked"
+	queryOutcomeLocalZone = "localZone"
+	queryOutcomeError     = "error"
+)
+
+var queryOutcomes = []string{
+	queryOutcomeCacheHit,
+	queryOutcomeCacheMiss,
+	queryOutcomeStale,
+	queryOutcomeBlocked,
+	queryOutcomeLocalZone,
+	queryOutcomeError,
+}
+
+// latencyHistogram counts observations in buckets with upper bounds, plus a final
+// bucket for observations above the last bound.
+type latencyHistogram struct {
+	upperBounds   []time.Duration
+	bucketCounts  []metricValue
+	sumNanosValue metricValue
+}
+
+func newLatencyHistogram(bucketsMilliseconds []float64) *latencyHistogram {
+	if len(bucketsMilliseconds) == 0 {
+		bucketsMilliseconds = defaultLatencyHistogramBucketsMilliseconds
+	}
+
+	upperBounds := make([]time.Duration, 0, len(bucketsMilliseconds))
+	for _, bucketMilliseconds := range bucketsMilliseconds {
+		upperBounds = append(upperBounds, time.Duration(bucketMilliseconds*float64(time.Millisecond)))
+	}
+	sort.Slice(upperBounds, func(i, j int) bool {
+		return upperBounds[i] < upperBounds[j]
+	})
+
+	return &latencyHistogram{
+		upperBounds:  upperBounds,
+		bucketCounts: make([]metricValue, len(upperBounds)+1),
+	}
+}
+
+func (latencyHistogram *latencyHistogram) observe(latency time.Duration) {
+	bucket := sort.Search(len(latencyHistogram.upperBounds), func(i int) bool {
+		return latency <= latencyHistogram.upperBounds[i]
+	})
+
+	latencyHistogram.bucketCounts[bucket].incrementCount()
+	latencyHistogram.sumNanosValue.addCount(uint64(latency))
+}
+
+func (latencyHistogram *latencyHistogram) observeSince(startTime time.Time) {
+	latencyHistogram.observe(time.Since(startTime))
+}
+
+type latencyHistogramSnapshot struct {
+	upperBounds  []time.Duration
+	bucketCounts []uint64
+	sum          time.Duration
+	count        uint64
+}
+
+func (latencyHistogram *latencyHistogram) snapshot() *latencyHistogramSnapshot {
+	bucketCounts := make([]uint64, len(latencyHistogram.bucketCounts))
+	var count uint64
+	for i := range latencyHistogram.bucketCounts {
+		bucketCounts[i] = latencyHistogram.bucketCounts[i].loadCount()
+		count += bucketCounts[i]
+	}
+
+	return &latencyHistogramSnapshot{
+		upperBounds:  latencyHistogram.upperBounds,
+		bucketCounts: bucketCounts,
+		sum:          time.Duration(latencyHistogram.sumNanosValue.loadCount()),
+		count:        count,
+	}
+}
+
+// percentile estimates the latency at percentile (0-100) by linear interpolation
+// within the bucket containing it.
+func (snapshot *latencyHistogramSnapshot) percentile(percentile float64) time.Duration {
+	if snapshot.count == 0 {
+		return 0
+	}
+
+	rank := (percentile / 100) * float64(snapshot.count)
+
+	var cumulativeCount uint64
+	for i, bucketCount := range snapshot.bucketCounts {
+		previousCumulativeCount := cumulativeCount
+		cumulativeCount += bucketCount
+
+		if (bucketCount == 0) || (float64(cumulativeCount) < rank) {
+			continue
+		}
+
+		if i >= len(snapshot.upperBounds) {
+			return snapshot.upperBounds[len(snapshot.upperBounds)-1]
+		}
+
+		var lowerBound time.Duration
+		if i > 0 {
+			lowerBound = snapshot.upperBounds[i-1]
+		}
+		upperBound := snapshot.upperBounds[i]
+
+		fraction := (rank - float64(previousCumulativeCount)) / float64(bucketCount)
+		return lowerBound + time.Duration(fraction*float64(upperBound-lowerBound))
+	}
+
+	return snapshot.upperBounds[len(snapshot.upperBounds)-1]
+}
+
+func (snapshot *latencyHistogramSnapshot) String() string {
+	return fmt.Sprintf("count = %v p50 = %v p90 = %v p99 = %v",
+		snapshot.count, snapshot.percentile(50), snapshot.percentile(90), snapshot.percentile(99))
+}
+
+func formatPrometheusSeconds(duration time.Duration) string {
+	return strconv.FormatFloat(duration.Seconds(), 'g', -1, 64)
+}
+
+// writeHistogram writes one prometheus histogram series, labels are name="value" pairs.
+func (prometheusWriter *prometheusWriter) writeHistogram(name string, labels []string, snapshot *latencyHistogramSnapshot) {
+	labelPrefix := ""
+	if len(labels) > 0 {
+		labelPrefix = strings.Join(labels, ",") + ","
+	}
+
+	var cumulativeCount uint64
+	for i, bucketCount := range snapshot.bucketCounts {
+		cumulativeCount += bucketCount
+
+		le := "+Inf"
+		if i < len(snapshot.upperBounds) {
+			le = formatPrometheusSeconds(snapshot.upperBounds[i])
+		}
+
+		fmt.Fprintf(prometheusWriter.writer, "%s%s_bucket{%sle=\"%s\"} %v\n", prometheusMetricPrefix, name, labelPrefix, le, cumulativeCount)
+	}
+
+	labelString := ""
+	if len(labels) > 0 {
+		labelString = "{" + strings.Join(labels, ",") + "}"
+	}
+	fmt.Fprintf(prometheusWriter.writer, "%s%s_sum%s %s\n", prometheusMetricPrefix, name, labelString, formatPrometheusSeconds(snapshot.sum))
+	fmt.Fprintf(prometheusWriter.writer, "%s%s_count%s %v\n", prometheusMetricPrefix, name, labelString, cumulativeCount)
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+	"time"
+)
+
+// newTestLatencyHistogram returns a histogram with 10ms, 100ms, and 1s buckets holding
+// 50 observations of 5ms, 40 of 50ms, 9 of 500ms, and 1 of 2s.
+func newTestLatencyHistogram() *latencyHistogram {
+	latencyHistogram := newLatencyHistogram([]float64{1000, 10, 100})
+
+	for i := 0; i < 50; i++ {
+		latencyHistogram.observe(5 * time.Millisecond)
+	}
+	for i := 0; i < 40; i++ {
+		latencyHistogram.observe(50 * time.Millisecond)
+	}
+	for i := 0; i < 9; i++ {
+		latencyHistogram.observe(500 * time.Millisecond)
+	}
+	latencyHistogram.observe(2 * time.Second)
+
+	return latencyHistogram
+}
+
+func TestLatencyHistogramObserve(t *testing.T) {
+	latencyHistogram := newLatencyHistogram([]float64{10, 100})
+
+	latencyHistogram.observe(10 * time.Millisecond)
+	latencyHistogram.observe(10*time.Millisecond + 1)
+	latencyHistogram.observe(time.Hour)
+
+	snapshot := latencyHistogram.snapshot()
+	wantBucketCounts := []uint64{1, 1, 1}
+	for i := range wantBucketCounts {
+		if snapshot.bucketCounts[i] != wantBucketCounts[i] {
+			t.Errorf("bucketCounts = %v, want %v", snapshot.bucketCounts, wantBucketCounts)
+			break
+		}
+	}
+	if snapshot.count != 3 {
+		t.Errorf("count = %v, want 3", snapshot.count)
+	}
+	if wantSum := 20*time.Millisecond + 1 + time.Hour; snapshot.sum != wantSum {
+		t.Errorf("sum = %v, want %v", snapshot.sum, wantSum)
+	}
+}
+
+func TestLatencyHistogramPercentile(t *testing.T) {
+	snapshot := newTestLatencyHistogram().snapshot()
+
+	tests := []struct {
+		percentile float64
+		want       time.Duration
+	}{
+		{percentile: 25, want: 5 * time.Millisecond},
+		{percentile: 50, want: 10 * time.Millisecond},
+		{percentile: 70, want: 55 * time.Millisecond},
+		{percentile: 90, want: 100 * time.Millisecond},
+		{percentile: 99, want: time.Second},
+		// the overflow bucket has no upper bound
+		{percentile: 100, want: time.Second},
+	}
+
+	for _, test := range tests {
+		if got := snapshot.percentile(test.percentile); got != test.want {
+			t.Errorf("percentile(%v) = %v, want %v", test.percentile, got, test.want)
+		}
+	}
+
+	if got := newLatencyHistogram(nil).snapshot().percentile(50); got != 0 {
+		t.Errorf("empty histogram percentile(50) = %v, want 0", got)
+	}
+
+	if got, want := snapshot.String(), "count = 100 p50 = 10ms p90 = 100ms p99 = 1s"; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+}
+
+func TestWriteHistogram(t *testing.T) {
+	snapshot := newTestLatencyHistogram().snapshot()
+
+	tests := []struct {
+		name   string
+		labels []string
+		want   string
+	}{
+		{
+			name: "no labels",
+			want: `dohproxy_latency_seconds_bucket{le="0.01"} 50
+dohproxy_latency_seconds_bucket{le="0.1"} 90
+dohproxy_latency_seconds_bucket{le="1"} 99
+dohproxy_latency_seconds_bucket{le="+Inf"} 100
+dohproxy_latency_seconds_sum 8.75
+dohproxy_latency_seconds_count 100
+`,
+		},
+		{
+			name:   "labels",
+			labels: []string{`outcome="cacheHit"`},
+			want: `dohproxy_latency_seconds_bucket{outcome="cacheHit",le="0.01"} 50
+dohproxy_latency_seconds_bucket{outcome="cacheHit",le="0.1"} 90
+dohproxy_latency_seconds_bucket{outcome="cacheHit",le="1"} 99
+dohproxy_latency_seconds_bucket{outcome="cacheHit",le="+Inf"} 100
+dohproxy_latency_seconds_sum{outcome="cacheHit"} 8.75
+dohproxy_latency_seconds_count{outcome="cacheHit"} 100
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			prometheusWriter := &prometheusWriter{
+				writer: bufio.NewWriter(&buffer),
+			}
+			prometheusWriter.writeHistogram("latency_seconds", test.labels, snapshot)
+			prometheusWriter.writer.Flush()
+
+			if got := buffer.String(); got != test.want {
+				t.Errorf("writeHistogram =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const prometheusMetricPrefix = "dohproxy_"
+
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metricGauge struct {
+	name      string
+	help      string
+	valueFunc func() int64
+}
+
+type prometheusWriter struct {
+	writer *bufio.Writer
+}
+
+func escapePrometheusLabelValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return value
+}
+
+func (prometheusWriter *prometheusWriter) writeHeader(name, metricType, help string) {
+	fmt.Fprintf(prometheusWriter.writer, "# HELP %s%s %s\n", prometheusMetricPrefix, name, help)
+	fmt.Fprintf(prometheusWriter.writer, "# TYPE %s%s %s\n", prometheusMetricPrefix, name, metricType)
+}
+
+func (prometheusWriter *prometheusWriter) writeValue(name string, value interface{}) {
+	fmt.Fprintf(prometheusWriter.writer, "%s%s %v\n", prometheusMetricPrefix, name, value)
+}
+
+func (prometheusWriter *prometheusWriter) writeLabeledValue(name, labelName, labelValue string, value interface{}) {
+	fmt.Fprintf(prometheusWriter.writer, "%s%s{%s=\"%s\"} %v\n", prometheusMetricPrefix, name, labelName, escapePrometheusLabelValue(labelValue), value)
+}
+
+func (prometheusWriter *prometheusWriter) writeCounter(name, help string, value uint64) {
+	prometheusWriter.writeHeader(name, "counter", help)
+	prometheusWriter.writeValue(name, value)
+}
+
+func (prometheusWriter *prometheusWriter) writeLabeledCounters(name, help, labelName string, values map[string]uint64) {
+	labelValues := make([]string, 0, len(values))
+	for labelValue := range values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+
+	prometheusWriter.writeHeader(name, "counter", help)
+	for _, labelValue := range labelValues {
+		prometheusWriter.writeLabeledValue(name, labelName, labelValue, values[labelValue])
+	}
+}
+
+// writePrometheusMetrics writes all metrics in the prometheus text exposition format.
+func (metrics *metrics) writePrometheusMetrics(writer io.Writer) error {
+	prometheusWriter := &prometheusWriter{
+		writer: bufio.NewWriter(writer),
+	}
+
+	prometheusWriter.writeCounter("blocked_total", "Queries answered for blocked domains.", metrics.blocked())
+	prometheusWriter.writeCounter("blocked_by_cname_total", "Upstream responses blocked because a CNAME target is a blocked domain.", metrics.blockedByCNAME())
+	prometheusWriter.writeCounter("blocked_by_address_total", "Queries blocked because an upstream answer address is in the IP blocklist.", metrics.blockedByAddress())
+	prometheusWriter.writeCounter("blocked_by_schedule_total", "Queries blocked by an active blocking schedule.", metrics.blockedBySchedule())
+	prometheusWriter.writeCounter("stripped_address_records_total", "Upstream answer records removed because their address is in the IP blocklist.", metrics.strippedAddressRecords())
+	prometheusWriter.writeCounter("allowlist_overrides_total", "Queries for blocked domains allowed by the allowlist.", metrics.allowlistOverrides())
+	prometheusWriter.writeCounter("blocklist_source_errors_total", "Failed blocklist source downloads and reads.", metrics.blocklistSourceErrors())
+	prometheusWriter.writeCounter("cache_hits_total", "Queries answered from the cache.", metrics.cacheHits())
+	prometheusWriter.writeCounter("cache_misses_total", "Queries not found in the cache.", metrics.cacheMisses())
+	prometheusWriter.writeCounter("prefetch_requests_total", "Upstream requests made by prefetch.", metrics.prefetchRequests())
+	prometheusWriter.writeCounter("coalesced_requests_total", "Requests that waited for an identical in-flight upstream request.", metrics.coalescedRequests())
+	prometheusWriter.writeCounter("stale_responses_total", "Stale responses served after upstream errors.", metrics.staleResponses())
+	prometheusWriter.writeCounter("query_log_dropped_total", "Query log entries dropped because the writer was behind.", metrics.queryLogDropped())
+	prometheusWriter.writeCounter("dnstap_dropped_total", "dnstap messages dropped because the writer was behind or not connected.", metrics.dnstapDropped())
+	prometheusWriter.writeCounter("doh_client_errors_total", "Failed upstream DoH requests.", metrics.dohClientErrors())
+	prometheusWriter.writeCounter("write_response_errors_total", "Errors writing responses to clients.", metrics.writeResponseErrors())
+
+	prometheusWriter.writeLabeledCounters("rcode_total", "Upstream responses by rcode.", "rcode", metrics.rcodeMetricsMapSnapshot())
+
+	rrTypeValues := make(map[string]uint64)
+	for rrType, count := range metrics.rrTypeMetricsMapSnapshot() {
+		rrTypeValues[rrType.String()] = count
+	}
+	prometheusWriter.writeLabeledCounters("rr_type_total", "Upstream answer records by type.", "type", rrTypeValues)
+
+	upstreamSuccessValues := make(map[string]uint64)
+	upstreamErrorsValues := make(map[string]uint64)
+	upstreamLatencyValues := make(map[string]uint64)
+	metrics.upstreamMetricsMap.Range(func(key, value interface{}) bool {
+		upstreamName := key.(string)
+		upstreamMetrics := value.(*upstreamMetrics)
+		upstreamSuccessValues[upstreamName] = upstreamMetrics.successValue.loadCount()
+		upstreamErrorsValues[upstreamName] = upstreamMetrics.errorsValue.loadCount()
+		upstreamLatencyValues[upstreamName] = upstreamMetrics.totalLatencyMicrosecondsValue.loadCount()
+		return true
+	})
+	prometheusWriter.writeLabeledCounters("upstream_success_total", "Successful requests by upstream.", "upstream", upstreamSuccessValues)
+	prometheusWriter.writeLabeledCounters("upstream_errors_total", "Failed requests by upstream.", "upstream", upstreamErrorsValues)
+	prometheusWriter.writeLabeledCounters("upstream_latency_microseconds_total", "Total latency of successful requests by upstream.", "upstream", upstreamLatencyValues)
+
+	clientGroupQueriesValues := make(map[string]uint64)
+	clientGroupBlockedValues := make(map[string]uint64)
+	metrics.clientGroupMetricsMap.Range(func(key, value interface{}) bool {
+		clientGroupName := key.(string)
+		clientGroupMetrics := value.(*clientGroupMetrics)
+		clientGroupQueriesValues[clientGroupName] = clientGroupMetrics.queriesValue.loadCount()
+		clientGroupBlockedValues[clientGroupName] = clientGroupMetrics.blockedValue.loadCount()
+		return true
+	})
+	prometheusWriter.writeLabeledCounters("client_group_queries_total", "Client queries by client group.", "client_group", clientGroupQueriesValues)
+	prometheusWriter.writeLabeledCounters("client_group_blocked_total", "Blocked client queries by client group.", "client_group", clientGroupBlockedValues)
+
+	prometheusWriter.writeHeader("query_latency_seconds", "histogram", "Time to serve client queries by outcome.")
+	for _, queryOutcome := range queryOutcomes {
+		labels := []string{fmt.Sprintf("outcome=\"%s\"", queryOutcome)}
+		prometheusWriter.writeHistogram("query_latency_seconds", labels, metrics.queryLatencyHistograms[queryOutcome].snapshot())
+	}
+
+	prometheusWriter.writeHeader("doh_request_latency_seconds", "histogram", "Upstream DoH request round trip time.")
+	prometheusWriter.writeHistogram("doh_request_latency_seconds", nil, metrics.dohRequestLatencyHistogram.snapshot())
+
+	prometheusWriter.writeHeader("semaphore_wait_latency_seconds", "histogram", "Time waiting for the DoH client semaphore.")
+	prometheusWriter.writeHistogram("semaphore_wait_latency_seconds", nil, metrics.semaphoreWaitLatencyHistogram.snapshot())
+
+	for _, gauge := range metrics.gauges {
+		prometheusWriter.writeHeader(gauge.name, "gauge", gauge.help)
+		prometheusWriter.writeValue(gauge.name, gauge.valueFunc())
+	}
+
+	return prometheusWriter.writer.Flush()
+}
+
+func (metrics *metrics) prometheusHandlerFunc() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", prometheusContentType)
+		if err := metrics.writePrometheusMetrics(w); err != nil {
+			log.Printf("writePrometheusMetrics error: %v", err)
+		}
+	}
+}
+
+// startHTTPServer serves /metrics on the configured listen address.  A bind failure is logged
+// and the proxy runs without the metrics endpoint.
+func (metrics *metrics) startHTTPServer() {
+	if len(metrics.configuration.ListenAddress) == 0 {
+		return
+	}
+
+	log.Printf("metrics starting http server on %v", metrics.configuration.ListenAddress)
+
+	listener, err := net.Listen("tcp", metrics.configuration.ListenAddress)
+	if err != nil {
+		log.Printf("metrics net.Listen error, not serving metrics: %v", err)
+		return
+	}
+
+	serveMux := http.NewServeMux()
+	serveMux.Handle("/metrics", metrics.prometheusHandlerFunc())
+
+	metrics.httpServer = &http.Server{
+		Handler:      serveMux,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		if err := metrics.httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("metrics http.Serve error: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestWritePrometheusMetrics(t *testing.T) {
+	metrics := newMetrics(&MetricsConfiguration{})
+
+	metrics.incrementBlocked()
+	metrics.incrementBlocked()
+	metrics.incrementCacheHits()
+	metrics.recordRcodeMetric(dns.RcodeSuccess)
+	metrics.recordRcodeMetric(dns.RcodeNameError)
+	metrics.recordRcodeMetric(dns.RcodeSuccess)
+	metrics.recordRRTypeMetric(dns.Type(dns.TypeAAAA))
+	metrics.recordUpstreamError(`quad"9\`)
+	metrics.addGauge("cache_size", "Entries in the response cache.", func() int64 {
+		return 42
+	})
+
+	var buffer bytes.Buffer
+	if err := metrics.writePrometheusMetrics(&buffer); err != nil {
+		t.Fatalf("writePrometheusMetrics error: %v", err)
+	}
+	output := buffer.String()
+
+	for _, wantLines := range []string{
+		"# HELP dohproxy_blocked_total Queries answered for blocked domains.\n# TYPE dohproxy_blocked_total counter\ndohproxy_blocked_total 2\n",
+		"dohproxy_cache_hits_total 1\n",
+		"dohproxy_cache_misses_total 0\n",
+		"# TYPE dohproxy_rcode_total counter\ndohproxy_rcode_total{rcode=\"NOERROR\"} 2\ndohproxy_rcode_total{rcode=\"NXDOMAIN\"} 1\n",
+		"dohproxy_rr_type_total{type=\"AAAA\"} 1\n",
+		`dohproxy_upstream_errors_total{upstream="quad\"9\\"} 1` + "\n",
+		"# HELP dohproxy_cache_size Entries in the response cache.\n# TYPE dohproxy_cache_size gauge\ndohproxy_cache_size 42\n",
+	} {
+		if !strings.Contains(output, wantLines) {
+			t.Errorf("output missing %q", wantLines)
+		}
+	}
+
+	// every sample follows the TYPE line of its metric family
+	typedFamilies := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSuffix(output, "\n"), "\n") {
+		if strings.HasPrefix(line, "# TYPE ") {
+			typedFamilies[strings.Fields(line)[2]] = true
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name := strings.FieldsFunc(line, func(r rune) bool { return (r == '{') || (r == ' ') })[0]
+		family := name
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if trimmed := strings.TrimSuffix(name, suffix); (trimmed != name) && typedFamilies[trimmed] {
+				family = trimmed
+			}
+		}
+		if !typedFamilies[family] {
+			t.Errorf("sample %q has no TYPE line", line)
+		}
+	}
+}
+
+func TestPrometheusHandler(t *testing.T) {
+	metrics := newMetrics(&MetricsConfiguration{})
+	metrics.incrementCacheMisses()
+
+	recorder := httptest.NewRecorder()
+	metrics.prometheusHandlerFunc()(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != prometheusContentType {
+		t.Errorf("Content-Type = %q, want %q", contentType, prometheusContentType)
+	}
+	if body := recorder.Body.String(); !strings.Contains(body, "dohproxy_cache_misses_total 1\n") {
+		t.Errorf("body missing cache_misses_total, got %q", body)
+	}
+}
+
+func TestMetricsHTTPServer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	address := listener.Addr().String()
+
+	t.Run("address in use", func(t *testing.T) {
+		metrics := newMetrics(&MetricsConfiguration{ListenAddress: address})
+		metrics.startHTTPServer()
+
+		if metrics.httpServer != nil {
+			t.Errorf("httpServer started on an address in use")
+		}
+	})
+
+	listener.Close()
+
+	t.Run("serves metrics", func(t *testing.T) {
+		metrics := newMetrics(&MetricsConfiguration{ListenAddress: address})
+		metrics.startHTTPServer()
+		defer metrics.httpServer.Close()
+
+		response, err := http.Get("http://" + address + "/metrics")
+		if err != nil {
+			t.Fatalf("http.Get error: %v", err)
+		}
+		defer response.Body.Close()
+
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatalf("ioutil.ReadAll error: %v", err)
+		}
+		if !strings.Contains(string(body), "dohproxy_blocked_total 0\n") {
+			t.Errorf("body missing blocked_total, got %q", body)
+		}
+	})
+}
@@ -1,8 +1,10 @@
 package proxy
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,28 +26,98 @@ func (metricValue *metricValue) incrementCount() {
 	atomic.AddUint64(&(metricValue.count), 1)
 }
 
+func (metricValue *metricValue) addCount(delta uint64) {
+	atomic.AddUint64(&(metricValue.count), delta)
+}
+
 func (metricValue *metricValue) loadCount() uint64 {
 	return atomic.LoadUint64(&(metricValue.count))
 }
 
+type upstreamMetrics struct {
+	successValue                  metricValue
+	errorsValue                   metricValue
+	totalLatencyMicrosecondsValue metricValue
+}
+
+func (upstreamMetrics *upstreamMetrics) String() string {
+	success := upstreamMetrics.successValue.loadCount()
+
+	var averageLatency time.Duration
+	if success > 0 {
+		averageLatency = time.Duration(upstreamMetrics.totalLatencyMicrosecondsValue.loadCount()/success) * time.Microsecond
+	}
+
+	return fmt.Sprintf("success = %v errors = %v averageLatency = %v",
+		success, upstreamMetrics.errorsValue.loadCount(), averageLatency)
+}
+
+type clientGroupMetrics struct {
+	queriesValue metricValue
+	blockedValue metricValue
+}
+
+func (clientGroupMetrics *clientGroupMetrics) String() string {
+	return fmt.Sprintf("queries = %v blocked = %v",
+		clientGroupMetrics.queriesValue.loadCount(), clientGroupMetrics.blockedValue.loadCount())
+}
+
 type metrics struct {
-	configuration            *MetricsConfiguration
-	blockedValue             metricValue
-	cacheHitsValue           metricValue
-	cacheMissesValue         metricValue
-	prefetchRequestsValue    metricValue
-	dohClientErrorsValue     metricValue
-	writeResponseErrorsValue metricValue
-	rcodeMetricsMap          sync.Map
-	rrTypeMetricsMap         sync.Map
+	configuration                 *MetricsConfiguration
+	backgroundTask                *backgroundTask
+	blockedValue                  metricValue
+	blockedByCNAMEValue           metricValue
+	blockedByAddressValue         metricValue
+	blockedByScheduleValue        metricValue
+	strippedAddressRecordsValue   metricValue
+	allowlistOverridesValue       metricValue
+	blocklistSourceErrorsValue    metricValue
+	cacheHitsValue                metricValue
+	cacheMissesValue              metricValue
+	prefetchRequestsValue         metricValue
+	coalescedRequestsValue        metricValue
+	staleResponsesValue           metricValue
+	queryLogDroppedValue          metricValue
+	dnstapDroppedValue            metricValue
+	dohClientErrorsValue          metricValue
+	writeResponseErrorsValue      metricValue
+	rcodeMetricsMap               sync.Map
+	rrTypeMetricsMap              sync.Map
+	upstreamMetricsMap            sync.Map
+	clientGroupMetricsMap         sync.Map
+	queryLatencyHistograms        map[string]*latencyHistogram
+	dohRequestLatencyHistogram    *latencyHistogram
+	semaphoreWaitLatencyHistogram *latencyHistogram
+	gauges                        []metricGauge
+	httpServer                    *http.Server
 }
 
 func newMetrics(configuration *MetricsConfiguration) *metrics {
+	bucketsMilliseconds := configuration.LatencyHistogramBucketsMilliseconds
+
+	queryLatencyHistograms := make(map[string]*latencyHistogram)
+	for _, queryOutcome := range queryOutcomes {
+		queryLatencyHistograms[queryOutcome] = newLatencyHistogram(bucketsMilliseconds)
+	}
+
 	return &metrics{
-		configuration: configuration,
+		configuration:                 configuration,
+		backgroundTask:                newBackgroundTask(),
+		queryLatencyHistograms:        queryLatencyHistograms,
+		dohRequestLatencyHistogram:    newLatencyHistogram(bucketsMilliseconds),
+		semaphoreWaitLatencyHistogram: newLatencyHistogram(bucketsMilliseconds),
 	}
 }
 
+// addGauge adds a gauge read when metrics are exported, must be called before start.
+func (metrics *metrics) addGauge(name, help string, valueFunc func() int64) {
+	metrics.gauges = append(metrics.gauges, metricGauge{
+		name:      name,
+		help:      help,
+		valueFunc: valueFunc,
+	})
+}
+
 func (metrics *metrics) incrementBlocked() {
 	metrics.blockedValue.incrementCount()
 }
@@ -54,6 +126,54 @@ func (metrics *metrics) blocked() uint64 {
 	return metrics.blockedValue.loadCount()
 }
 
+func (metrics *metrics) incrementBlockedByCNAME() {
+	metrics.blockedByCNAMEValue.incrementCount()
+}
+
+func (metrics *metrics) blockedByCNAME() uint64 {
+	return metrics.blockedByCNAMEValue.loadCount()
+}
+
+func (metrics *metrics) incrementBlockedByAddress() {
+	metrics.blockedByAddressValue.incrementCount()
+}
+
+func (metrics *metrics) blockedByAddress() uint64 {
+	return metrics.blockedByAddressValue.loadCount()
+}
+
+func (metrics *metrics) incrementBlockedBySchedule() {
+	metrics.blockedByScheduleValue.incrementCount()
+}
+
+func (metrics *metrics) blockedBySchedule() uint64 {
+	return metrics.blockedByScheduleValue.loadCount()
+}
+
+func (metrics *metrics) addStrippedAddressRecords(records int) {
+	metrics.strippedAddressRecordsValue.addCount(uint64(records))
+}
+
+func (metrics *metrics) strippedAddressRecords() uint64 {
+	return metrics.strippedAddressRecordsValue.loadCount()
+}
+
+func (metrics *metrics) incrementAllowlistOverrides() {
+	metrics.allowlistOverridesValue.incrementCount()
+}
+
+func (metrics *metrics) allowlistOverrides() uint64 {
+	return metrics.allowlistOverridesValue.loadCount()
+}
+
+func (metrics *metrics) incrementBlocklistSourceErrors() {
+	metrics.blocklistSourceErrorsValue.incrementCount()
+}
+
+func (metrics *metrics) blocklistSourceErrors() uint64 {
+	return metrics.blocklistSourceErrorsValue.loadCount()
+}
+
 func (metrics *metrics) incrementCacheHits() {
 	metrics.cacheHitsValue.incrementCount()
 }
@@ -78,6 +198,38 @@ func (metrics *metrics) prefetchRequests() uint64 {
 	return metrics.prefetchRequestsValue.loadCount()
 }
 
+func (metrics *metrics) incrementCoalescedRequests() {
+	metrics.coalescedRequestsValue.incrementCount()
+}
+
+func (metrics *metrics) coalescedRequests() uint64 {
+	return metrics.coalescedRequestsValue.loadCount()
+}
+
+func (metrics *metrics) incrementStaleResponses() {
+	metrics.staleResponsesValue.incrementCount()
+}
+
+func (metrics *metrics) staleResponses() uint64 {
+	return metrics.staleResponsesValue.loadCount()
+}
+
+func (metrics *metrics) incrementQueryLogDropped() {
+	metrics.queryLogDroppedValue.incrementCount()
+}
+
+func (metrics *metrics) queryLogDropped() uint64 {
+	return metrics.queryLogDroppedValue.loadCount()
+}
+
+func (metrics *metrics) incrementDNSTapDropped() {
+	metrics.dnstapDroppedValue.incrementCount()
+}
+
+func (metrics *metrics) dnstapDropped() uint64 {
+	return metrics.dnstapDroppedValue.loadCount()
+}
+
 func (metrics *metrics) incrementDOHClientErrors() {
 	metrics.dohClientErrorsValue.incrementCount()
 }
@@ -152,26 +304,147 @@ func (metrics *metrics) rrTypeMetricsMapSnapshot() map[dns.Type]uint64 {
 	return localMap
 }
 
+func (metrics *metrics) getUpstreamMetrics(upstreamName string) *upstreamMetrics {
+
+	value, loaded := metrics.upstreamMetricsMap.Load(upstreamName)
+
+	if !loaded {
+		value, _ = metrics.upstreamMetricsMap.LoadOrStore(upstreamName, new(upstreamMetrics))
+	}
+
+	return value.(*upstreamMetrics)
+}
+
+func (metrics *metrics) recordUpstreamSuccess(upstreamName string, latency time.Duration) {
+	upstreamMetrics := metrics.getUpstreamMetrics(upstreamName)
+	upstreamMetrics.successValue.incrementCount()
+	upstreamMetrics.totalLatencyMicrosecondsValue.addCount(uint64(latency / time.Microsecond))
+}
+
+func (metrics *metrics) recordUpstreamError(upstreamName string) {
+	metrics.getUpstreamMetrics(upstreamName).errorsValue.incrementCount()
+}
+
+func (metrics *metrics) upstreamMetricsMapSnapshot() map[string]string {
+
+	localMap := make(map[string]string)
+
+	metrics.upstreamMetricsMap.Range(func(key, value interface{}) bool {
+		upstreamName := key.(string)
+		upstreamMetrics := value.(*upstreamMetrics)
+		localMap[upstreamName] = upstreamMetrics.String()
+		return true
+	})
+
+	return localMap
+}
+
+func (metrics *metrics) getClientGroupMetrics(clientGroupName string) *clientGroupMetrics {
+
+	value, loaded := metrics.clientGroupMetricsMap.Load(clientGroupName)
+
+	if !loaded {
+		value, _ = metrics.clientGroupMetricsMap.LoadOrStore(clientGroupName, new(clientGroupMetrics))
+	}
+
+	return value.(*clientGroupMetrics)
+}
+
+// recordClientGroupQuery counts a client query and whether it was blocked by client group.
+func (metrics *metrics) recordClientGroupQuery(clientGroupName, queryOutcome string) {
+	clientGroupMetrics := metrics.getClientGroupMetrics(clientGroupName)
+	clientGroupMetrics.queriesValue.incrementCount()
+	if queryOutcome == queryOutcomeBlocked {
+		clientGroupMetrics.blockedValue.incrementCount()
+	}
+}
+
+func (metrics *metrics) clientGroupMetricsMapSnapshot() map[string]string {
+
+	localMap := make(map[string]string)
+
+	metrics.clientGroupMetricsMap.Range(func(key, value interface{}) bool {
+		clientGroupName := key.(string)
+		clientGroupMetrics := value.(*clientGroupMetrics)
+		localMap[clientGroupName] = clientGroupMetrics.String()
+		return true
+	})
+
+	return localMap
+}
+
+// recordQueryLatency records the time to serve a client query since startTime.
+// queryLatencyHistograms is not modified after newMetrics so needs no locking.
+func (metrics *metrics) recordQueryLatency(queryOutcome string, startTime time.Time) {
+	metrics.queryLatencyHistograms[queryOutcome].observeSince(startTime)
+}
+
+func (metrics *metrics) recordDOHRequestLatency(latency time.Duration) {
+	metrics.dohRequestLatencyHistogram.observe(latency)
+}
+
+func (metrics *metrics) recordSemaphoreWaitLatency(latency time.Duration) {
+	metrics.semaphoreWaitLatencyHistogram.observe(latency)
+}
+
+func (metrics *metrics) queryLatencySnapshot() map[string]string {
+
+	localMap := make(map[string]string)
+
+	for queryOutcome, histogram := range metrics.queryLatencyHistograms {
+		snapshot := histogram.snapshot()
+		if snapshot.count > 0 {
+			localMap[queryOutcome] = snapshot.String()
+		}
+	}
+
+	return localMap
+}
+
 func (metrics *metrics) String() string {
 	return fmt.Sprintf(
-		"blocked = %v cacheHits = %v cacheMisses = %v prefetchRequests = %v dohClientErrors = %v writeResponseErrors = %v rcodeMetrics = %v rrtypeMetrics = %v",
-		metrics.blocked(), metrics.cacheHits(), metrics.cacheMisses(), metrics.prefetchRequests(),
-		metrics.dohClientErrors(), metrics.writeResponseErrors(),
-		metrics.rcodeMetricsMapSnapshot(), metrics.rrTypeMetricsMapSnapshot())
+		"blocked = %v blockedByCNAME = %v blockedByAddress = %v blockedBySchedule = %v strippedAddressRecords = %v allowlistOverrides = %v blocklistSourceErrors = %v cacheHits = %v cacheMisses = %v prefetchRequests = %v coalescedRequests = %v staleResponses = %v queryLogDropped = %v dnstapDropped = %v dohClientErrors = %v writeResponseErrors = %v rcodeMetrics = %v rrtypeMetrics = %v upstreamMetrics = %v clientGroupMetrics = %v queryLatency = %v dohRequestLatency = {%v} semaphoreWaitLatency = {%v}",
+		metrics.blocked(), metrics.blockedByCNAME(), metrics.blockedByAddress(), metrics.blockedBySchedule(), metrics.strippedAddressRecords(), metrics.allowlistOverrides(), metrics.blocklistSourceErrors(), metrics.cacheHits(), metrics.cacheMisses(), metrics.prefetchRequests(),
+		metrics.coalescedRequests(), metrics.staleResponses(), metrics.queryLogDropped(), metrics.dnstapDropped(), metrics.dohClientErrors(), metrics.writeResponseErrors(),
+		metrics.rcodeMetricsMapSnapshot(), metrics.rrTypeMetricsMapSnapshot(), metrics.upstreamMetricsMapSnapshot(), metrics.clientGroupMetricsMapSnapshot(),
+		metrics.queryLatencySnapshot(), metrics.dohRequestLatencyHistogram.snapshot(), metrics.semaphoreWaitLatencyHistogram.snapshot())
 }
 
 func (metrics *metrics) runPeriodicTimer() {
 	ticker := time.NewTicker(time.Duration(metrics.configuration.TimerIntervalSeconds) * time.Second)
+	defer ticker.Stop()
 
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+			log.Printf("metrics: %v", metrics)
 
-		log.Printf("metrics: %v", metrics)
+		case <-metrics.backgroundTask.stopping():
+			return
+		}
 	}
 }
 
 func (metrics *metrics) start() {
 	log.Printf("metrics.start")
 
-	go metrics.runPeriodicTimer()
+	metrics.backgroundTask.run(metrics.runPeriodicTimer)
+
+	metrics.startHTTPServer()
+}
+
+func (metrics *metrics) stop(ctx context.Context) error {
+	log.Printf("metrics.stop")
+
+	if metrics.httpServer != nil {
+		if err := metrics.httpServer.Shutdown(ctx); err != nil {
+			log.Printf("metrics httpServer.Shutdown error: %v", err)
+		}
+	}
+
+	err := metrics.backgroundTask.stop(ctx)
+
+	log.Printf("final metrics: %v", metrics)
+
+	return err
 }
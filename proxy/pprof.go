@@ -1,12 +1,13 @@
 package proxy
 
 import (
+	"errors"
 	"log"
 	"net/http"
 	"net/http/pprof"
 )
 
-func startPprof(configuration *PprofConfiguration) {
+func startPprof(configuration *PprofConfiguration) (httpServer *http.Server) {
 	if configuration.Enabled {
 		log.Printf("startPprof starting server on %v", configuration.ListenAddress)
 
@@ -18,8 +19,17 @@ func startPprof(configuration *PprofConfiguration) {
 		serveMux.Handle("/debug/pprof/symbol", http.HandlerFunc(pprof.Symbol))
 		serveMux.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
 
+		httpServer = &http.Server{
+			Addr:    configuration.ListenAddress,
+			Handler: serveMux,
+		}
+
 		go func() {
-			log.Fatalf("http.ListenAndServe error: %v", http.ListenAndServe(configuration.ListenAddress, serveMux))
+			if err := httpServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("http.ListenAndServe error: %v", err)
+			}
 		}()
 	}
+
+	return
 }
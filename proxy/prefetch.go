@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"log"
 	"time"
 
@@ -10,6 +11,7 @@ import (
 
 type prefetchCacheEntry struct {
 	question       dns.Question
+	upstreamPolicy upstreamPolicy
 	expirationTime time.Time
 }
 
@@ -18,11 +20,13 @@ func (prefetchCacheEntry *prefetchCacheEntry) expired(now time.Time) bool {
 }
 
 type prefetchRequest struct {
-	cacheKey string
-	question dns.Question
+	cacheKey       string
+	question       dns.Question
+	upstreamPolicy upstreamPolicy
 }
 
 type prefetch struct {
+	backgroundTask        *backgroundTask
 	cacheKeyToQuestion    *lru.Cache
 	prefetchRequstChannel chan *prefetchRequest
 	numWorkers            int
@@ -37,6 +41,7 @@ func newPrefetch(prefetchConfiguration *PrefetchConfiguration) *prefetch {
 	}
 
 	return &prefetch{
+		backgroundTask:        newBackgroundTask(),
 		cacheKeyToQuestion:    cacheKeyToQuestion,
 		prefetchRequstChannel: make(chan *prefetchRequest, prefetchConfiguration.NumWorkers),
 		numWorkers:            prefetchConfiguration.NumWorkers,
@@ -45,9 +50,10 @@ func newPrefetch(prefetchConfiguration *PrefetchConfiguration) *prefetch {
 	}
 }
 
-func (prefetch *prefetch) addToPrefetch(cacheKey string, question *dns.Question) {
+func (prefetch *prefetch) addToPrefetch(cacheKey string, question *dns.Question, upstreamPolicy upstreamPolicy) {
 	prefetch.cacheKeyToQuestion.Add(cacheKey, &prefetchCacheEntry{
 		question:       *question,
+		upstreamPolicy: upstreamPolicy,
 		expirationTime: time.Now().Add(prefetch.maxCacheEntryAge),
 	})
 }
@@ -55,8 +61,15 @@ func (prefetch *prefetch) addToPrefetch(cacheKey string, question *dns.Question)
 func (prefetch *prefetch) runPeriodicPrefetch() {
 	log.Printf("runPeriodicPrefetch sleepInterval %v", prefetch.sleepInterval)
 
+	timer := time.NewTimer(prefetch.sleepInterval)
+	defer timer.Stop()
+
 	for {
-		time.Sleep(prefetch.sleepInterval)
+		select {
+		case <-timer.C:
+		case <-prefetch.backgroundTask.stopping():
+			return
+		}
 
 		log.Printf("runPeriodicPrefetch after sleep")
 
@@ -76,29 +89,40 @@ func (prefetch *prefetch) runPeriodicPrefetch() {
 					prefetch.cacheKeyToQuestion.Remove(cacheKey)
 					expiredPrefetchCacheEntries++
 				} else {
-					prefetch.prefetchRequstChannel <- &prefetchRequest{
-						cacheKey: cacheKey,
-						question: entry.question,
+					select {
+					case prefetch.prefetchRequstChannel <- &prefetchRequest{
+						cacheKey:       cacheKey,
+						question:       entry.question,
+						upstreamPolicy: entry.upstreamPolicy,
+					}:
+					case <-prefetch.backgroundTask.stopping():
+						return
 					}
 				}
 			}
 		}
 
 		log.Printf("runPeriodicPrefetch before sleep cacheKeyToQuestion.Len = %v expiredPrefetchCacheEntries = %v", prefetch.cacheKeyToQuestion.Len(), expiredPrefetchCacheEntries)
+
+		timer.Reset(prefetch.sleepInterval)
 	}
 }
 
 type prefetchRequestor interface {
-	makePrefetchRequest(cacheKey string, question *dns.Question)
+	makePrefetchRequest(cacheKey string, question *dns.Question, upstreamPolicy upstreamPolicy)
 }
 
-func runPrefetchRequestTask(workerNumber int, prefetchRequstChannel chan *prefetchRequest, prefetchRequestor prefetchRequestor) {
+func runPrefetchRequestTask(workerNumber int, prefetchRequstChannel chan *prefetchRequest, stopping <-chan struct{}, prefetchRequestor prefetchRequestor) {
 	log.Printf("runPrefetchRequestTask workerNumber = %v", workerNumber)
 
 	for {
-		prefetchRequest := <-prefetchRequstChannel
+		select {
+		case prefetchRequest := <-prefetchRequstChannel:
+			prefetchRequestor.makePrefetchRequest(prefetchRequest.cacheKey, &prefetchRequest.question, prefetchRequest.upstreamPolicy)
 
-		prefetchRequestor.makePrefetchRequest(prefetchRequest.cacheKey, &prefetchRequest.question)
+		case <-stopping:
+			return
+		}
 	}
 }
 
@@ -106,8 +130,17 @@ func (prefetch *prefetch) start(prefetchRequestor prefetchRequestor) {
 	log.Printf("prefetch.start")
 
 	for i := 0; i < prefetch.numWorkers; i++ {
-		go runPrefetchRequestTask(i, prefetch.prefetchRequstChannel, prefetchRequestor)
+		workerNumber := i
+		prefetch.backgroundTask.run(func() {
+			runPrefetchRequestTask(workerNumber, prefetch.prefetchRequstChannel, prefetch.backgroundTask.stopping(), prefetchRequestor)
+		})
 	}
 
-	go prefetch.runPeriodicPrefetch()
+	prefetch.backgroundTask.run(prefetch.runPeriodicPrefetch)
+}
+
+func (prefetch *prefetch) stop(ctx context.Context) error {
+	log.Printf("prefetch.stop")
+
+	return prefetch.backgroundTask.stop(ctx)
 }
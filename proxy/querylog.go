@@ -0,0 +1,372 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	queryLogModeOff    = "off"
+	queryLogModeErrors = "errors"
+	queryLogModeAll    = "all"
+)
+
+const queryLogChannelSize = 1000
+
+// queryLogBackupTimeFormat is the timestamp suffix of rotated files, it sorts oldest first.
+const queryLogBackupTimeFormat = "20060102-150405.000000"
+
+// queryDetails accumulates information about a client query as it is handled.
+type queryDetails struct {
+	startTime       time.Time
+	upstreamLatency time.Duration
+	blockedReason   string
+	clientGroup     string
+}
+
+func newQueryDetails(clientGroupName string) *queryDetails {
+	return &queryDetails{
+		startTime:   time.Now(),
+		clientGroup: clientGroupName,
+	}
+}
+
+type queryLogEntry struct {
+	Timestamp                   string   `json:"timestamp"`
+	ClientAddress               string   `json:"clientAddress"`
+	ClientGroup                 string   `json:"clientGroup,omitempty"`
+	Protocol                    string   `json:"protocol"`
+	QName                       string   `json:"qname"`
+	QType                       string   `json:"qtype"`
+	Rcode                       string   `json:"rcode"`
+	Answers                     []string `json:"answers,omitempty"`
+	Outcome                     string   `json:"outcome"`
+	CacheHit                    bool     `json:"cacheHit"`
+	UpstreamLatencyMilliseconds float64  `json:"upstreamLatencyMilliseconds,omitempty"`
+	BlockedReason               string   `json:"blockedReason,omitempty"`
+	DurationMilliseconds        float64  `json:"durationMilliseconds"`
+}
+
+func clientAddressAndProtocol(w dns.ResponseWriter) (clientAddress, protocol string) {
+	remoteAddr := w.RemoteAddr()
+	if remoteAddr == nil {
+		return
+	}
+
+	clientAddress = remoteAddr.String()
+	if _, isDOH := w.(*dohResponseWriter); isDOH {
+		if tcpAddr, ok := remoteAddr.(*net.TCPAddr); ok {
+			clientAddress = tcpAddr.IP.String()
+		}
+		protocol = "https"
+		return
+	}
+
+	switch addr := remoteAddr.(type) {
+	case *net.UDPAddr:
+		clientAddress = addr.IP.String()
+		protocol = "udp"
+	case *net.TCPAddr:
+		clientAddress = addr.IP.String()
+		protocol = "tcp"
+		if isDNSOverTLS(w) {
+			protocol = "tcp-tls"
+		}
+	default:
+		protocol = remoteAddr.Network()
+	}
+	return
+}
+
+// summarizeAnswer returns the rdata of an answer record, e.g. "A 192.0.2.1".
+func summarizeAnswer(rr dns.RR) string {
+	return dns.Type(rr.Header().Rrtype).String() + " " + rrData(rr)
+}
+
+func newQueryLogEntry(w dns.ResponseWriter, request, response *dns.Msg, outcome string, queryDetails *queryDetails) *queryLogEntry {
+	now := time.Now()
+
+	entry := &queryLogEntry{
+		Timestamp:            now.Format(time.RFC3339Nano),
+		ClientGroup:          queryDetails.clientGroup,
+		Outcome:              outcome,
+		CacheHit:             (outcome == queryOutcomeCacheHit),
+		BlockedReason:        queryDetails.blockedReason,
+		DurationMilliseconds: float64(now.Sub(queryDetails.startTime)) / float64(time.Millisecond),
+	}
+
+	if queryDetails.upstreamLatency > 0 {
+		entry.UpstreamLatencyMilliseconds = float64(queryDetails.upstreamLatency) / float64(time.Millisecond)
+	}
+
+	entry.ClientAddress, entry.Protocol = clientAddressAndProtocol(w)
+
+	if len(request.Question) > 0 {
+		entry.QName = request.Question[0].Name
+		entry.QType = dns.Type(request.Question[0].Qtype).String()
+	}
+
+	rcode := dns.RcodeServerFailure
+	if response != nil {
+		rcode = response.Rcode
+		for _, rr := range response.Answer {
+			entry.Answers = append(entry.Answers, summarizeAnswer(rr))
+		}
+	}
+	entry.Rcode = dns.RcodeToString[rcode]
+
+	return entry
+}
+
+func (entry *queryLogEntry) isError() bool {
+	return (entry.Outcome == queryOutcomeError) ||
+		((entry.Rcode != dns.RcodeToString[dns.RcodeSuccess]) && (entry.Rcode != dns.RcodeToString[dns.RcodeNameError]))
+}
+
+type queryLog struct {
+	configuration  *QueryLogConfiguration
+	metrics        *metrics
+	backgroundTask *backgroundTask
+	entryChannel   chan *queryLogEntry
+	file           *os.File
+	fileSize       int64
+	// fileStartTime is the time of the first entry in the file, age based rotation starts from it
+	fileStartTime time.Time
+}
+
+func newQueryLog(configuration *QueryLogConfiguration, metrics *metrics) *queryLog {
+	switch configuration.Mode {
+	case "", queryLogModeOff, queryLogModeErrors, queryLogModeAll:
+	default:
+		log.Fatalf("invalid queryLogConfiguration mode %q", configuration.Mode)
+	}
+
+	if (configuration.Mode == queryLogModeErrors || configuration.Mode == queryLogModeAll) && (len(configuration.File) == 0) {
+		log.Fatalf("queryLogConfiguration mode %q requires file", configuration.Mode)
+	}
+
+	return &queryLog{
+		configuration:  configuration,
+		metrics:        metrics,
+		backgroundTask: newBackgroundTask(),
+		entryChannel:   make(chan *queryLogEntry, queryLogChannelSize),
+	}
+}
+
+func (queryLog *queryLog) enabled() bool {
+	return (queryLog.configuration.Mode == queryLogModeErrors) || (queryLog.configuration.Mode == queryLogModeAll)
+}
+
+// logQuery queues an entry for the writer goroutine, entries are dropped if the queue is full.
+func (queryLog *queryLog) logQuery(w dns.ResponseWriter, request, response *dns.Msg, outcome string, queryDetails *queryDetails) {
+	if !queryLog.enabled() {
+		return
+	}
+
+	entry := newQueryLogEntry(w, request, response, outcome, queryDetails)
+
+	if (queryLog.configuration.Mode == queryLogModeErrors) && (!entry.isError()) {
+		return
+	}
+
+	select {
+	case queryLog.entryChannel <- entry:
+	default:
+		queryLog.metrics.incrementQueryLogDropped()
+	}
+}
+
+func (queryLog *queryLog) openFile() error {
+	file, err := os.OpenFile(queryLog.configuration.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("os.OpenFile error: %w", err)
+	}
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("file.Stat error: %w", err)
+	}
+
+	queryLog.file = file
+	queryLog.fileSize = fileInfo.Size()
+	queryLog.fileStartTime = time.Now()
+	if fileInfo.Size() > 0 {
+		queryLog.fileStartTime = existingFileStartTime(queryLog.configuration.File, fileInfo.ModTime())
+	}
+
+	return nil
+}
+
+// existingFileStartTime returns the timestamp of the first entry in an existing log file, or
+// modTime if it cannot be read, so restarts do not reset the age of the file.
+func existingFileStartTime(fileName string, modTime time.Time) time.Time {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return modTime
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return modTime
+	}
+
+	var entry queryLogEntry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return modTime
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, entry.Timestamp)
+	if err != nil {
+		return modTime
+	}
+
+	return timestamp
+}
+
+func (queryLog *queryLog) needsRotation(nextEntryLength int) bool {
+	if (queryLog.configuration.MaxSizeBytes > 0) && (queryLog.fileSize > 0) &&
+		(queryLog.fileSize+int64(nextEntryLength) > queryLog.configuration.MaxSizeBytes) {
+		return true
+	}
+
+	maxAge := time.Duration(queryLog.configuration.MaxAgeSeconds) * time.Second
+	if (maxAge > 0) && (time.Since(queryLog.fileStartTime) > maxAge) {
+		return true
+	}
+
+	return false
+}
+
+// rotate renames the current file with a timestamp suffix and removes old backups
+// beyond MaxBackups.
+func (queryLog *queryLog) rotate() error {
+	queryLog.file.Close()
+	queryLog.file = nil
+
+	backupFile := queryLog.configuration.File + "." + time.Now().Format(queryLogBackupTimeFormat)
+	if err := os.Rename(queryLog.configuration.File, backupFile); err != nil {
+		return fmt.Errorf("os.Rename error: %w", err)
+	}
+
+	if queryLog.configuration.MaxBackups > 0 {
+		backupFiles, err := queryLogBackupFiles(queryLog.configuration.File)
+		if err != nil {
+			return fmt.Errorf("queryLogBackupFiles error: %w", err)
+		}
+
+		for len(backupFiles) > queryLog.configuration.MaxBackups {
+			if err := os.Remove(backupFiles[0]); err != nil {
+				log.Printf("queryLog remove backup error: %v", err)
+			}
+			backupFiles = backupFiles[1:]
+		}
+	}
+
+	return queryLog.openFile()
+}
+
+// queryLogBackupFiles returns the rotated files of fileName oldest first.  Other files with the
+// same prefix, e.g. the query.log.1 of another tool, are not backups.
+func queryLogBackupFiles(fileName string) ([]string, error) {
+	directory := filepath.Dir(fileName)
+	prefix := filepath.Base(fileName) + "."
+
+	fileInfos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, fmt.Errorf("ioutil.ReadDir error: %w", err)
+	}
+
+	var backupFiles []string
+	for _, fileInfo := range fileInfos {
+		name := fileInfo.Name()
+		if fileInfo.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if _, err := time.Parse(queryLogBackupTimeFormat, strings.TrimPrefix(name, prefix)); err != nil {
+			continue
+		}
+		backupFiles = append(backupFiles, filepath.Join(directory, name))
+	}
+
+	// ioutil.ReadDir sorts by name and timestamp suffixes sort oldest first
+	return backupFiles, nil
+}
+
+func (queryLog *queryLog) writeEntry(entry *queryLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("queryLog json.Marshal error: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if queryLog.file == nil {
+		if err := queryLog.openFile(); err != nil {
+			log.Printf("queryLog openFile error: %v", err)
+			return
+		}
+	}
+
+	if queryLog.needsRotation(len(line)) {
+		if err := queryLog.rotate(); err != nil {
+			log.Printf("queryLog rotate error: %v", err)
+			return
+		}
+	}
+
+	n, err := queryLog.file.Write(line)
+	queryLog.fileSize += int64(n)
+	if err != nil {
+		log.Printf("queryLog write error: %v", err)
+	}
+}
+
+func (queryLog *queryLog) runWriter() {
+	for {
+		select {
+		case entry := <-queryLog.entryChannel:
+			queryLog.writeEntry(entry)
+
+		case <-queryLog.backgroundTask.stopping():
+			for {
+				select {
+				case entry := <-queryLog.entryChannel:
+					queryLog.writeEntry(entry)
+				default:
+					if queryLog.file != nil {
+						queryLog.file.Close()
+						queryLog.file = nil
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+func (queryLog *queryLog) start() {
+	log.Printf("queryLog.start mode = %q", queryLog.configuration.Mode)
+
+	if queryLog.enabled() {
+		queryLog.backgroundTask.run(queryLog.runWriter)
+	}
+}
+
+func (queryLog *queryLog) stop(ctx context.Context) error {
+	log.Printf("queryLog.stop")
+
+	return queryLog.backgroundTask.stop(ctx)
+}
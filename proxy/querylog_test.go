@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestQueryLogNeedsRotation(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxSizeBytes    int64
+		maxAgeSeconds   int
+		fileSize        int64
+		fileAge         time.Duration
+		nextEntryLength int
+		want            bool
+	}{
+		{name: "no limits", fileSize: 1 << 30, fileAge: 24 * time.Hour, nextEntryLength: 100, want: false},
+		{name: "below max size", maxSizeBytes: 1000, fileSize: 800, nextEntryLength: 200, want: false},
+		{name: "above max size", maxSizeBytes: 1000, fileSize: 801, nextEntryLength: 200, want: true},
+		{name: "empty file with entry above max size", maxSizeBytes: 100, fileSize: 0, nextEntryLength: 200, want: false},
+		{name: "below max age", maxAgeSeconds: 60, fileAge: 30 * time.Second, nextEntryLength: 100, want: false},
+		{name: "above max age", maxAgeSeconds: 60, fileAge: 90 * time.Second, nextEntryLength: 100, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queryLog := &queryLog{
+				configuration: &QueryLogConfiguration{
+					MaxSizeBytes:  test.maxSizeBytes,
+					MaxAgeSeconds: test.maxAgeSeconds,
+				},
+				fileSize:      test.fileSize,
+				fileStartTime: time.Now().Add(-test.fileAge),
+			}
+
+			if got := queryLog.needsRotation(test.nextEntryLength); got != test.want {
+				t.Errorf("needsRotation = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExistingFileStartTime(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	firstEntryTime := time.Date(2019, 12, 31, 23, 59, 58, 123456789, time.UTC)
+
+	tests := []struct {
+		name     string
+		contents string
+		want     time.Time
+	}{
+		{
+			name:     "first entry timestamp",
+			contents: `{"timestamp":"2019-12-31T23:59:58.123456789Z","qname":"a."}` + "\n" + `{"timestamp":"2020-01-01T00:00:00Z"}` + "\n",
+			want:     firstEntryTime,
+		},
+		{name: "partial first line", contents: `{"timestamp":"2019-12-31T23:59:58.123456789Z"}`, want: modTime},
+		{name: "invalid json", contents: "not json\n", want: modTime},
+		{name: "invalid timestamp", contents: `{"timestamp":"yesterday"}` + "\n", want: modTime},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "query.log")
+			if err := ioutil.WriteFile(file, []byte(test.contents), 0644); err != nil {
+				t.Fatalf("ioutil.WriteFile error: %v", err)
+			}
+
+			if got := existingFileStartTime(file, modTime); !got.Equal(test.want) {
+				t.Errorf("existingFileStartTime = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	if got := existingFileStartTime(filepath.Join(t.TempDir(), "missing.log"), modTime); !got.Equal(modTime) {
+		t.Errorf("existingFileStartTime of missing file = %v, want %v", got, modTime)
+	}
+}
+
+func TestQueryLogRotatePrunesBackups(t *testing.T) {
+	directory := t.TempDir()
+	file := filepath.Join(directory, "query.log")
+
+	oldBackups := []string{
+		"query.log.20200101-000000.000000",
+		"query.log.20200102-000000.000000",
+		"query.log.20200103-000000.000000",
+	}
+	otherFiles := []string{
+		"query.log.1",
+		"query.log.gz",
+		"query.log.20200101-000000.000000.gz",
+		"query.logger",
+		"other.log.20200101-000000.000000",
+	}
+	for _, name := range append(append([]string{"query.log"}, oldBackups...), otherFiles...) {
+		if err := ioutil.WriteFile(filepath.Join(directory, name), []byte("{}\n"), 0644); err != nil {
+			t.Fatalf("ioutil.WriteFile error: %v", err)
+		}
+	}
+
+	queryLog := newQueryLog(&QueryLogConfiguration{
+		Mode:         queryLogModeAll,
+		File:         file,
+		MaxSizeBytes: 1,
+		MaxBackups:   2,
+	}, newMetrics(&MetricsConfiguration{}))
+
+	queryLog.writeEntry(&queryLogEntry{
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+		QName:     "example.com.",
+	})
+	queryLog.file.Close()
+
+	backupFiles, err := queryLogBackupFiles(file)
+	if err != nil {
+		t.Fatalf("queryLogBackupFiles error: %v", err)
+	}
+	if (len(backupFiles) != 2) || (filepath.Base(backupFiles[0]) != oldBackups[2]) {
+		t.Errorf("backupFiles = %v, want %v and the new backup", backupFiles, oldBackups[2])
+	}
+
+	fileInfos, err := ioutil.ReadDir(directory)
+	if err != nil {
+		t.Fatalf("ioutil.ReadDir error: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, fileInfo := range fileInfos {
+		names[fileInfo.Name()] = true
+	}
+	for _, name := range append([]string{"query.log"}, otherFiles...) {
+		if !names[name] {
+			t.Errorf("%v removed", name)
+		}
+	}
+	for _, name := range oldBackups[:2] {
+		if names[name] {
+			t.Errorf("%v not removed", name)
+		}
+	}
+
+	if contents, err := ioutil.ReadFile(file); (err != nil) || (len(contents) == 0) {
+		t.Errorf("new query.log contents = %q, error = %v", contents, err)
+	}
+}
+
+func TestQueryLogBackupFilesSorted(t *testing.T) {
+	directory := t.TempDir()
+	file := filepath.Join(directory, "query.log")
+
+	want := []string{
+		filepath.Join(directory, "query.log.20191231-235959.999999"),
+		filepath.Join(directory, "query.log.20200101-000000.000001"),
+		filepath.Join(directory, "query.log.20200101-000001.000000"),
+	}
+	for _, name := range []string{want[2], want[0], want[1]} {
+		if err := ioutil.WriteFile(name, nil, 0644); err != nil {
+			t.Fatalf("ioutil.WriteFile error: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(directory, "query.log.20200102-000000.000000"), 0755); err != nil {
+		t.Fatalf("os.Mkdir error: %v", err)
+	}
+
+	got, err := queryLogBackupFiles(file)
+	if err != nil {
+		t.Fatalf("queryLogBackupFiles error: %v", err)
+	}
+	if !sort.StringsAreSorted(got) || !reflect.DeepEqual(got, want) {
+		t.Errorf("queryLogBackupFiles = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	scheduleActionEnable  = "enable"
+	scheduleActionDisable = "disable"
+)
+
+const minutesPerDay = 24 * 60
+
+// scheduleDays maps full and three letter lower case day names to weekdays.
+var scheduleDays = func() map[string]time.Weekday {
+	scheduleDays := make(map[string]time.Weekday)
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		name := strings.ToLower(weekday.String())
+		scheduleDays[name] = weekday
+		scheduleDays[name[:3]] = weekday
+	}
+	return scheduleDays
+}()
+
+// scheduleTimeRange is minutes since midnight, end is before start for ranges ending the next day.
+type scheduleTimeRange struct {
+	start int
+	end   int
+}
+
+// parseScheduleTime parses "HH:MM" as minutes since midnight, "24:00" is the end of the day.
+func parseScheduleTime(value string) (int, error) {
+	var hours, minutes int
+	if n, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes); (err != nil) || (n != 2) {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", value)
+	}
+
+	if (hours < 0) || (minutes < 0) || (minutes > 59) || ((hours*60)+minutes > minutesPerDay) {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+
+	return (hours * 60) + minutes, nil
+}
+
+// schedule is the days and time ranges when a schedule is active.
+type schedule struct {
+	location *time.Location
+	// days is nil for every day
+	days       map[time.Weekday]bool
+	timeRanges []scheduleTimeRange
+}
+
+func newSchedule(configuration *ScheduleConfiguration) (*schedule, error) {
+	schedule := &schedule{
+		location: time.Local,
+	}
+
+	if len(configuration.TimeZone) > 0 {
+		location, err := time.LoadLocation(configuration.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("time.LoadLocation error: %w", err)
+		}
+		schedule.location = location
+	}
+
+	if len(configuration.Days) > 0 {
+		schedule.days = make(map[time.Weekday]bool)
+		for _, day := range configuration.Days {
+			weekday, ok := scheduleDays[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("invalid day %q", day)
+			}
+			schedule.days[weekday] = true
+		}
+	}
+
+	if len(configuration.TimeRanges) == 0 {
+		return nil, errors.New("no timeRanges")
+	}
+
+	for _, timeRangeConfiguration := range configuration.TimeRanges {
+		start, err := parseScheduleTime(timeRangeConfiguration.Start)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseScheduleTime(timeRangeConfiguration.End)
+		if err != nil {
+			return nil, err
+		}
+		schedule.timeRanges = append(schedule.timeRanges, scheduleTimeRange{
+			start: start,
+			end:   end,
+		})
+	}
+
+	return schedule, nil
+}
+
+func (schedule *schedule) activeDay(weekday time.Weekday) bool {
+	return (schedule.days == nil) || schedule.days[weekday]
+}
+
+// active returns true if now is in a time range starting on one of the days.
+func (schedule *schedule) active(now time.Time) bool {
+	now = now.In(schedule.location)
+	weekday := now.Weekday()
+	previousWeekday := (weekday + 6) % 7
+	minute := (now.Hour() * 60) + now.Minute()
+
+	for _, timeRange := range schedule.timeRanges {
+		if timeRange.start <= timeRange.end {
+			if schedule.activeDay(weekday) && (minute >= timeRange.start) && (minute < timeRange.end) {
+				return true
+			}
+			continue
+		}
+
+		if (schedule.activeDay(weekday) && (minute >= timeRange.start)) ||
+			(schedule.activeDay(previousWeekday) && (minute < timeRange.end)) {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduledBlocklist is a blocklist that blocks by schedule.
+type scheduledBlocklist struct {
+	name string
+	// clientGroupNames is empty for all client groups
+	clientGroupNames map[string]bool
+	blocklistNames   []string
+	schedule         *schedule
+	blockWhenActive  bool
+	blocklist        *blocklist
+}
+
+func newScheduledBlocklist(configuration *ScheduleConfiguration, namedRules map[string]*blocklistRules, allowlistRules *blocklistRules) (*scheduledBlocklist, error) {
+	if len(configuration.Name) == 0 {
+		return nil, errors.New("schedule name required")
+	}
+
+	schedule, err := newSchedule(configuration)
+	if err != nil {
+		return nil, fmt.Errorf("schedule %q error: %w", configuration.Name, err)
+	}
+
+	scheduledBlocklist := &scheduledBlocklist{
+		name:             configuration.Name,
+		clientGroupNames: make(map[string]bool),
+		blocklistNames:   configuration.Blocklists,
+		schedule:         schedule,
+	}
+
+	switch configuration.Action {
+	case "", scheduleActionEnable:
+		scheduledBlocklist.blockWhenActive = true
+
+	case scheduleActionDisable:
+
+	default:
+		return nil, fmt.Errorf("schedule %q invalid action %q", configuration.Name, configuration.Action)
+	}
+
+	for _, clientGroupName := range configuration.ClientGroups {
+		scheduledBlocklist.clientGroupNames[clientGroupName] = true
+	}
+
+	rulesList := make([]*blocklistRules, 0, len(configuration.Blocklists)+2)
+	for _, name := range configuration.Blocklists {
+		rules, ok := namedRules[name]
+		if !ok {
+			return nil, fmt.Errorf("schedule %q unknown blocklist %q", configuration.Name, name)
+		}
+		rulesList = append(rulesList, rules)
+	}
+
+	var blockedDomainRules blocklistRules
+	blockedDomainRules.parseBlockedDomains(fmt.Sprintf("schedule %q blockedDomains", configuration.Name), configuration.BlockedDomains)
+	rulesList = append(rulesList, &blockedDomainRules, allowlistRules)
+
+	scheduledBlocklist.blocklist = newBlocklist("schedule "+configuration.Name, rulesList)
+
+	return scheduledBlocklist, nil
+}
+
+func (scheduledBlocklist *scheduledBlocklist) appliesTo(clientGroup *clientGroup) bool {
+	return clientGroup.blocking &&
+		((len(scheduledBlocklist.clientGroupNames) == 0) || scheduledBlocklist.clientGroupNames[clientGroup.name])
+}
+
+// blocking returns true if the blocklist blocks at now.
+func (scheduledBlocklist *scheduledBlocklist) blocking(now time.Time) bool {
+	return scheduledBlocklist.schedule.active(now) == scheduledBlocklist.blockWhenActive
+}
+
+// scheduledBlocklists are the scheduled blocklists of a client group.  They are checked at query
+// time, after the cache, so a schedule change applies to cached responses.
+type scheduledBlocklists []*scheduledBlocklist
+
+// blockingScheduledBlocklist returns the first blocking scheduled blocklist with domainName
+// blocked, or nil.
+func (scheduledBlocklists scheduledBlocklists) blockingScheduledBlocklist(domainName string, now time.Time) *scheduledBlocklist {
+	for _, scheduledBlocklist := range scheduledBlocklists {
+		if scheduledBlocklist.blocking(now) && (scheduledBlocklist.blocklist.check(domainName) == blocklistBlocked) {
+			return scheduledBlocklist
+		}
+	}
+	return nil
+}
+
+// blockedCNAMETarget returns the first CNAME target blocked by a blocking scheduled blocklist,
+// or "" if none is blocked.
+func (scheduledBlocklists scheduledBlocklists) blockedCNAMETarget(response *dns.Msg, now time.Time) string {
+	for _, scheduledBlocklist := range scheduledBlocklists {
+		if !scheduledBlocklist.blocking(now) {
+			continue
+		}
+		if cnameTarget := scheduledBlocklist.blocklist.blockedCNAMETarget(response); len(cnameTarget) > 0 {
+			return cnameTarget
+		}
+	}
+	return ""
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "00:00", want: 0},
+		{value: "06:30", want: 390},
+		{value: "22:00", want: 1320},
+		{value: "24:00", want: minutesPerDay},
+		{value: "24:01", wantErr: true},
+		{value: "12:60", wantErr: true},
+		{value: "-1:00", wantErr: true},
+		{value: "noon", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := parseScheduleTime(test.value)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseScheduleTime error = %v, wantErr %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("parseScheduleTime = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestScheduleActive(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("time.LoadLocation error: %v", err)
+	}
+
+	// school nights: 22:00 to 06:00 starting Sunday through Thursday
+	schoolNights, err := newSchedule(&ScheduleConfiguration{
+		Days:       []string{"sun", "Monday", "tue", "wed", "thursday"},
+		TimeRanges: []ScheduleTimeRangeConfiguration{{Start: "22:00", End: "06:00"}},
+		TimeZone:   "America/New_York",
+	})
+	if err != nil {
+		t.Fatalf("newSchedule error: %v", err)
+	}
+
+	everyEvening, err := newSchedule(&ScheduleConfiguration{
+		TimeRanges: []ScheduleTimeRangeConfiguration{{Start: "18:00", End: "24:00"}},
+		TimeZone:   "America/New_York",
+	})
+	if err != nil {
+		t.Fatalf("newSchedule error: %v", err)
+	}
+
+	// 2020-01-05 is a Sunday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2020, 1, day, hour, minute, 0, 0, newYork)
+	}
+
+	tests := []struct {
+		name     string
+		schedule *schedule
+		now      time.Time
+		want     bool
+	}{
+		{name: "sunday before start", schedule: schoolNights, now: at(5, 21, 59), want: false},
+		{name: "sunday at start", schedule: schoolNights, now: at(5, 22, 0), want: true},
+		{name: "monday morning after sunday night", schedule: schoolNights, now: at(6, 5, 59), want: true},
+		{name: "monday at end", schedule: schoolNights, now: at(6, 6, 0), want: false},
+		{name: "monday afternoon", schedule: schoolNights, now: at(6, 15, 0), want: false},
+		{name: "thursday night", schedule: schoolNights, now: at(9, 23, 30), want: true},
+		{name: "friday morning after thursday night", schedule: schoolNights, now: at(10, 1, 0), want: true},
+		{name: "friday night", schedule: schoolNights, now: at(10, 23, 0), want: false},
+		{name: "saturday morning after friday night", schedule: schoolNights, now: at(11, 1, 0), want: false},
+		{name: "saturday night", schedule: schoolNights, now: at(11, 23, 0), want: false},
+		{name: "sunday morning after saturday night", schedule: schoolNights, now: at(5, 1, 0), want: false},
+		{name: "time zone conversion", schedule: schoolNights, now: at(6, 3, 0).UTC(), want: true},
+		{name: "UTC outside the range in New York", schedule: schoolNights, now: time.Date(2020, 1, 6, 23, 0, 0, 0, time.UTC), want: false},
+		{name: "range ending at 24:00", schedule: everyEvening, now: at(8, 23, 59), want: true},
+		{name: "after range ending at 24:00", schedule: everyEvening, now: at(9, 0, 0), want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.schedule.active(test.now); got != test.want {
+				t.Errorf("active(%v) = %v, want %v", test.now, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNewScheduleErrors(t *testing.T) {
+	timeRanges := []ScheduleTimeRangeConfiguration{{Start: "22:00", End: "06:00"}}
+
+	tests := []struct {
+		name          string
+		configuration ScheduleConfiguration
+	}{
+		{name: "no time ranges", configuration: ScheduleConfiguration{}},
+		{name: "invalid day", configuration: ScheduleConfiguration{Days: []string{"someday"}, TimeRanges: timeRanges}},
+		{name: "invalid time", configuration: ScheduleConfiguration{TimeRanges: []ScheduleTimeRangeConfiguration{{Start: "25:00", End: "06:00"}}}},
+		{name: "invalid time zone", configuration: ScheduleConfiguration{TimeRanges: timeRanges, TimeZone: "Mars/Olympus_Mons"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newSchedule(&test.configuration); err == nil {
+				t.Errorf("newSchedule error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestScheduledBlocklistBlocking(t *testing.T) {
+	namedRules := map[string]*blocklistRules{
+		"social": {blockedDomains: []string{"social.example."}},
+	}
+	allowlistRules := &blocklistRules{exactAllowedDomains: []string{"allowed.social.example."}}
+
+	// 2020-01-06 is a Monday
+	during := time.Date(2020, 1, 6, 23, 0, 0, 0, time.UTC)
+	outside := time.Date(2020, 1, 6, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		action     string
+		domainName string
+		now        time.Time
+		want       bool
+	}{
+		{name: "enable during", domainName: "www.social.example.", now: during, want: true},
+		{name: "enable outside", domainName: "www.social.example.", now: outside, want: false},
+		{name: "enable blocked domains", domainName: "games.example.", now: during, want: true},
+		{name: "enable allowlist", domainName: "allowed.social.example.", now: during, want: false},
+		{name: "disable during", action: scheduleActionDisable, domainName: "www.social.example.", now: during, want: false},
+		{name: "disable outside", action: scheduleActionDisable, domainName: "www.social.example.", now: outside, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scheduledBlocklist, err := newScheduledBlocklist(&ScheduleConfiguration{
+				Name:           "school nights",
+				Action:         test.action,
+				TimeRanges:     []ScheduleTimeRangeConfiguration{{Start: "22:00", End: "06:00"}},
+				TimeZone:       "UTC",
+				Blocklists:     []string{"social"},
+				BlockedDomains: []string{"games.example"},
+			}, namedRules, allowlistRules)
+			if err != nil {
+				t.Fatalf("newScheduledBlocklist error: %v", err)
+			}
+
+			scheduledBlocklists := scheduledBlocklists{scheduledBlocklist}
+			if got := scheduledBlocklists.blockingScheduledBlocklist(test.domainName, test.now) != nil; got != test.want {
+				t.Errorf("blockingScheduledBlocklist(%q) blocked = %v, want %v", test.domainName, got, test.want)
+			}
+		})
+	}
+
+	if _, err := newScheduledBlocklist(&ScheduleConfiguration{
+		Name:       "unknown",
+		TimeRanges: []ScheduleTimeRangeConfiguration{{Start: "22:00", End: "06:00"}},
+		Blocklists: []string{"missing"},
+	}, namedRules, allowlistRules); err == nil {
+		t.Errorf("newScheduledBlocklist with unknown blocklist error = nil, want error")
+	}
+}
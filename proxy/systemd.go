@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemd socket activation and service notification, see sd_listen_fds(3) and sd_notify(3).
+
+const systemdListenFDsStart = 3
+
+// systemdSocket is a socket passed by systemd.  Exactly one of packetConn and listener is set.
+type systemdSocket struct {
+	name       string
+	packetConn net.PacketConn
+	listener   net.Listener
+}
+
+// systemdSockets returns the sockets passed by systemd socket activation, if any.  The
+// environment variables are unset so child processes do not inherit them.
+func systemdSockets() ([]systemdSocket, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	listenFDs, names, err := parseSystemdListenFDs(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+	if (err != nil) || (listenFDs == 0) {
+		return nil, err
+	}
+
+	files := make([]*os.File, 0, listenFDs)
+	for i := 0; i < listenFDs; i++ {
+		fd := systemdListenFDsStart + i
+		files = append(files, os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%v", fd)))
+	}
+
+	return systemdSocketsFromFiles(files, names)
+}
+
+// parseSystemdListenFDs returns the number of sockets and their names from the LISTEN_PID,
+// LISTEN_FDS, and LISTEN_FDNAMES values.  There are no sockets if LISTEN_PID is not pid.
+func parseSystemdListenFDs(listenPID, listenFDs, listenFDNames string, pid int) (count int, names []string, err error) {
+	if len(listenPID) == 0 {
+		return
+	}
+
+	if parsedPID, parseErr := strconv.Atoi(listenPID); (parseErr != nil) || (parsedPID != pid) {
+		return
+	}
+
+	count, err = strconv.Atoi(listenFDs)
+	if err != nil {
+		err = fmt.Errorf("invalid LISTEN_FDS: %w", err)
+		return
+	}
+	if count < 0 {
+		err = fmt.Errorf("invalid LISTEN_FDS: %v", count)
+		count = 0
+		return
+	}
+
+	if len(listenFDNames) > 0 {
+		names = strings.Split(listenFDNames, ":")
+	}
+	return
+}
+
+// systemdSocketsFromFiles wraps socket files named by names in order.  The files are closed, and
+// if any is not a listening socket the sockets already wrapped are closed too.
+func systemdSocketsFromFiles(files []*os.File, names []string) (sockets []systemdSocket, err error) {
+	for i, file := range files {
+		socket := systemdSocket{}
+		if i < len(names) {
+			socket.name = names[i]
+		}
+
+		// net.FileListener and net.FilePacketConn dup the fd, so file is closed either way.
+		if err == nil {
+			if listener, listenerErr := net.FileListener(file); listenerErr == nil {
+				socket.listener = listener
+			} else if packetConn, packetConnErr := net.FilePacketConn(file); packetConnErr == nil {
+				socket.packetConn = packetConn
+			} else {
+				err = fmt.Errorf("%v is not a listening socket: %v, %v", file.Name(), listenerErr, packetConnErr)
+			}
+		}
+		file.Close()
+
+		if err == nil {
+			sockets = append(sockets, socket)
+		}
+	}
+
+	if err != nil {
+		closeSystemdSockets(sockets)
+		sockets = nil
+	}
+	return
+}
+
+// closeSystemdSockets closes sockets not yet passed to a server.
+func closeSystemdSockets(sockets []systemdSocket) {
+	for _, socket := range sockets {
+		if socket.listener != nil {
+			socket.listener.Close()
+		}
+		if socket.packetConn != nil {
+			socket.packetConn.Close()
+		}
+	}
+}
+
+// sdNotify sends a state like "READY=1" to the service manager.  It does nothing when not run by systemd.
+func sdNotify(state string) error {
+	notifySocket := os.Getenv("NOTIFY_SOCKET")
+	if len(notifySocket) == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("unixgram", notifySocket)
+	if err != nil {
+		return fmt.Errorf("net.Dial error: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("conn.Write error: %w", err)
+	}
+
+	return nil
+}
+
+func logSDNotify(state string) {
+	if err := sdNotify(state); err != nil {
+		log.Printf("sdNotify %q error: %v", state, err)
+	}
+}
+
+// systemdWatchdog sends WATCHDOG=1 at half the WatchdogSec interval while healthCheck passes.
+type systemdWatchdog struct {
+	backgroundTask *backgroundTask
+	interval       time.Duration
+}
+
+func newSystemdWatchdog() *systemdWatchdog {
+	systemdWatchdog := &systemdWatchdog{
+		backgroundTask: newBackgroundTask(),
+	}
+
+	watchdogUSec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if (err != nil) || (watchdogUSec <= 0) {
+		return systemdWatchdog
+	}
+
+	if watchdogPID := os.Getenv("WATCHDOG_PID"); len(watchdogPID) > 0 {
+		if pid, err := strconv.Atoi(watchdogPID); (err != nil) || (pid != os.Getpid()) {
+			return systemdWatchdog
+		}
+	}
+
+	systemdWatchdog.interval = time.Duration(watchdogUSec) * time.Microsecond / 2
+
+	return systemdWatchdog
+}
+
+func (systemdWatchdog *systemdWatchdog) runWatchdogLoop(healthCheck func() error) {
+	ticker := time.NewTicker(systemdWatchdog.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := healthCheck(); err != nil {
+				log.Printf("health check failed, not sending watchdog ping: %v", err)
+				continue
+			}
+			logSDNotify("WATCHDOG=1")
+
+		case <-systemdWatchdog.backgroundTask.stopping():
+			return
+		}
+	}
+}
+
+func (systemdWatchdog *systemdWatchdog) start(healthCheck func() error) {
+	if systemdWatchdog.interval <= 0 {
+		return
+	}
+
+	log.Printf("systemdWatchdog.start interval = %v", systemdWatchdog.interval)
+
+	systemdWatchdog.backgroundTask.run(func() {
+		systemdWatchdog.runWatchdogLoop(healthCheck)
+	})
+}
+
+func (systemdWatchdog *systemdWatchdog) stop(ctx context.Context) error {
+	return systemdWatchdog.backgroundTask.stop(ctx)
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestParseSystemdListenFDs(t *testing.T) {
+	const pid = 1234
+
+	tests := []struct {
+		name          string
+		listenPID     string
+		listenFDs     string
+		listenFDNames string
+		wantCount     int
+		wantNames     []string
+		wantErr       bool
+	}{
+		{name: "not socket activated"},
+		{name: "other pid", listenPID: "4321", listenFDs: "2"},
+		{name: "invalid pid", listenPID: "self", listenFDs: "2"},
+		{name: "no names", listenPID: "1234", listenFDs: "2", wantCount: 2},
+		{name: "names", listenPID: "1234", listenFDs: "2", listenFDNames: "dns-udp:dns-tcp", wantCount: 2, wantNames: []string{"dns-udp", "dns-tcp"}},
+		{name: "fewer names than fds", listenPID: "1234", listenFDs: "3", listenFDNames: "dns-udp", wantCount: 3, wantNames: []string{"dns-udp"}},
+		{name: "invalid fds", listenPID: "1234", listenFDs: "two", wantErr: true},
+		{name: "missing fds", listenPID: "1234", wantErr: true},
+		{name: "negative fds", listenPID: "1234", listenFDs: "-1", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			count, names, err := parseSystemdListenFDs(test.listenPID, test.listenFDs, test.listenFDNames, pid)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseSystemdListenFDs error = %v, wantErr %v", err, test.wantErr)
+			}
+			if count != test.wantCount {
+				t.Errorf("count = %v, want %v", count, test.wantCount)
+			}
+			if !reflect.DeepEqual(names, test.wantNames) {
+				t.Errorf("names = %q, want %q", names, test.wantNames)
+			}
+		})
+	}
+}
+
+func TestSystemdSocketsUnsetsEnvironment(t *testing.T) {
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		defer os.Unsetenv(name)
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "2")
+	os.Setenv("LISTEN_FDNAMES", "dns-udp:dns-tcp")
+
+	sockets, err := systemdSockets()
+	if (len(sockets) != 0) || (err != nil) {
+		t.Errorf("systemdSockets for another pid = %v, %v, want none", sockets, err)
+	}
+
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if value, ok := os.LookupEnv(name); ok {
+			t.Errorf("%v = %q after systemdSockets, want unset", name, value)
+		}
+	}
+}
+
+// testOpenFDs returns the number of open fds, skipping the test where /proc/self/fd does not exist.
+func testOpenFDs(t *testing.T) int {
+	fileInfos, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("ioutil.ReadDir error: %v", err)
+	}
+	return len(fileInfos)
+}
+
+// newTestSocketFiles returns files for a UDP socket and a TCP listener, as systemd passes them.
+func newTestSocketFiles(t *testing.T) []*os.File {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("net.ListenUDP error: %v", err)
+	}
+	t.Cleanup(func() { udpConn.Close() })
+
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("net.ListenTCP error: %v", err)
+	}
+	t.Cleanup(func() { tcpListener.Close() })
+
+	udpFile, err := udpConn.File()
+	if err != nil {
+		t.Fatalf("udpConn.File error: %v", err)
+	}
+	tcpFile, err := tcpListener.File()
+	if err != nil {
+		t.Fatalf("tcpListener.File error: %v", err)
+	}
+	return []*os.File{udpFile, tcpFile}
+}
+
+func TestSystemdSocketsFromFiles(t *testing.T) {
+	sockets, err := systemdSocketsFromFiles(newTestSocketFiles(t), []string{"dns-udp", "dns-tcp"})
+	if err != nil {
+		t.Fatalf("systemdSocketsFromFiles error: %v", err)
+	}
+	defer closeSystemdSockets(sockets)
+
+	if len(sockets) != 2 {
+		t.Fatalf("len(sockets) = %v, want 2", len(sockets))
+	}
+	if (sockets[0].name != "dns-udp") || (sockets[0].packetConn == nil) || (sockets[0].listener != nil) {
+		t.Errorf("sockets[0] = %+v, want packetConn dns-udp", sockets[0])
+	}
+	if (sockets[1].name != "dns-tcp") || (sockets[1].listener == nil) || (sockets[1].packetConn != nil) {
+		t.Errorf("sockets[1] = %+v, want listener dns-tcp", sockets[1])
+	}
+}
+
+func TestSystemdSocketsFromFilesClosesOnPartialFailure(t *testing.T) {
+	socketFiles := newTestSocketFiles(t)
+
+	notSocket, err := os.Create(filepath.Join(t.TempDir(), "not-a-socket"))
+	if err != nil {
+		t.Fatalf("os.Create error: %v", err)
+	}
+
+	// the socket files are closed too, so count fds as if they were not open
+	openFDs := testOpenFDs(t) - len(socketFiles) - 1
+
+	files := []*os.File{socketFiles[0], notSocket, socketFiles[1]}
+	sockets, err := systemdSocketsFromFiles(files, []string{"dns-udp", "not-a-socket", "dns-tcp"})
+	if err == nil {
+		closeSystemdSockets(sockets)
+		t.Fatalf("systemdSocketsFromFiles error = nil, want error")
+	}
+	if sockets != nil {
+		t.Errorf("sockets = %v, want nil", sockets)
+	}
+
+	if got := testOpenFDs(t); got != openFDs {
+		t.Errorf("open fds = %v, want %v", got, openFDs)
+	}
+}
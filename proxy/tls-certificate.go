@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// tlsCertificateCheckInterval is how often the certificate files are checked for changes.
+const tlsCertificateCheckInterval = 10 * time.Second
+
+// tlsCertificateReloader serves a certificate from files.  A timer goroutine reloads it when the
+// files change, so handshakes only load the current certificate.
+type tlsCertificateReloader struct {
+	configuration    *TLSConfiguration
+	backgroundTask   *backgroundTask
+	certificateValue atomic.Value
+	// the file mod times are used only by load and the timer goroutine
+	certFileModTime time.Time
+	keyFileModTime  time.Time
+}
+
+func newTLSCertificateReloader(configuration *TLSConfiguration) (*tlsCertificateReloader, error) {
+	tlsCertificateReloader := &tlsCertificateReloader{
+		configuration:  configuration,
+		backgroundTask: newBackgroundTask(),
+	}
+
+	if err := tlsCertificateReloader.load(); err != nil {
+		return nil, err
+	}
+
+	return tlsCertificateReloader, nil
+}
+
+func fileModTime(file string) (time.Time, error) {
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fileInfo.ModTime(), nil
+}
+
+// load must be called from the timer goroutine or before it is started.
+func (tlsCertificateReloader *tlsCertificateReloader) load() error {
+	certFileModTime, err := fileModTime(tlsCertificateReloader.configuration.CertFile)
+	if err != nil {
+		return fmt.Errorf("certFile stat error: %w", err)
+	}
+
+	keyFileModTime, err := fileModTime(tlsCertificateReloader.configuration.KeyFile)
+	if err != nil {
+		return fmt.Errorf("keyFile stat error: %w", err)
+	}
+
+	certificate, err := tls.LoadX509KeyPair(tlsCertificateReloader.configuration.CertFile, tlsCertificateReloader.configuration.KeyFile)
+	if err != nil {
+		return fmt.Errorf("tls.LoadX509KeyPair error: %w", err)
+	}
+
+	tlsCertificateReloader.certificateValue.Store(&certificate)
+	tlsCertificateReloader.certFileModTime = certFileModTime
+	tlsCertificateReloader.keyFileModTime = keyFileModTime
+
+	log.Printf("loaded TLS certificate certFile = %q keyFile = %q", tlsCertificateReloader.configuration.CertFile, tlsCertificateReloader.configuration.KeyFile)
+
+	return nil
+}
+
+// reloadIfChanged keeps the current certificate if the changed files fail to load.
+func (tlsCertificateReloader *tlsCertificateReloader) reloadIfChanged() {
+	certFileModTime, certErr := fileModTime(tlsCertificateReloader.configuration.CertFile)
+	keyFileModTime, keyErr := fileModTime(tlsCertificateReloader.configuration.KeyFile)
+	if (certErr != nil) || (keyErr != nil) {
+		log.Printf("TLS certificate stat error certFile: %v keyFile: %v", certErr, keyErr)
+		return
+	}
+
+	if certFileModTime.Equal(tlsCertificateReloader.certFileModTime) && keyFileModTime.Equal(tlsCertificateReloader.keyFileModTime) {
+		return
+	}
+
+	if err := tlsCertificateReloader.load(); err != nil {
+		log.Printf("TLS certificate reload error: %v", err)
+	}
+}
+
+func (tlsCertificateReloader *tlsCertificateReloader) runPeriodicTimer() {
+	ticker := time.NewTicker(tlsCertificateCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			tlsCertificateReloader.reloadIfChanged()
+
+		case <-tlsCertificateReloader.backgroundTask.stopping():
+			return
+		}
+	}
+}
+
+func (tlsCertificateReloader *tlsCertificateReloader) start() {
+	log.Printf("tlsCertificateReloader.start")
+
+	tlsCertificateReloader.backgroundTask.run(tlsCertificateReloader.runPeriodicTimer)
+}
+
+func (tlsCertificateReloader *tlsCertificateReloader) stop(ctx context.Context) error {
+	log.Printf("tlsCertificateReloader.stop")
+
+	return tlsCertificateReloader.backgroundTask.stop(ctx)
+}
+
+func (tlsCertificateReloader *tlsCertificateReloader) certificate() *tls.Certificate {
+	return tlsCertificateReloader.certificateValue.Load().(*tls.Certificate)
+}
+
+func (tlsCertificateReloader *tlsCertificateReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return tlsCertificateReloader.certificate(), nil
+}
+
+func (tlsCertificateReloader *tlsCertificateReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: tlsCertificateReloader.getCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for commonName and its key, with file
+// mod times of modTime.
+func writeTestCertificate(t *testing.T, configuration *TLSConfiguration, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey error: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certificateDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("x509.CreateCertificate error: %v", err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("x509.MarshalECPrivateKey error: %v", err)
+	}
+
+	writeTestPEMFile(t, configuration.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificateDER}), modTime)
+	writeTestPEMFile(t, configuration.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), modTime)
+}
+
+func writeTestPEMFile(t *testing.T, file string, contents []byte, modTime time.Time) {
+	if err := ioutil.WriteFile(file, contents, 0600); err != nil {
+		t.Fatalf("ioutil.WriteFile error: %v", err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatalf("os.Chtimes error: %v", err)
+	}
+}
+
+func testCertificateCommonName(t *testing.T, tlsCertificateReloader *tlsCertificateReloader) string {
+	certificate, err := tlsCertificateReloader.getCertificate(nil)
+	if err != nil {
+		t.Fatalf("getCertificate error: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatalf("x509.ParseCertificate error: %v", err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func newTestTLSConfiguration(t *testing.T) *TLSConfiguration {
+	directory := t.TempDir()
+	return &TLSConfiguration{
+		CertFile: filepath.Join(directory, "cert.pem"),
+		KeyFile:  filepath.Join(directory, "key.pem"),
+	}
+}
+
+func TestTLSCertificateReloader(t *testing.T) {
+	configuration := newTestTLSConfiguration(t)
+	modTime := time.Now().Add(-time.Hour)
+	writeTestCertificate(t, configuration, "first", modTime)
+
+	tlsCertificateReloader, err := newTLSCertificateReloader(configuration)
+	if err != nil {
+		t.Fatalf("newTLSCertificateReloader error: %v", err)
+	}
+	if commonName := testCertificateCommonName(t, tlsCertificateReloader); commonName != "first" {
+		t.Errorf("certificate = %q, want first", commonName)
+	}
+
+	// unchanged files are not loaded again
+	certificate := tlsCertificateReloader.certificate()
+	tlsCertificateReloader.reloadIfChanged()
+	if tlsCertificateReloader.certificate() != certificate {
+		t.Errorf("certificate reloaded with unchanged files")
+	}
+
+	modTime = modTime.Add(time.Minute)
+	writeTestCertificate(t, configuration, "second", modTime)
+	tlsCertificateReloader.reloadIfChanged()
+	if commonName := testCertificateCommonName(t, tlsCertificateReloader); commonName != "second" {
+		t.Errorf("certificate after change = %q, want second", commonName)
+	}
+
+	// a certificate that does not load keeps the current one
+	modTime = modTime.Add(time.Minute)
+	writeTestPEMFile(t, configuration.CertFile, []byte("not a certificate"), modTime)
+	tlsCertificateReloader.reloadIfChanged()
+	if commonName := testCertificateCommonName(t, tlsCertificateReloader); commonName != "second" {
+		t.Errorf("certificate after invalid change = %q, want second", commonName)
+	}
+
+	if err := os.Remove(configuration.KeyFile); err != nil {
+		t.Fatalf("os.Remove error: %v", err)
+	}
+	tlsCertificateReloader.reloadIfChanged()
+	if commonName := testCertificateCommonName(t, tlsCertificateReloader); commonName != "second" {
+		t.Errorf("certificate after removed key = %q, want second", commonName)
+	}
+}
+
+func TestNewTLSCertificateReloaderErrors(t *testing.T) {
+	configuration := newTestTLSConfiguration(t)
+	if _, err := newTLSCertificateReloader(configuration); err == nil {
+		t.Errorf("newTLSCertificateReloader with missing files error = nil, want error")
+	}
+
+	writeTestCertificate(t, configuration, "test", time.Now())
+	writeTestPEMFile(t, configuration.KeyFile, []byte("not a key"), time.Now())
+	if _, err := newTLSCertificateReloader(configuration); err == nil {
+		t.Errorf("newTLSCertificateReloader with invalid key error = nil, want error")
+	}
+}
+
+// TestTLSCertificateReloaderConcurrentHandshakes fails with -race if handshakes read the
+// certificate while the timer goroutine replaces it.
+func TestTLSCertificateReloaderConcurrentHandshakes(t *testing.T) {
+	configuration := newTestTLSConfiguration(t)
+	modTime := time.Now().Add(-time.Hour)
+	writeTestCertificate(t, configuration, "first", modTime)
+
+	tlsCertificateReloader, err := newTLSCertificateReloader(configuration)
+	if err != nil {
+		t.Fatalf("newTLSCertificateReloader error: %v", err)
+	}
+	tlsCertificateReloader.start()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if certificate, err := tlsCertificateReloader.tlsConfig().GetCertificate(nil); (certificate == nil) || (err != nil) {
+					t.Errorf("GetCertificate = %v, %v", certificate, err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		modTime = modTime.Add(time.Minute)
+		writeTestCertificate(t, configuration, "next", modTime)
+		tlsCertificateReloader.reloadIfChanged()
+	}
+	wg.Wait()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := tlsCertificateReloader.stop(ctx); err != nil {
+		t.Errorf("stop error: %v", err)
+	}
+}